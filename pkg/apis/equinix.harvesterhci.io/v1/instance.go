@@ -1,10 +1,26 @@
 package v1
 
 import (
+	"github.com/rancher/wrangler/pkg/condition"
+	"github.com/rancher/wrangler/pkg/genericcondition"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+var (
+	// InstanceNetworkSynced reports whether the port configuration of the device matches
+	// the NetworkingConfiguration of the instance
+	InstanceNetworkSynced condition.Cond = "NetworkSynced"
+	// InstanceDataDisksProvisioned reports whether the selected disks of the node have been
+	// provisioned as Longhorn data disks
+	InstanceDataDisksProvisioned condition.Cond = "DataDisksProvisioned"
+	// InstanceInstalled reports the progress of the harvester install received through install webhooks
+	InstanceInstalled condition.Cond = "Installed"
+	// InstanceReconciled reports errors of the equinix metal api which stopped the instance from
+	// being reconciled, with the class of the error as reason
+	InstanceReconciled condition.Cond = "Reconciled"
+)
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -34,14 +50,100 @@ type InstanceSpec struct {
 	ManagementInterfaces     []string          `json:"managementInterfaces,omitempty"`
 	ManagementBondingOptions map[string]string `json:"managementBondingOptions,omitempty"`
 	NetworkingConfiguration  `json:"networkingConfiguration,omitempty"`
+	ManagementAddress        *ManagementAddress     `json:"managementAddress,omitempty"`
+	ReservedIPAddress        string                 `json:"reservedIPAddress,omitempty"`
+	BGP                      *BGPConfiguration      `json:"bgp,omitempty"`
+	IPAddresses              []IPAddressRequest     `json:"ipAddresses,omitempty"`
+	DataDisks                *DataDiskConfiguration `json:"dataDisks,omitempty"`
+	ConsoleLog               bool                   `json:"consoleLog,omitempty"`
+}
+
+// ManagementAddress is a static address configured on the harvester-mgmt network of the node
+type ManagementAddress struct {
+	IP             string   `json:"ip"`
+	SubnetMask     string   `json:"subnetMask"`
+	Gateway        string   `json:"gateway"`
+	DNSNameservers []string `json:"dnsNameservers,omitempty"`
 }
 
 // InstanceStatus defines the observed state of Instance
 type InstanceStatus struct {
-	Status     string `json:"status"`
-	InstanceID string `json:"instanceID"`
-	PublicIP   string `json:"publicIP"`
-	PrivateIP  string `json:"privateIP"`
+	Status      string             `json:"status"`
+	InstanceID  string             `json:"instanceID"`
+	PublicIP    string             `json:"publicIP"`
+	PrivateIP   string             `json:"privateIP"`
+	PublicIPv6  string             `json:"publicIPv6,omitempty"`
+	Addresses   []AddressStatus    `json:"addresses,omitempty"`
+	NetworkType string             `json:"networkType,omitempty"`
+	Ports       []PortStatus       `json:"ports,omitempty"`
+	VLANBatches []VLANBatchStatus  `json:"vlanBatches,omitempty"`
+	ReservedIP  *ReservedIPStatus  `json:"reservedIP,omitempty"`
+	BGPSessions []BGPSessionStatus `json:"bgpSessions,omitempty"`
+	DataDisks   []string           `json:"dataDisks,omitempty"`
+	Device      *DeviceMetadata    `json:"device,omitempty"`
+	// FailedGeneration is the generation of the spec which failed with a permanent error of the
+	// Metal api, the instance is not reconciled again until its spec changes
+	FailedGeneration int64                               `json:"failedGeneration,omitempty"`
+	Conditions       []genericcondition.GenericCondition `json:"conditions,omitempty"`
+}
+
+// DeviceMetadata records details of the Metal device backing the instance
+type DeviceMetadata struct {
+	Hostname               string       `json:"hostname,omitempty"`
+	Plan                   string       `json:"plan,omitempty"`
+	Facility               string       `json:"facility,omitempty"`
+	Metro                  string       `json:"metro,omitempty"`
+	State                  string       `json:"state,omitempty"`
+	CreatedAt              *metav1.Time `json:"createdAt,omitempty"`
+	ProvisionedAt          *metav1.Time `json:"provisionedAt,omitempty"`
+	ProvisioningPercentage int          `json:"provisioningPercentage,omitempty"`
+	SOS                    string       `json:"sos,omitempty"`
+	HardwareReservationID  string       `json:"hardwareReservationID,omitempty"`
+	SpotInstance           bool         `json:"spotInstance,omitempty"`
+	TerminationTime        *metav1.Time `json:"terminationTime,omitempty"`
+}
+
+// AddressStatus records an address assigned to the device
+type AddressStatus struct {
+	Address       string `json:"address"`
+	AddressFamily int    `json:"addressFamily"`
+	Public        bool   `json:"public"`
+	CIDR          int    `json:"cidr"`
+	Network       string `json:"network,omitempty"`
+	Gateway       string `json:"gateway,omitempty"`
+	Management    bool   `json:"management,omitempty"`
+}
+
+// ReservedIPStatus records the assignment of an address from a reserved IP block to the device
+type ReservedIPStatus struct {
+	AssignmentID string `json:"assignmentID"`
+	Address      string `json:"address"`
+	CIDR         int    `json:"cidr"`
+	Gateway      string `json:"gateway,omitempty"`
+}
+
+// BGPSessionStatus records a bgp session of the device
+type BGPSessionStatus struct {
+	ID            string `json:"id"`
+	AddressFamily string `json:"addressFamily"`
+	Status        string `json:"status,omitempty"`
+}
+
+// VLANBatchStatus references a VLAN assignment batch submitted for a port, which Metal
+// processes asynchronously
+type VLANBatchStatus struct {
+	Port    string `json:"port"`
+	PortID  string `json:"portID"`
+	BatchID string `json:"batchID"`
+}
+
+// PortStatus records the observed configuration of a device port
+type PortStatus struct {
+	Name       string   `json:"name"`
+	MAC        string   `json:"mac,omitempty"`
+	Bond       string   `json:"bond,omitempty"`
+	VLANs      []string `json:"vlans,omitempty"`
+	NativeVLAN string   `json:"nativeVlan,omitempty"`
 }
 
 // +genclient
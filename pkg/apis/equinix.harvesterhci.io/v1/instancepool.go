@@ -1,10 +1,29 @@
 package v1
 
 import (
+	"github.com/rancher/wrangler/pkg/condition"
+	"github.com/rancher/wrangler/pkg/genericcondition"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+var (
+	// InstancePoolVersionCompatible reports whether the harvesterVersion of the pool matches
+	// the version of the running cluster
+	InstancePoolVersionCompatible condition.Cond = "VersionCompatible"
+	// InstancePoolArtifactsVerified reports whether the install artifacts match their pinned checksums
+	InstancePoolArtifactsVerified condition.Cond = "ArtifactsVerified"
+	// InstancePoolCredentialsValid is false while the equinix metal api rejects the credentials of
+	// the pool, which pauses the pool and its instances
+	InstancePoolCredentialsValid condition.Cond = "CredentialsValid"
+	// InstancePoolReconciled reports errors of the equinix metal api which stopped the pool from
+	// being reconciled, with the class of the error as reason
+	InstancePoolReconciled condition.Cond = "Reconciled"
+	// InstancePoolWithinBudget reports whether the estimated cost of the pool fits the budgets of the
+	// pool and its project
+	InstancePoolWithinBudget condition.Cond = "WithinBudget"
+)
+
 // +genclient
 // +genclient:nonNamespaced
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -19,6 +38,8 @@ type InstancePool struct {
 
 type InstancePoolSpec struct {
 	Count                    int               `json:"count"`
+	MinCount                 int               `json:"minCount,omitempty"`
+	MaxCount                 int               `json:"maxCount,omitempty"`
 	BillingCycle             string            `json:"billingCycle,omitempty"`
 	SpotInstance             bool              `json:"spotInstance,omitempty"`
 	SpotPriceMax             resource.Quantity `json:"spotPriceMax,omitempty"`
@@ -36,24 +57,215 @@ type InstancePoolSpec struct {
 	Facility                 []string          `json:"facility,omitempty"`
 	NodeCleanupWaitInterval  *metav1.Duration  `json:"nodeCleanupWaitInterval,omitempty"`
 	NetworkingConfiguration  `json:"networkingConfiguration,omitempty"`
+	StaticIPPool             *StaticIPPool             `json:"staticIPPool,omitempty"`
+	PublicIPv4SubnetSize     int                       `json:"publicIPv4SubnetSize,omitempty"`
+	ReservedIPBlock          *ReservedIPBlock          `json:"reservedIPBlock,omitempty"`
+	BGP                      *BGPConfiguration         `json:"bgp,omitempty"`
+	IPAddresses              []IPAddressRequest        `json:"ipAddresses,omitempty"`
+	HarvesterConfig          string                    `json:"harvesterConfig,omitempty"`
+	HarvesterConfigRef       *HarvesterConfigRef       `json:"harvesterConfigRef,omitempty"`
+	DataDisks                *DataDiskConfiguration    `json:"dataDisks,omitempty"`
+	HarvesterVersion         string                    `json:"harvesterVersion,omitempty"`
+	Checksums                *ArtifactChecksums        `json:"checksums,omitempty"`
+	DisablePasswordLogin     bool                      `json:"disablePasswordLogin,omitempty"`
+	SSHAuthorizedKeys        []string                  `json:"sshAuthorizedKeys,omitempty"`
+	SSHAuthorizedKeysSecret  string                    `json:"sshAuthorizedKeysSecret,omitempty"`
+	Template                 *InstanceTemplate         `json:"template,omitempty"`
+	ConsoleLog               bool                      `json:"consoleLog,omitempty"`
+	Budget                   *Budget                   `json:"budget,omitempty"`
+	Autoscaling              *AutoscalingConfiguration `json:"autoscaling,omitempty"`
+}
+
+// InstanceTemplate is copied into every Instance created by the pool. Fields of the pool spec only
+// fill in fields left empty in the template, while the fields managed by the operator (os, project,
+// userdata, ipxe script, networking, addresses, bgp and data disks) always follow the pool.
+type InstanceTemplate struct {
+	Metadata InstanceTemplateMetadata `json:"metadata,omitempty"`
+	Spec     InstanceSpec             `json:"spec,omitempty"`
+}
+
+// InstanceTemplateMetadata holds the labels and annotations added to every Instance of the pool
+type InstanceTemplateMetadata struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ArtifactChecksums pins the sha256 checksums of the install artifacts. Artifacts are verified
+// by the operator before instances are submitted.
+type ArtifactChecksums struct {
+	ISO    string `json:"iso,omitempty"`
+	Kernel string `json:"kernel,omitempty"`
+	Initrd string `json:"initrd,omitempty"`
+	RootFS string `json:"rootfs,omitempty"`
+}
+
+// HarvesterRelease records the install artifacts resolved for the harvesterVersion of the pool
+type HarvesterRelease struct {
+	Version   string `json:"version,omitempty"`
+	ISOURL    string `json:"isoUrl,omitempty"`
+	KernelURL string `json:"kernelUrl,omitempty"`
+	InitrdURL string `json:"initrdUrl,omitempty"`
+	RootFSURL string `json:"rootfsUrl,omitempty"`
+}
+
+// DataDiskConfiguration selects the disks of a node which are provisioned as Longhorn data disks
+// once the node has joined. Disks are selected by the data disks of the plan catalogue and by path,
+// and filtered by minimum size; without paths no disk is selected.
+type DataDiskConfiguration struct {
+	PlanDisks      bool               `json:"planDisks,omitempty"`
+	Paths          []string           `json:"paths,omitempty"`
+	MinSize        *resource.Quantity `json:"minSize,omitempty"`
+	ForceFormatted bool               `json:"forceFormatted,omitempty"`
+}
+
+// HarvesterConfigRef points to a key of a ConfigMap or Secret in the operator namespace holding
+// a partial harvester config, for overrides carrying credentials such as proxy passwords
+type HarvesterConfigRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+}
+
+// IPAddressRequest selects an address family and visibility requested for the device. When the
+// list is empty Metal assigns a public IPv4, private IPv4 and public IPv6 address.
+type IPAddressRequest struct {
+	AddressFamily int  `json:"addressFamily"`
+	Public        bool `json:"public"`
+	CIDR          int  `json:"cidr,omitempty"`
+}
+
+// BGPConfiguration enables BGP on the project and creates sessions for every instance of the pool,
+// allowing a bgp speaker on the nodes to announce LoadBalancer addresses
+type BGPConfiguration struct {
+	DeploymentType  string   `json:"deploymentType,omitempty"`
+	ASN             int      `json:"asn,omitempty"`
+	MD5             string   `json:"md5,omitempty"`
+	UseCase         string   `json:"useCase,omitempty"`
+	AddressFamilies []string `json:"addressFamilies,omitempty"`
+	DefaultRoute    bool     `json:"defaultRoute,omitempty"`
+}
+
+// ReservedIPBlock references a Metal reserved IP block from which an address is assigned to
+// every instance of the pool. When no ID is specified a block of Quantity addresses is
+// requested by the operator, and released once the pool is deleted.
+type ReservedIPBlock struct {
+	ID             string `json:"id,omitempty"`
+	Type           string `json:"type,omitempty"`
+	Quantity       int    `json:"quantity,omitempty"`
+	AssignmentCIDR int    `json:"assignmentCIDR,omitempty"`
+}
+
+// StaticIPPool is the range from which management addresses are allocated to instances.
+// It is needed for layer2 network types, where no DHCP is available to the nodes.
+type StaticIPPool struct {
+	CIDR           string   `json:"cidr"`
+	Gateway        string   `json:"gateway"`
+	RangeStart     string   `json:"rangeStart,omitempty"`
+	RangeEnd       string   `json:"rangeEnd,omitempty"`
+	DNSNameservers []string `json:"dnsNameservers,omitempty"`
 }
 
 type InstancePoolStatus struct {
-	Status    string `json:"status"`
-	Ready     int    `json:"ready"`
-	Requested int    `json:"requested"`
-	Needed    int    `json:"needed"`
-	Token     string `json:"token"`
+	Status            string                              `json:"status"`
+	Ready             int                                 `json:"ready"`
+	Requested         int                                 `json:"requested"`
+	Needed            int                                 `json:"needed"`
+	Token             string                              `json:"token"`
+	ReservedIPBlockID string                              `json:"reservedIPBlockID,omitempty"`
+	MetalGateway      *MetalGatewayStatus                 `json:"metalGateway,omitempty"`
+	Release           *HarvesterRelease                   `json:"release,omitempty"`
+	MirroredArtifacts map[string]string                   `json:"mirroredArtifacts,omitempty"`
+	EstimatedCost     *CostEstimate                       `json:"estimatedCost,omitempty"`
+	Autoscaler        *AutoscalerStatus                   `json:"autoscaler,omitempty"`
+	Conditions        []genericcondition.GenericCondition `json:"conditions,omitempty"`
+}
+
+// Budget limits the estimated cost of instances, in the currency of the Metal account. Scale-ups
+// which would exceed either limit are blocked.
+type Budget struct {
+	MaxHourlyCost  *resource.Quantity `json:"maxHourlyCost,omitempty"`
+	MaxMonthlyCost *resource.Quantity `json:"maxMonthlyCost,omitempty"`
+}
+
+// CostEstimate is the estimated cost of the requested instances of the pool
+type CostEstimate struct {
+	Plan              string `json:"plan"`
+	Instances         int    `json:"instances"`
+	HourlyPerInstance string `json:"hourlyPerInstance"`
+	Hourly            string `json:"hourly"`
+	Monthly           string `json:"monthly"`
+	Spot              bool   `json:"spot,omitempty"`
+}
+
+// AutoscalingConfiguration scales the pool between minCount and maxCount on the load of the harvester
+// cluster. Utilisation thresholds are percentages. The pool scales up when VMs can't be scheduled for
+// lack of cpu or memory, or when the utilisation of cpu, memory or storage reaches its scale-up
+// threshold. It scales down when cpu and memory utilisation are below the scale-down threshold,
+// removing only nodes without VMs whose workload fits on the remaining nodes.
+type AutoscalingConfiguration struct {
+	Enabled              bool             `json:"enabled"`
+	ScaleUpUtilization   int              `json:"scaleUpUtilization,omitempty"`
+	ScaleDownUtilization int              `json:"scaleDownUtilization,omitempty"`
+	StorageUtilization   int              `json:"storageUtilization,omitempty"`
+	ScaleUpCooldown      *metav1.Duration `json:"scaleUpCooldown,omitempty"`
+	ScaleDownCooldown    *metav1.Duration `json:"scaleDownCooldown,omitempty"`
+}
+
+// AutoscalerStatus records the signals and the last decision of the autoscaler
+type AutoscalerStatus struct {
+	DesiredCount       int          `json:"desiredCount"`
+	PendingVMs         int          `json:"pendingVMs"`
+	CPUUtilization     int          `json:"cpuUtilization"`
+	MemoryUtilization  int          `json:"memoryUtilization"`
+	StorageUtilization int          `json:"storageUtilization"`
+	LastScaleTime      *metav1.Time `json:"lastScaleTime,omitempty"`
+	LastScaleReason    string       `json:"lastScaleReason,omitempty"`
+	// Draining is the instance whose node is drained before it is removed by a scale-down
+	Draining string `json:"draining,omitempty"`
+	// ScaleUpBlocked is the reason the last scale-up was not made, such as the budget of the pool
+	ScaleUpBlocked string `json:"scaleUpBlocked,omitempty"`
 }
 
 type NetworkingConfiguration struct {
-	Type       string                   `json:"type"`
-	Interfaces []InterfaceConfiguration `json:"interfaceConfiguration"`
+	Type         string                     `json:"type"`
+	Interfaces   []InterfaceConfiguration   `json:"interfaceConfiguration"`
+	MetalGateway *MetalGatewayConfiguration `json:"metalGateway,omitempty"`
+}
+
+// MetalGatewayConfiguration attaches a routed Metal Gateway to a VLAN of the pool. A gateway referenced
+// by ID is never removed by the operator, otherwise the gateway is removed once the last pool using it
+// is deleted.
+type MetalGatewayConfiguration struct {
+	ID                    string            `json:"id,omitempty"`
+	VLAN                  string            `json:"vlan,omitempty"`
+	PrivateIPv4SubnetSize int               `json:"privateIPv4SubnetSize,omitempty"`
+	IPReservationID       string            `json:"ipReservationID,omitempty"`
+	VRF                   *VRFConfiguration `json:"vrf,omitempty"`
+}
+
+// VRFConfiguration is the ip range of a VRF which backs the Metal Gateway
+type VRFConfiguration struct {
+	ID      string `json:"id"`
+	Network string `json:"network"`
+	CIDR    int    `json:"cidr"`
+}
+
+// MetalGatewayStatus records the gateway used by the pool and the network it routes
+type MetalGatewayStatus struct {
+	ID               string `json:"id"`
+	State            string `json:"state,omitempty"`
+	VLAN             string `json:"vlan,omitempty"`
+	Network          string `json:"network,omitempty"`
+	Gateway          string `json:"gateway,omitempty"`
+	SubnetMask       string `json:"subnetMask,omitempty"`
+	Managed          bool   `json:"managed,omitempty"`
+	VRFReservationID string `json:"vrfReservationID,omitempty"`
 }
 
 type InterfaceConfiguration struct {
-	Name    string   `json:"name"`
-	VlanIDS []string `json:"vlanIDS"`
+	Name       string   `json:"name"`
+	VlanIDS    []string `json:"vlanIDS"`
+	NativeVlan string   `json:"nativeVlanID,omitempty"`
 }
 
 func (n *NetworkingConfiguration) IsEmpty() bool {
@@ -21,17 +21,277 @@ limitations under the License.
 package v1
 
 import (
+	genericcondition "github.com/rancher/wrangler/pkg/genericcondition"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AddressStatus) DeepCopyInto(out *AddressStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressStatus.
+func (in *AddressStatus) DeepCopy() *AddressStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AddressStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ArtifactChecksums) DeepCopyInto(out *ArtifactChecksums) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ArtifactChecksums.
+func (in *ArtifactChecksums) DeepCopy() *ArtifactChecksums {
+	if in == nil {
+		return nil
+	}
+	out := new(ArtifactChecksums)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AutoscalerStatus) DeepCopyInto(out *AutoscalerStatus) {
+	*out = *in
+	if in.LastScaleTime != nil {
+		in, out := &in.LastScaleTime, &out.LastScaleTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AutoscalerStatus.
+func (in *AutoscalerStatus) DeepCopy() *AutoscalerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AutoscalerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AutoscalingConfiguration) DeepCopyInto(out *AutoscalingConfiguration) {
+	*out = *in
+	if in.ScaleUpCooldown != nil {
+		in, out := &in.ScaleUpCooldown, &out.ScaleUpCooldown
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.ScaleDownCooldown != nil {
+		in, out := &in.ScaleDownCooldown, &out.ScaleDownCooldown
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AutoscalingConfiguration.
+func (in *AutoscalingConfiguration) DeepCopy() *AutoscalingConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(AutoscalingConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGPConfiguration) DeepCopyInto(out *BGPConfiguration) {
+	*out = *in
+	if in.AddressFamilies != nil {
+		in, out := &in.AddressFamilies, &out.AddressFamilies
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGPConfiguration.
+func (in *BGPConfiguration) DeepCopy() *BGPConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(BGPConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGPSessionStatus) DeepCopyInto(out *BGPSessionStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGPSessionStatus.
+func (in *BGPSessionStatus) DeepCopy() *BGPSessionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BGPSessionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Budget) DeepCopyInto(out *Budget) {
+	*out = *in
+	if in.MaxHourlyCost != nil {
+		in, out := &in.MaxHourlyCost, &out.MaxHourlyCost
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MaxMonthlyCost != nil {
+		in, out := &in.MaxMonthlyCost, &out.MaxMonthlyCost
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Budget.
+func (in *Budget) DeepCopy() *Budget {
+	if in == nil {
+		return nil
+	}
+	out := new(Budget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CostEstimate) DeepCopyInto(out *CostEstimate) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CostEstimate.
+func (in *CostEstimate) DeepCopy() *CostEstimate {
+	if in == nil {
+		return nil
+	}
+	out := new(CostEstimate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DataDiskConfiguration) DeepCopyInto(out *DataDiskConfiguration) {
+	*out = *in
+	if in.Paths != nil {
+		in, out := &in.Paths, &out.Paths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.MinSize != nil {
+		in, out := &in.MinSize, &out.MinSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DataDiskConfiguration.
+func (in *DataDiskConfiguration) DeepCopy() *DataDiskConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(DataDiskConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceMetadata) DeepCopyInto(out *DeviceMetadata) {
+	*out = *in
+	if in.CreatedAt != nil {
+		in, out := &in.CreatedAt, &out.CreatedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.ProvisionedAt != nil {
+		in, out := &in.ProvisionedAt, &out.ProvisionedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.TerminationTime != nil {
+		in, out := &in.TerminationTime, &out.TerminationTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceMetadata.
+func (in *DeviceMetadata) DeepCopy() *DeviceMetadata {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceMetadata)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HarvesterConfigRef) DeepCopyInto(out *HarvesterConfigRef) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HarvesterConfigRef.
+func (in *HarvesterConfigRef) DeepCopy() *HarvesterConfigRef {
+	if in == nil {
+		return nil
+	}
+	out := new(HarvesterConfigRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HarvesterRelease) DeepCopyInto(out *HarvesterRelease) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HarvesterRelease.
+func (in *HarvesterRelease) DeepCopy() *HarvesterRelease {
+	if in == nil {
+		return nil
+	}
+	out := new(HarvesterRelease)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPAddressRequest) DeepCopyInto(out *IPAddressRequest) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPAddressRequest.
+func (in *IPAddressRequest) DeepCopy() *IPAddressRequest {
+	if in == nil {
+		return nil
+	}
+	out := new(IPAddressRequest)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Instance) DeepCopyInto(out *Instance) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -92,7 +352,7 @@ func (in *InstancePool) DeepCopyInto(out *InstancePool) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -191,6 +451,61 @@ func (in *InstancePoolSpec) DeepCopyInto(out *InstancePoolSpec) {
 		**out = **in
 	}
 	in.NetworkingConfiguration.DeepCopyInto(&out.NetworkingConfiguration)
+	if in.StaticIPPool != nil {
+		in, out := &in.StaticIPPool, &out.StaticIPPool
+		*out = new(StaticIPPool)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ReservedIPBlock != nil {
+		in, out := &in.ReservedIPBlock, &out.ReservedIPBlock
+		*out = new(ReservedIPBlock)
+		**out = **in
+	}
+	if in.BGP != nil {
+		in, out := &in.BGP, &out.BGP
+		*out = new(BGPConfiguration)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.IPAddresses != nil {
+		in, out := &in.IPAddresses, &out.IPAddresses
+		*out = make([]IPAddressRequest, len(*in))
+		copy(*out, *in)
+	}
+	if in.HarvesterConfigRef != nil {
+		in, out := &in.HarvesterConfigRef, &out.HarvesterConfigRef
+		*out = new(HarvesterConfigRef)
+		**out = **in
+	}
+	if in.DataDisks != nil {
+		in, out := &in.DataDisks, &out.DataDisks
+		*out = new(DataDiskConfiguration)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Checksums != nil {
+		in, out := &in.Checksums, &out.Checksums
+		*out = new(ArtifactChecksums)
+		**out = **in
+	}
+	if in.SSHAuthorizedKeys != nil {
+		in, out := &in.SSHAuthorizedKeys, &out.SSHAuthorizedKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Template != nil {
+		in, out := &in.Template, &out.Template
+		*out = new(InstanceTemplate)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Budget != nil {
+		in, out := &in.Budget, &out.Budget
+		*out = new(Budget)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Autoscaling != nil {
+		in, out := &in.Autoscaling, &out.Autoscaling
+		*out = new(AutoscalingConfiguration)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -207,6 +522,38 @@ func (in *InstancePoolSpec) DeepCopy() *InstancePoolSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InstancePoolStatus) DeepCopyInto(out *InstancePoolStatus) {
 	*out = *in
+	if in.MetalGateway != nil {
+		in, out := &in.MetalGateway, &out.MetalGateway
+		*out = new(MetalGatewayStatus)
+		**out = **in
+	}
+	if in.Release != nil {
+		in, out := &in.Release, &out.Release
+		*out = new(HarvesterRelease)
+		**out = **in
+	}
+	if in.MirroredArtifacts != nil {
+		in, out := &in.MirroredArtifacts, &out.MirroredArtifacts
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.EstimatedCost != nil {
+		in, out := &in.EstimatedCost, &out.EstimatedCost
+		*out = new(CostEstimate)
+		**out = **in
+	}
+	if in.Autoscaler != nil {
+		in, out := &in.Autoscaler, &out.Autoscaler
+		*out = new(AutoscalerStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]genericcondition.GenericCondition, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -269,6 +616,26 @@ func (in *InstanceSpec) DeepCopyInto(out *InstanceSpec) {
 		}
 	}
 	in.NetworkingConfiguration.DeepCopyInto(&out.NetworkingConfiguration)
+	if in.ManagementAddress != nil {
+		in, out := &in.ManagementAddress, &out.ManagementAddress
+		*out = new(ManagementAddress)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BGP != nil {
+		in, out := &in.BGP, &out.BGP
+		*out = new(BGPConfiguration)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.IPAddresses != nil {
+		in, out := &in.IPAddresses, &out.IPAddresses
+		*out = make([]IPAddressRequest, len(*in))
+		copy(*out, *in)
+	}
+	if in.DataDisks != nil {
+		in, out := &in.DataDisks, &out.DataDisks
+		*out = new(DataDiskConfiguration)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -285,6 +652,48 @@ func (in *InstanceSpec) DeepCopy() *InstanceSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InstanceStatus) DeepCopyInto(out *InstanceStatus) {
 	*out = *in
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]AddressStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Ports != nil {
+		in, out := &in.Ports, &out.Ports
+		*out = make([]PortStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.VLANBatches != nil {
+		in, out := &in.VLANBatches, &out.VLANBatches
+		*out = make([]VLANBatchStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.ReservedIP != nil {
+		in, out := &in.ReservedIP, &out.ReservedIP
+		*out = new(ReservedIPStatus)
+		**out = **in
+	}
+	if in.BGPSessions != nil {
+		in, out := &in.BGPSessions, &out.BGPSessions
+		*out = make([]BGPSessionStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.DataDisks != nil {
+		in, out := &in.DataDisks, &out.DataDisks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Device != nil {
+		in, out := &in.Device, &out.Device
+		*out = new(DeviceMetadata)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]genericcondition.GenericCondition, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -298,6 +707,54 @@ func (in *InstanceStatus) DeepCopy() *InstanceStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstanceTemplate) DeepCopyInto(out *InstanceTemplate) {
+	*out = *in
+	in.Metadata.DeepCopyInto(&out.Metadata)
+	in.Spec.DeepCopyInto(&out.Spec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstanceTemplate.
+func (in *InstanceTemplate) DeepCopy() *InstanceTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(InstanceTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InstanceTemplateMetadata) DeepCopyInto(out *InstanceTemplateMetadata) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InstanceTemplateMetadata.
+func (in *InstanceTemplateMetadata) DeepCopy() *InstanceTemplateMetadata {
+	if in == nil {
+		return nil
+	}
+	out := new(InstanceTemplateMetadata)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InterfaceConfiguration) DeepCopyInto(out *InterfaceConfiguration) {
 	*out = *in
@@ -319,6 +776,64 @@ func (in *InterfaceConfiguration) DeepCopy() *InterfaceConfiguration {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagementAddress) DeepCopyInto(out *ManagementAddress) {
+	*out = *in
+	if in.DNSNameservers != nil {
+		in, out := &in.DNSNameservers, &out.DNSNameservers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagementAddress.
+func (in *ManagementAddress) DeepCopy() *ManagementAddress {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagementAddress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MetalGatewayConfiguration) DeepCopyInto(out *MetalGatewayConfiguration) {
+	*out = *in
+	if in.VRF != nil {
+		in, out := &in.VRF, &out.VRF
+		*out = new(VRFConfiguration)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetalGatewayConfiguration.
+func (in *MetalGatewayConfiguration) DeepCopy() *MetalGatewayConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(MetalGatewayConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MetalGatewayStatus) DeepCopyInto(out *MetalGatewayStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetalGatewayStatus.
+func (in *MetalGatewayStatus) DeepCopy() *MetalGatewayStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MetalGatewayStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NetworkingConfiguration) DeepCopyInto(out *NetworkingConfiguration) {
 	*out = *in
@@ -329,6 +844,11 @@ func (in *NetworkingConfiguration) DeepCopyInto(out *NetworkingConfiguration) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.MetalGateway != nil {
+		in, out := &in.MetalGateway, &out.MetalGateway
+		*out = new(MetalGatewayConfiguration)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -341,3 +861,109 @@ func (in *NetworkingConfiguration) DeepCopy() *NetworkingConfiguration {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PortStatus) DeepCopyInto(out *PortStatus) {
+	*out = *in
+	if in.VLANs != nil {
+		in, out := &in.VLANs, &out.VLANs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PortStatus.
+func (in *PortStatus) DeepCopy() *PortStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PortStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReservedIPBlock) DeepCopyInto(out *ReservedIPBlock) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReservedIPBlock.
+func (in *ReservedIPBlock) DeepCopy() *ReservedIPBlock {
+	if in == nil {
+		return nil
+	}
+	out := new(ReservedIPBlock)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReservedIPStatus) DeepCopyInto(out *ReservedIPStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReservedIPStatus.
+func (in *ReservedIPStatus) DeepCopy() *ReservedIPStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ReservedIPStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StaticIPPool) DeepCopyInto(out *StaticIPPool) {
+	*out = *in
+	if in.DNSNameservers != nil {
+		in, out := &in.DNSNameservers, &out.DNSNameservers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StaticIPPool.
+func (in *StaticIPPool) DeepCopy() *StaticIPPool {
+	if in == nil {
+		return nil
+	}
+	out := new(StaticIPPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VLANBatchStatus) DeepCopyInto(out *VLANBatchStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VLANBatchStatus.
+func (in *VLANBatchStatus) DeepCopy() *VLANBatchStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VLANBatchStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VRFConfiguration) DeepCopyInto(out *VRFConfiguration) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VRFConfiguration.
+func (in *VRFConfiguration) DeepCopy() *VRFConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(VRFConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
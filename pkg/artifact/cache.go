@@ -0,0 +1,389 @@
+package artifact
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultCacheDir      = "/var/lib/equinix-addon/artifacts"
+	DefaultListenAddress = ":8080"
+	mirrorDir            = "mirror"
+	publishDir           = "published"
+	servePath            = "/artifacts/"
+	// PublishedPath is the path content published in the cache is served under
+	PublishedPath = servePath + publishDir + "/"
+	// downloadRetryInterval is the time a failed download is retried after. Downloads failing with
+	// a checksum mismatch are not retried until the url or checksum changes.
+	downloadRetryInterval = 15 * time.Minute
+)
+
+// ChecksumMismatchError is returned when a downloaded artifact does not match its pinned checksum
+type ChecksumMismatchError struct {
+	URL      string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected sha256 %s, got %s", e.URL, e.Expected, e.Actual)
+}
+
+// Cache stores install artifacts on disk so every artifact is only downloaded once. Verified
+// artifacts are keyed by their sha256 checksum, mirrored ones by their url. When a base url is
+// configured the cache also serves its artifacts to devices as a mirror.
+type Cache struct {
+	dir        string
+	baseURL    string
+	publishURL string
+	client     *http.Client
+	lock       sync.Mutex
+	downloads  map[string]*download
+}
+
+// download tracks an artifact being downloaded into the cache in the background
+type download struct {
+	finished bool
+	err      error
+	failedAt time.Time
+}
+
+func NewCache(dir, baseURL string) *Cache {
+	if dir == "" {
+		dir = DefaultCacheDir
+	}
+
+	return &Cache{
+		dir:        dir,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		publishURL: strings.TrimSuffix(baseURL, "/"),
+		client:     http.DefaultClient,
+		downloads:  make(map[string]*download),
+	}
+}
+
+// CacheDir returns the cache directory configured for the operator
+func CacheDir() string {
+	return os.Getenv("ARTIFACT_CACHE_DIR")
+}
+
+// MirrorURL returns the url devices reach the artifact mirror of the operator at. The mirror
+// is disabled when it is not set.
+func MirrorURL() string {
+	return os.Getenv("ARTIFACT_MIRROR_URL")
+}
+
+// ListenAddress returns the address the artifact mirror listens on
+func ListenAddress() string {
+	address := os.Getenv("ARTIFACT_MIRROR_LISTEN_ADDRESS")
+	if address == "" {
+		address = DefaultListenAddress
+	}
+
+	return address
+}
+
+// MirrorEnabled reports whether artifacts are served to devices from the cache
+func (c *Cache) MirrorEnabled() bool {
+	return c.baseURL != ""
+}
+
+// PublishAt serves published content from url, where PublishedHandler is served, when the mirror
+// is disabled
+func (c *Cache) PublishAt(url string) {
+	if !c.MirrorEnabled() {
+		c.publishURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// PublishEnabled reports whether devices can download content published in the cache
+func (c *Cache) PublishEnabled() bool {
+	return c.publishURL != ""
+}
+
+// PublishedHandler serves the content published in the cache under PublishedPath
+func (c *Cache) PublishedHandler() http.Handler {
+	return c.fileHandler()
+}
+
+// Mirror starts fetching the artifact into the cache in the background and returns the url devices
+// can download it from, once it is present. Artifacts with a pinned checksum are verified and shared
+// with Verify.
+func (c *Cache) Mirror(ctx context.Context, url, checksum string) (string, bool, error) {
+	if checksum != "" {
+		verified, err := c.Verify(ctx, url, checksum)
+		if err != nil || !verified {
+			return "", false, err
+		}
+		return c.baseURL + servePath + strings.ToLower(strings.TrimSpace(checksum)), true, nil
+	}
+
+	key := sha256.Sum256([]byte(url))
+	name := filepath.Join(mirrorDir, hex.EncodeToString(key[:8]), filepath.Base(url))
+	path := filepath.Join(c.dir, name)
+	mirrored, err := c.ensure(path, path, func() error {
+		return c.fetch(ctx, url, path)
+	})
+	if err != nil || !mirrored {
+		return "", false, err
+	}
+
+	return c.baseURL + servePath + filepath.ToSlash(name), true, nil
+}
+
+// MirrorIPXEScript mirrors an iPXE script along with the kernel, initrd and rootfs it boots, and
+// publishes a copy of the script pointing at the mirrored artifacts. The url of the published script
+// is returned once all artifacts are present. Checksums pins the checksums of artifacts by url.
+func (c *Cache) MirrorIPXEScript(ctx context.Context, url string, checksums map[string]string) (string, bool, error) {
+	key := sha256.Sum256([]byte(url))
+	path := filepath.Join(c.dir, mirrorDir, hex.EncodeToString(key[:8]), filepath.Base(url))
+	fetched, err := c.ensure(path, path, func() error {
+		return c.fetch(ctx, url, path)
+	})
+	if err != nil || !fetched {
+		return "", false, err
+	}
+
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	complete := true
+	rewritten := rewriteIPXEScript(string(script), func(artifactURL string) string {
+		mirrored, ok, mirrorErr := c.Mirror(ctx, artifactURL, checksums[artifactURL])
+		if mirrorErr != nil && err == nil {
+			err = errors.Wrapf(mirrorErr, "error mirroring %s of iPXE script %s", artifactURL, url)
+		}
+		if !ok {
+			complete = false
+			return artifactURL
+		}
+		return mirrored
+	})
+	if err != nil || !complete {
+		return "", false, err
+	}
+
+	published, err := c.Publish(hex.EncodeToString(key[:8])+"-"+filepath.Base(url), []byte(rewritten))
+	if err != nil {
+		return "", false, err
+	}
+
+	return published, true, nil
+}
+
+// Publish stores content generated by the operator, such as rendered iPXE scripts, under name and
+// returns the url devices can download it from. Content published under the same name is replaced.
+func (c *Cache) Publish(name string, content []byte) (string, error) {
+	name = filepath.Join(publishDir, filepath.Base(name))
+	path := filepath.Join(c.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", errors.Wrap(err, "error creating artifact cache")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return "", errors.Wrap(err, "error creating artifact cache file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(content); err != nil {
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	return c.publishURL + servePath + filepath.ToSlash(name), nil
+}
+
+// Serve serves the cached artifacts over http until the context is cancelled
+func (c *Cache) Serve(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle(servePath, c.fileHandler())
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// fileHandler serves the artifacts of the cache. Downloads in progress are written to hidden temporary
+// files, which are not served, and neither are directory listings.
+func (c *Cache) fileHandler() http.Handler {
+	files := http.StripPrefix(servePath, http.FileServer(http.Dir(c.dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") || strings.HasPrefix(path.Base(r.URL.Path), ".") {
+			http.NotFound(w, r)
+			return
+		}
+
+		files.ServeHTTP(w, r)
+	})
+}
+
+// Verify starts downloading the artifact at url into the cache in the background, unless an
+// artifact with the expected checksum is already present, and returns true once it is. The error of
+// a failed download is returned until it is retried after downloadRetryInterval. A
+// ChecksumMismatchError is returned without downloading the artifact again, until the url or the
+// checksum changes.
+func (c *Cache) Verify(ctx context.Context, url, checksum string) (bool, error) {
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if _, err := hex.DecodeString(checksum); err != nil || len(checksum) != sha256.Size*2 {
+		return false, fmt.Errorf("invalid sha256 checksum %s for %s", checksum, url)
+	}
+
+	path := c.Path(checksum)
+	return c.ensure(url+"@"+checksum, path, func() error {
+		return c.verify(ctx, url, checksum, path)
+	})
+}
+
+// ensure runs fetch in the background unless the artifact at path is present or already being
+// fetched under key, and returns true once the artifact is present
+func (c *Cache) ensure(key, path string, fetch func() error) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if d, ok := c.downloads[key]; ok {
+		if !d.finished {
+			return false, nil
+		}
+		if d.err != nil {
+			mismatch := &ChecksumMismatchError{}
+			if errors.As(d.err, &mismatch) || time.Since(d.failedAt) < downloadRetryInterval {
+				return false, d.err
+			}
+		}
+		delete(c.downloads, key)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return true, nil
+	}
+
+	d := &download{}
+	c.downloads[key] = d
+	go func() {
+		err := fetch()
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		d.finished = true
+		d.err = err
+		if err != nil {
+			d.failedAt = time.Now()
+		}
+	}()
+
+	return false, nil
+}
+
+func (c *Cache) verify(ctx context.Context, url, checksum, path string) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return errors.Wrap(err, "error creating artifact cache")
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".download-")
+	if err != nil {
+		return errors.Wrap(err, "error creating artifact cache file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	actual, err := c.download(ctx, url, tmp)
+	if err != nil {
+		return errors.Wrapf(err, "error downloading %s", url)
+	}
+
+	if actual != checksum {
+		return &ChecksumMismatchError{URL: url, Expected: checksum, Actual: actual}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *Cache) fetch(ctx context.Context, url, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "error creating artifact cache")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-")
+	if err != nil {
+		return errors.Wrap(err, "error creating artifact cache file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := c.download(ctx, url, tmp); err != nil {
+		return errors.Wrapf(err, "error downloading %s", url)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Path returns the location of the artifact with the given checksum in the cache
+func (c *Cache) Path(checksum string) string {
+	return filepath.Join(c.dir, strings.ToLower(checksum))
+}
+
+func (c *Cache) download(ctx context.Context, url string, w io.Writer) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), resp.Body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
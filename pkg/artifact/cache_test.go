@@ -0,0 +1,231 @@
+package artifact
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitVerified(t *testing.T, c *Cache, url, checksum string) error {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		verified, err := c.Verify(context.Background(), url, checksum)
+		if err != nil || verified {
+			return err
+		}
+	}
+
+	t.Fatalf("artifact %s was not verified in time", url)
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	content := []byte("harvester")
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		checksum string
+		wantErr  bool
+		mismatch bool
+	}{
+		{
+			name:     "matching checksum",
+			url:      server.URL + "/artifact",
+			checksum: checksum,
+		},
+		{
+			name:     "checksum mismatch",
+			url:      server.URL + "/artifact",
+			checksum: checksum[:len(checksum)-1] + "0",
+			wantErr:  true,
+			mismatch: true,
+		},
+		{
+			name:     "download failure",
+			url:      server.URL + "/missing",
+			checksum: hex.EncodeToString(make([]byte, sha256.Size)),
+			wantErr:  true,
+		},
+		{
+			name:     "invalid checksum",
+			url:      server.URL + "/artifact",
+			checksum: "abc",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(t.TempDir(), "")
+			err := waitVerified(t, c, tt.url, tt.checksum)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			mismatch := &ChecksumMismatchError{}
+			if errors.As(err, &mismatch) != tt.mismatch {
+				t.Errorf("Verify() error = %v, want checksum mismatch %v", err, tt.mismatch)
+			}
+
+			if err == nil {
+				verified, err := c.Verify(context.Background(), tt.url, tt.checksum)
+				if !verified || err != nil {
+					t.Errorf("Verify() of a cached artifact = %v, %v", verified, err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyRetries(t *testing.T) {
+	content := []byte("harvester")
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		checksum string
+		backoff  bool
+		retried  bool
+		fixed    string
+	}{
+		{
+			name:     "checksum mismatch is not downloaded again",
+			url:      server.URL + "/artifact",
+			checksum: checksum[:len(checksum)-1] + "0",
+			backoff:  true,
+		},
+		{
+			name:     "corrected checksum is downloaded",
+			url:      server.URL + "/artifact",
+			checksum: checksum[:len(checksum)-1] + "0",
+			fixed:    checksum,
+		},
+		{
+			name:     "download failure is not retried during the backoff",
+			url:      server.URL + "/missing",
+			checksum: checksum,
+		},
+		{
+			name:     "download failure is retried after the backoff",
+			url:      server.URL + "/missing",
+			checksum: checksum,
+			backoff:  true,
+			retried:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+			c := NewCache(t.TempDir(), "")
+			if err := waitVerified(t, c, tt.url, tt.checksum); err == nil {
+				t.Fatal("Verify() error = nil, want an error")
+			}
+
+			if tt.backoff {
+				c.lock.Lock()
+				for _, d := range c.downloads {
+					d.failedAt = d.failedAt.Add(-downloadRetryInterval)
+				}
+				c.lock.Unlock()
+			}
+
+			_, err := c.Verify(context.Background(), tt.url, tt.checksum)
+			if (err == nil) != tt.retried {
+				t.Errorf("Verify() after the failure error = %v, want retried %v", err, tt.retried)
+			}
+			want := int32(1)
+			if tt.retried {
+				want = 2
+			}
+
+			if tt.fixed != "" {
+				if err := waitVerified(t, c, tt.url, tt.fixed); err != nil {
+					t.Fatal(err)
+				}
+				want++
+			}
+
+			// give a restarted download the time to reach the server
+			time.Sleep(100 * time.Millisecond)
+			if got := atomic.LoadInt32(&hits); got != want {
+				t.Errorf("server was hit %d times, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFileHandler(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mirror/abc/vmlinuz":          "kernel",
+		"mirror/abc/.download-123456": "partial",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(NewCache(dir, "").fileHandler())
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/artifacts/mirror/abc/vmlinuz", http.StatusOK},
+		{"/artifacts/mirror/abc/.download-123456", http.StatusNotFound},
+		{"/artifacts/mirror/abc/", http.StatusNotFound},
+		{"/artifacts/mirror/abc/initrd", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.path, resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
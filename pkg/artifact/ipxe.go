@@ -0,0 +1,80 @@
+package artifact
+
+import (
+	"strings"
+)
+
+// ipxeImageCommands are the iPXE commands downloading an image, which can be mirrored
+var ipxeImageCommands = map[string]bool{
+	"kernel":   true,
+	"initrd":   true,
+	"imgfetch": true,
+	"module":   true,
+}
+
+const liveRootPrefix = "root=live:"
+
+// rewriteIPXEScript replaces the urls of the images downloaded by an iPXE script, and of the live
+// rootfs passed to the kernel, with the urls returned by mirror. Variables set in the script are
+// expanded in the replaced urls, urls depending on variables set at boot time are kept as is.
+func rewriteIPXEScript(script string, mirror func(url string) string) string {
+	vars := make(map[string]string)
+	lines := strings.Split(script, "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "set" && len(fields) >= 3 {
+			vars[fields[1]] = expandIPXEVariables(strings.Join(fields[2:], " "), vars)
+			continue
+		}
+
+		if !ipxeImageCommands[fields[0]] {
+			continue
+		}
+
+		// the image is the first url argument, option values such as the --name of an image are kept
+		replaced := false
+		image := false
+		for j, field := range fields[1:] {
+			prefix := ""
+			if strings.HasPrefix(field, liveRootPrefix) {
+				prefix = liveRootPrefix
+			} else if image || strings.HasPrefix(field, "-") {
+				continue
+			}
+
+			url := expandIPXEVariables(strings.TrimPrefix(field, prefix), vars)
+			if !isHTTPURL(url) {
+				continue
+			}
+			if prefix == "" {
+				image = true
+			}
+
+			fields[j+1] = prefix + mirror(url)
+			replaced = true
+		}
+
+		if replaced {
+			lines[i] = strings.Join(fields, " ")
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// expandIPXEVariables replaces the ${name} references of known variables
+func expandIPXEVariables(value string, vars map[string]string) string {
+	for name, v := range vars {
+		value = strings.ReplaceAll(value, "${"+name+"}", v)
+	}
+
+	return value
+}
+
+func isHTTPURL(url string) bool {
+	return (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) && !strings.Contains(url, "${")
+}
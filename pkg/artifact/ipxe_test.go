@@ -0,0 +1,64 @@
+package artifact
+
+import "testing"
+
+func TestRewriteIPXEScript(t *testing.T) {
+	mirror := func(url string) string {
+		return "http://mirror/" + url[len("https://"):]
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{
+			name: "kernel initrd and rootfs",
+			script: `#!ipxe
+kernel https://releases/vmlinuz initrd=initrd console=ttyS1 root=live:https://releases/rootfs.squashfs harvester.install.config_url=https://metadata/userdata
+initrd --name initrd https://releases/initrd
+boot`,
+			want: `#!ipxe
+kernel http://mirror/releases/vmlinuz initrd=initrd console=ttyS1 root=live:http://mirror/releases/rootfs.squashfs harvester.install.config_url=https://metadata/userdata
+initrd --name initrd http://mirror/releases/initrd
+boot`,
+		},
+		{
+			name: "variables are expanded",
+			script: `#!ipxe
+set version v1.0.3
+set base https://releases/${version}
+kernel ${base}/vmlinuz root=live:${base}/rootfs.squashfs
+initrd ${base}/initrd`,
+			want: `#!ipxe
+set version v1.0.3
+set base https://releases/${version}
+kernel http://mirror/releases/v1.0.3/vmlinuz root=live:http://mirror/releases/v1.0.3/rootfs.squashfs
+initrd http://mirror/releases/v1.0.3/initrd`,
+		},
+		{
+			name: "boot time variables are kept",
+			script: `#!ipxe
+kernel https://releases/vmlinuz ip=${ip}
+chain https://releases/next.ipxe
+initrd ${base-url}/initrd`,
+			want: `#!ipxe
+kernel http://mirror/releases/vmlinuz ip=${ip}
+chain https://releases/next.ipxe
+initrd ${base-url}/initrd`,
+		},
+		{
+			name:   "shell",
+			script: "#!ipxe\nshell\n",
+			want:   "#!ipxe\nshell\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteIPXEScript(tt.script, mirror); got != tt.want {
+				t.Errorf("rewriteIPXEScript() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
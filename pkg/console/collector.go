@@ -0,0 +1,171 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DefaultSOSPort = "22"
+	// DefaultLogSize keeps the console log within the size limit of a ConfigMap
+	DefaultLogSize = 512 * 1024
+)
+
+// Collector captures the serial console of devices through the Metal serial over ssh (SOS) service
+type Collector struct {
+	config *ssh.ClientConfig
+}
+
+// NewCollector returns a collector authenticating with the private key, which must belong to a
+// Metal user or project key. Host keys are checked against knownHosts, which is required.
+func NewCollector(privateKey, knownHosts []byte) (*Collector, error) {
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing sos private key")
+	}
+
+	if len(knownHosts) == 0 {
+		return nil, errors.New("sos known hosts are required to verify the host keys of the sos service")
+	}
+
+	hostKeyCallback, err := knownHostsCallback(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Collector{
+		config: &ssh.ClientConfig{
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+// Collect streams the console of the SOS connection string `<device id>@<host>` into w until the
+// context is cancelled or the console is closed
+func (c *Collector) Collect(ctx context.Context, sos string, w io.Writer) error {
+	user, host, err := ParseSOS(sos)
+	if err != nil {
+		return err
+	}
+
+	config := *c.config
+	config.User = user
+	address := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		address = net.JoinHostPort(host, DefaultSOSPort)
+	}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "error connecting to %s", address)
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, &config)
+	if err != nil {
+		conn.Close()
+		return errors.Wrapf(err, "error opening sos session to %s", address)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdout = w
+	session.Stderr = w
+	if err := session.Shell(); err != nil {
+		return errors.Wrap(err, "error starting sos shell")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-done:
+		if _, ok := err.(*ssh.ExitMissingError); ok {
+			return nil
+		}
+		return err
+	}
+}
+
+// ParseSOS splits a SOS connection string into the user and host
+func ParseSOS(sos string) (user, host string, err error) {
+	i := strings.LastIndex(sos, "@")
+	if i <= 0 || i == len(sos)-1 {
+		return "", "", fmt.Errorf("invalid sos connection string %s", sos)
+	}
+
+	return sos[:i], sos[i+1:], nil
+}
+
+// Log is a writer keeping the last size bytes written to it
+type Log struct {
+	lock sync.Mutex
+	buf  []byte
+	size int
+}
+
+func NewLog(size int) *Log {
+	return &Log{size: size}
+}
+
+func (l *Log) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.buf = append(l.buf, p...)
+	if len(l.buf) > l.size {
+		l.buf = l.buf[len(l.buf)-l.size:]
+	}
+
+	return len(p), nil
+}
+
+func (l *Log) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return string(l.buf)
+}
+
+func knownHostsCallback(data []byte) (ssh.HostKeyCallback, error) {
+	var keys []ssh.PublicKey
+	for len(data) != 0 {
+		_, _, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing sos known hosts")
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		for _, known := range keys {
+			if bytes.Equal(known.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown host key for %s", hostname)
+	}, nil
+}
@@ -0,0 +1,98 @@
+package console
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/harvester/harvester-equinix-addon/pkg/console/consoletest"
+)
+
+func privateKey(t *testing.T) []byte {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func newServer(t *testing.T, output string) *consoletest.Server {
+	t.Helper()
+	server, err := consoletest.NewServer([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server
+}
+
+func TestCollect(t *testing.T) {
+	server := newServer(t, "harvester install started\n")
+	other := newServer(t, "")
+
+	tests := []struct {
+		name       string
+		knownHosts []byte
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "known host",
+			knownHosts: server.KnownHosts(),
+			want:       "harvester install started\n",
+		},
+		{
+			name:       "unknown host key",
+			knownHosts: other.KnownHosts(),
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector, err := NewCollector(privateKey(t), tt.knownHosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			log := NewLog(DefaultLogSize)
+			err = collector.Collect(ctx, "device@"+server.Addr(), log)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Collect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := log.String(); got != tt.want {
+				t.Errorf("Collect() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCollectorRequiresKnownHosts(t *testing.T) {
+	if _, err := NewCollector(privateKey(t), nil); err == nil {
+		t.Error("NewCollector() without known hosts succeeded")
+	}
+}
+
+func TestLog(t *testing.T) {
+	log := NewLog(8)
+	log.Write([]byte("0123"))
+	log.Write([]byte("456789"))
+	if got := log.String(); got != "23456789" {
+		t.Errorf("Log.String() = %q, want %q", got, "23456789")
+	}
+}
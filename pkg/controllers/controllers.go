@@ -8,13 +8,19 @@ import (
 	"github.com/rancher/lasso/pkg/client"
 	"github.com/rancher/lasso/pkg/controller"
 	"github.com/rancher/wrangler/pkg/generated/controllers/core"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/workqueue"
 
+	"github.com/harvester/harvester-equinix-addon/pkg/artifact"
 	instanceController "github.com/harvester/harvester-equinix-addon/pkg/controllers/instance"
 	instancePoolController "github.com/harvester/harvester-equinix-addon/pkg/controllers/instancepool"
 	"github.com/harvester/harvester-equinix-addon/pkg/crd"
 	instance "github.com/harvester/harvester-equinix-addon/pkg/generated/controllers/equinix.harvesterhci.io"
+	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
+	"github.com/harvester/harvester-equinix-addon/pkg/webhook"
 	"github.com/rancher/wrangler/pkg/start"
+	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -69,8 +75,44 @@ func Register(ctx context.Context, cfg clientcmd.ClientConfig) error {
 		return err
 	}
 
-	instanceController.Register(ctx, instanceFactory.Equinix().V1().Instance(), corecontrollers.Core().V1().Node())
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	artifacts := artifact.NewCache(artifact.CacheDir(), artifact.MirrorURL())
+	if artifacts.MirrorEnabled() {
+		go func() {
+			if err := artifacts.Serve(ctx, artifact.ListenAddress()); err != nil {
+				logrus.Errorf("artifact mirror stopped: %v", err)
+			}
+		}()
+	}
+
+	if webhook.URL() != "" {
+		receiver := webhook.NewReceiver(instanceFactory.Equinix().V1().Instance(), corecontrollers.Core().V1().Secret())
+		if !artifacts.MirrorEnabled() {
+			// without the mirror, the install scripts rendered for harvester versions are served by the receiver
+			artifacts.PublishAt(webhook.URL())
+			receiver.Handle(artifact.PublishedPath, artifacts.PublishedHandler())
+		}
+		go func() {
+			if err := receiver.Serve(ctx, webhook.ListenAddress()); err != nil {
+				logrus.Errorf("install webhook receiver stopped: %v", err)
+			}
+		}()
+	}
+
+	instanceController.Register(ctx, instanceFactory.Equinix().V1().Instance(), corecontrollers.Core().V1().Node(), corecontrollers.Core().V1().Secret(),
+		corecontrollers.Core().V1().ConfigMap(), harvester.NewBlockDeviceClient(dynamicClient))
 	instancePoolController.Register(ctx, instanceFactory.Equinix().V1().InstancePool(),
-		instanceFactory.Equinix().V1().Instance(), corecontrollers.Core().V1().Secret(), corecontrollers.Core().V1().Node(), corecontrollers.Core().V1().Service())
+		instanceFactory.Equinix().V1().Instance(), corecontrollers.Core().V1().Secret(), corecontrollers.Core().V1().ConfigMap(),
+		corecontrollers.Core().V1().Node(), corecontrollers.Core().V1().Service(), harvester.NewSettingClient(dynamicClient),
+		artifacts, corecontrollers.Core().V1().Pod(), harvester.NewLonghornNodeClient(dynamicClient), clientset.CoreV1())
 	return start.All(ctx, 5, instanceFactory)
 }
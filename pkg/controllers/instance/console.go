@@ -0,0 +1,156 @@
+package instance
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/console"
+	"github.com/harvester/harvester-equinix-addon/pkg/util"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	consoleSecret        = "equinix-addon-sos"
+	consoleLogKey        = "console.log"
+	consoleFlushInterval = 30 * time.Second
+	consoleLogTimeout    = 2 * time.Hour
+)
+
+// startConsoleLog captures the serial console of the device while harvester is being installed,
+// and stores it in a configmap for post-mortem of failed installs
+func (h *handler) startConsoleLog(i *equinix.Instance) {
+	if !i.Spec.ConsoleLog || i.Status.Device == nil || i.Status.Device.SOS == "" {
+		return
+	}
+
+	h.consoleLock.Lock()
+	defer h.consoleLock.Unlock()
+	if _, ok := h.consoles[i.Name]; ok {
+		return
+	}
+
+	collector, err := h.consoleCollector()
+	if err != nil {
+		logrus.Warnf("unable to collect console log of instance %s: %v", i.Name, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, consoleLogTimeout)
+	h.consoles[i.Name] = cancel
+	go h.collectConsoleLog(ctx, collector, i.DeepCopy())
+}
+
+// syncConsoleLog captures the serial console of the device until harvester reports the outcome
+// of the install through the install webhooks
+func (h *handler) syncConsoleLog(i *equinix.Instance) {
+	if equinix.InstanceInstalled.IsTrue(i) || equinix.InstanceInstalled.IsFalse(i) {
+		h.stopConsoleLog(i.Name)
+		return
+	}
+
+	h.startConsoleLog(i)
+}
+
+// stopConsoleLog stops capturing the serial console of the instance
+func (h *handler) stopConsoleLog(name string) {
+	h.consoleLock.Lock()
+	defer h.consoleLock.Unlock()
+	if cancel, ok := h.consoles[name]; ok {
+		cancel()
+		delete(h.consoles, name)
+	}
+}
+
+func (h *handler) collectConsoleLog(ctx context.Context, collector *console.Collector, i *equinix.Instance) {
+	defer h.stopConsoleLog(i.Name)
+
+	log := console.NewLog(console.DefaultLogSize)
+	done := make(chan error, 1)
+	go func() {
+		done <- collector.Collect(ctx, i.Status.Device.SOS, log)
+	}()
+
+	ticker := time.NewTicker(consoleFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.flushConsoleLog(i, log); err != nil {
+				logrus.Warnf("error storing console log of instance %s: %v", i.Name, err)
+			}
+		case err := <-done:
+			if err != nil {
+				logrus.Warnf("console log collection of instance %s stopped: %v", i.Name, err)
+			}
+			if err := h.flushConsoleLog(i, log); err != nil {
+				logrus.Warnf("error storing console log of instance %s: %v", i.Name, err)
+			}
+			return
+		}
+	}
+}
+
+func (h *handler) consoleCollector() (*console.Collector, error) {
+	secret, err := h.secret.Get(util.OperatorNamespace(), consoleSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return console.NewCollector(secret.Data[v1.SSHAuthPrivateKey], secret.Data["known_hosts"])
+}
+
+func (h *handler) flushConsoleLog(i *equinix.Instance, log *console.Log) error {
+	name := ConsoleLogName(i.Name)
+	namespace := util.OperatorNamespace()
+	cm, err := h.configMap.Get(namespace, name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if apierrors.IsNotFound(err) {
+		_, err = h.configMap.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					"instance": i.Name,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: "equinix.harvesterhci.io/v1",
+						Kind:       "Instance",
+						Name:       i.Name,
+						UID:        i.UID,
+					},
+				},
+			},
+			Data: map[string]string{
+				consoleLogKey: log.String(),
+			},
+		})
+		return err
+	}
+
+	content := log.String()
+	if cm.Data[consoleLogKey] == content {
+		return nil
+	}
+
+	cmCopy := cm.DeepCopy()
+	if cmCopy.Data == nil {
+		cmCopy.Data = make(map[string]string)
+	}
+	cmCopy.Data[consoleLogKey] = content
+	_, err = h.configMap.Update(cmCopy)
+	return err
+}
+
+// ConsoleLogName returns the name of the configmap holding the console log of an instance
+func ConsoleLogName(instance string) string {
+	return fmt.Sprintf("%s-console", instance)
+}
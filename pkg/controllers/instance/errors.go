@@ -0,0 +1,77 @@
+package instance
+
+import (
+	"reflect"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// handleError records equinix metal api errors in the Reconciled condition of the instance.
+// Permanent errors are not retried until the instance changes, capacity errors are retried after
+// a long backoff, and all other errors are returned to be retried by the controller.
+func (h *handler) handleError(key string, i *equinix.Instance, result *equinix.Instance, err error) (*equinix.Instance, error) {
+	if err == nil {
+		if result == nil || !equinix.InstanceReconciled.IsFalse(result) {
+			return result, nil
+		}
+		resultCopy := result.DeepCopy()
+		equinix.InstanceReconciled.SetError(resultCopy, "", nil)
+		resultCopy.Status.FailedGeneration = 0
+		return h.instance.UpdateStatus(resultCopy)
+	}
+
+	classified := equinixClient.ClassifyError(err)
+	if classified == nil || classified.Class == equinixClient.ErrorClassTransient {
+		return result, err
+	}
+
+	// the instance may have been updated before the error occurred
+	latest, getErr := h.instance.Get(i.Name, metav1.GetOptions{})
+	if getErr != nil {
+		return result, err
+	}
+
+	latestCopy := latest.DeepCopy()
+	equinix.InstanceReconciled.False(latestCopy)
+	equinix.InstanceReconciled.Reason(latestCopy, string(classified.Class))
+	equinix.InstanceReconciled.Message(latestCopy, classified.Error())
+	if classified.Permanent() {
+		// the error was returned for the spec the reconcile started with
+		latestCopy.Status.FailedGeneration = i.Generation
+	}
+
+	if !reflect.DeepEqual(latest.Status, latestCopy.Status) {
+		latest, err = h.instance.UpdateStatus(latestCopy)
+		if err != nil {
+			return latest, err
+		}
+	}
+
+	switch {
+	case classified.Class == equinixClient.ErrorClassCapacity:
+		logrus.Warnf("equinix metal capacity exhausted for instance %s, retrying in %s: %v", i.Name, equinixClient.CapacityRetryInterval, classified)
+		h.instance.EnqueueAfter(key, equinixClient.CapacityRetryInterval)
+	case classified.Class == equinixClient.ErrorClassAuth:
+		// the instancePool revalidates the credentials and resumes the instance
+		logrus.Errorf("equinix metal rejected the credentials of instance %s: %v", i.Name, classified)
+	default:
+		logrus.Errorf("not retrying instance %s: %v", i.Name, classified)
+	}
+
+	return latest, nil
+}
+
+// stoppedByError reports whether the instance stopped after a permanent error of the equinix metal
+// api. It is not reconciled again until its spec changes, or the instancePool resumes it with
+// revalidated credentials.
+func stoppedByError(i *equinix.Instance) bool {
+	if !equinix.InstanceReconciled.IsFalse(i) {
+		return false
+	}
+
+	class := equinixClient.ErrorClass(equinix.InstanceReconciled.GetReason(i))
+	return class.Permanent() && i.Status.FailedGeneration == i.Generation
+}
@@ -2,6 +2,10 @@ package instance
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/harvester/harvester-equinix-addon/pkg/util"
@@ -11,6 +15,8 @@ import (
 	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
 	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
 	controller "github.com/harvester/harvester-equinix-addon/pkg/generated/controllers/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
+	"github.com/harvester/harvester-equinix-addon/pkg/webhook"
 	corecontrollers "github.com/rancher/wrangler/pkg/generated/controllers/core/v1"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
@@ -18,22 +24,35 @@ import (
 )
 
 type handler struct {
-	ctx      context.Context
-	instance controller.InstanceController
-	node     corecontrollers.NodeController
+	ctx         context.Context
+	instance    controller.InstanceController
+	node        corecontrollers.NodeController
+	secret      corecontrollers.SecretController
+	configMap   corecontrollers.ConfigMapController
+	blockDevice *harvester.BlockDeviceClient
+	consoles    map[string]context.CancelFunc
+	consoleLock sync.Mutex
 }
 
 const (
-	finalizer = "equinix.instance.harvesterhci.io"
+	finalizer            = "equinix.instance.harvesterhci.io"
+	dataDiskSyncInterval = time.Minute
 )
 
-func Register(ctx context.Context, instance controller.InstanceController, node corecontrollers.NodeController) {
+func Register(ctx context.Context, instance controller.InstanceController, node corecontrollers.NodeController, secret corecontrollers.SecretController,
+	configMap corecontrollers.ConfigMapController, blockDevice *harvester.BlockDeviceClient) {
 	iHandler := &handler{
-		ctx:      ctx,
-		instance: instance,
-		node:     node,
+		ctx:         ctx,
+		instance:    instance,
+		node:        node,
+		secret:      secret,
+		configMap:   configMap,
+		blockDevice: blockDevice,
+		consoles:    make(map[string]context.CancelFunc),
 	}
 
+	go newDevicePoller(instance).run(ctx)
+
 	node.OnChange(ctx, "node-change", iHandler.ResolveNode)
 	instance.OnChange(ctx, "instance-change", iHandler.OnInstanceChange)
 	instance.OnRemove(ctx, "instance-remove", iHandler.OnInstanceRemove)
@@ -44,6 +63,16 @@ func (h *handler) OnInstanceChange(key string, i *equinix.Instance) (*equinix.In
 		return i, nil
 	}
 
+	if stoppedByError(i) {
+		logrus.Debugf("skipping instance %s until its spec changes: %s", i.Name, equinix.InstanceReconciled.GetMessage(i))
+		return i, nil
+	}
+
+	result, err := h.reconcile(key, i)
+	return h.handleError(key, i, result, err)
+}
+
+func (h *handler) reconcile(key string, i *equinix.Instance) (*equinix.Instance, error) {
 	switch i.Status.Status {
 	case "": // identify the token
 		logrus.Infof("creating node %s in equinix metal\n", i.Name)
@@ -53,13 +82,28 @@ func (h *handler) OnInstanceChange(key string, i *equinix.Instance) (*equinix.In
 		return h.reinstallDevice(key, i)
 	case "reinstalling":
 		logrus.Infof("waiting for node %s to be active\n", i.Name)
+		h.syncConsoleLog(i)
 		return h.checkDeviceStatus(key, i)
 	case "ready": // node has processed, disable pxe boot and join config scripts
 		logrus.Infof("instance %s is ready\n", i.Name)
+		h.syncConsoleLog(i)
+		i, err := h.configureBGP(key, i)
+		if err != nil {
+			return i, err
+		}
 		return h.manageNodes(key, i)
 	case "managed":
-		logrus.Infof("instance %s is managed \n", i.Name)
-		return i, nil
+		logrus.Debugf("instance %s is managed \n", i.Name)
+		h.stopConsoleLog(i.Name)
+		i, err := h.provisionDataDisks(key, i)
+		if err != nil {
+			return i, err
+		}
+		return h.syncNetworkConfig(key, i)
+	case webhook.StatusInstallFailed:
+		// the device is kept as is for post-mortem, deleting the instance releases it
+		logrus.Errorf("harvester install failed on instance %s\n", i.Name)
+		h.stopConsoleLog(i.Name)
 	}
 
 	return i, nil
@@ -71,9 +115,22 @@ func (h *handler) OnInstanceRemove(_ string, i *equinix.Instance) (*equinix.Inst
 		return i, nil
 	}
 
+	h.stopConsoleLog(i.Name)
 	if util.ContainsFinalizer(i.GetFinalizers(), finalizer) {
 		m := equinixClient.NewClient(i.ObjectMeta.Annotations["token"], i.Spec.ProjectID)
 		logrus.Infof("object deleted %s", i.Name)
+		err = m.UnassignReservedIP(i)
+		if err != nil {
+			return i, err
+		}
+		err = m.DeleteBGPSessions(i)
+		if err != nil {
+			return i, err
+		}
+		err = h.findAndDeleteBGPSecret(i)
+		if err != nil {
+			return i, err
+		}
 		err = m.DeleteDevice(i)
 		if err != nil {
 			return i, err
@@ -165,7 +222,8 @@ func (h *handler) checkDeviceStatus(key string, i *equinix.Instance) (*equinix.I
 	}
 
 	if status.Status != "ready" {
-		h.instance.EnqueueAfter(key, 2*time.Minute)
+		// the device poller enqueues the instance once its device changes state
+		h.instance.EnqueueAfter(key, deviceResyncInterval)
 		return i, nil
 	}
 
@@ -181,16 +239,37 @@ func (h *handler) reinstallDevice(key string, i *equinix.Instance) (*equinix.Ins
 	}
 
 	if status.Status != "ready" {
-		h.instance.EnqueueAfter(key, 2*time.Minute)
+		// the device poller enqueues the instance once its device changes state
+		h.instance.EnqueueAfter(key, deviceResyncInterval)
 		return i, nil
 	}
 
+	// attach the address allocated from the reserved ip block of the instancePool
+	status, err = m.AssignReservedIP(i)
+	if err != nil {
+		return i, err
+	}
+	i.Status = *status
+
 	// device is inactive and has been powered off...
 	status, err = m.ReInstallDevice(i)
 	if err != nil {
+		// keep track of the vlan assignment batches submitted or dropped before the error
+		if !reflect.DeepEqual(i.Status.VLANBatches, status.VLANBatches) {
+			i.Status.VLANBatches = status.VLANBatches
+			if _, updateErr := h.instance.UpdateStatus(i); updateErr != nil {
+				return i, updateErr
+			}
+		}
 		return i, err
 	}
 	i.Status = *status
+
+	if len(status.VLANBatches) != 0 {
+		logrus.Infof("waiting for vlan assignments of node %s before reinstalling it\n", i.Name)
+		h.instance.EnqueueAfter(key, equinixClient.VLANBatchPollInterval)
+		return h.instance.UpdateStatus(i)
+	}
 	logrus.Infof("reconfigured node %s\n", i.Name)
 	return h.instance.UpdateStatus(i)
 }
@@ -286,3 +365,254 @@ func (h *handler) manageNodes(_ string, i *equinix.Instance) (*equinix.Instance,
 
 	return i, nil
 }
+
+// syncNetworkConfig compares the port configuration of the device with the NetworkingConfiguration
+// of the instance, and reverts any changes made outside the operator. Once in sync, the device is
+// only requested again after the device poller flagged a drift of its listed ports.
+func (h *handler) syncNetworkConfig(key string, i *equinix.Instance) (*equinix.Instance, error) {
+	if i.Spec.NetworkingConfiguration.IsEmpty() {
+		return i, nil
+	}
+
+	if len(i.Status.VLANBatches) == 0 && equinix.InstanceNetworkSynced.IsTrue(i) {
+		return i, nil
+	}
+
+	m := equinixClient.NewClient(i.ObjectMeta.Annotations["token"], i.ObjectMeta.Annotations["projectID"])
+	status, drift, err := m.ReconcileNetworkConfig(i)
+	iCopy := i.DeepCopy()
+	iCopy.Status = *status
+	if len(status.VLANBatches) != 0 {
+		h.instance.EnqueueAfter(key, equinixClient.VLANBatchPollInterval)
+	}
+
+	if err != nil {
+		equinix.InstanceNetworkSynced.SetError(iCopy, "ReconcileFailed", err)
+	} else if len(status.VLANBatches) != 0 {
+		equinix.InstanceNetworkSynced.Unknown(iCopy)
+		equinix.InstanceNetworkSynced.Reason(iCopy, "Converging")
+		if drift != nil {
+			logrus.Infof("correcting network drift on instance %s: %s", i.Name, drift)
+			equinix.InstanceNetworkSynced.Message(iCopy, drift.String())
+		}
+	} else if !drift.IsEmpty() {
+		logrus.Infof("corrected network drift on instance %s: %s", i.Name, drift)
+		equinix.InstanceNetworkSynced.True(iCopy)
+		equinix.InstanceNetworkSynced.Reason(iCopy, "DriftCorrected")
+		equinix.InstanceNetworkSynced.Message(iCopy, drift.String())
+	} else {
+		equinix.InstanceNetworkSynced.SetError(iCopy, "InSync", nil)
+	}
+
+	if !reflect.DeepEqual(i.Status, iCopy.Status) {
+		if _, updateErr := h.instance.UpdateStatus(iCopy); updateErr != nil {
+			return i, updateErr
+		}
+	}
+
+	return i, err
+}
+
+// provisionDataDisks adds the disks of the node selected by the DataDiskConfiguration of the instance
+// to Longhorn, by provisioning the matching BlockDevices discovered by the harvester node-disk-manager
+func (h *handler) provisionDataDisks(key string, i *equinix.Instance) (*equinix.Instance, error) {
+	if i.Spec.DataDisks == nil || equinix.InstanceDataDisksProvisioned.IsTrue(i) {
+		return i, nil
+	}
+
+	iCopy := i.DeepCopy()
+	iCopy.Status.DataDisks = nil
+
+	var pending []string
+	if len(i.Spec.DataDisks.Paths) != 0 {
+		devices, err := h.blockDevice.List(h.ctx, i.Name)
+		if err != nil {
+			return i, err
+		}
+
+		for _, device := range devices {
+			if !dataDiskMatches(i.Spec.DataDisks, device) || device.Provisioned {
+				continue
+			}
+
+			logrus.Infof("provisioning data disk %s on instance %s", device.DevPath, i.Name)
+			if err := h.blockDevice.Provision(h.ctx, device.Name, i.Spec.DataDisks.ForceFormatted); err != nil {
+				return i, err
+			}
+		}
+
+		iCopy.Status.DataDisks, pending = dataDiskProgress(i.Spec.DataDisks, devices)
+	}
+
+	if len(pending) == 0 {
+		equinix.InstanceDataDisksProvisioned.True(iCopy)
+		equinix.InstanceDataDisksProvisioned.Message(iCopy, "")
+	} else {
+		// block devices are discovered and formatted asynchronously once the node has joined
+		h.instance.EnqueueAfter(key, dataDiskSyncInterval)
+		equinix.InstanceDataDisksProvisioned.Unknown(iCopy)
+		equinix.InstanceDataDisksProvisioned.Message(iCopy, fmt.Sprintf("waiting for block devices %s to be provisioned", strings.Join(pending, ",")))
+	}
+
+	if reflect.DeepEqual(i.Status, iCopy.Status) {
+		return i, nil
+	}
+
+	return h.instance.UpdateStatus(iCopy)
+}
+
+// dataDiskProgress returns the provisioned data disks and the selected paths which are still pending.
+// A selected path is pending until its block device has been discovered and provisioned, unless the
+// discovered device is skipped for its type or size.
+func dataDiskProgress(config *equinix.DataDiskConfiguration, devices []harvester.BlockDevice) (provisioned []string, pending []string) {
+	discovered := make(map[string]harvester.BlockDevice, len(devices))
+	for _, device := range devices {
+		discovered[device.DevPath] = device
+	}
+
+	for _, path := range config.Paths {
+		device, ok := discovered[path]
+		switch {
+		case !ok:
+			pending = append(pending, path)
+		case !dataDiskMatches(config, device):
+		case device.Provisioned && device.Phase == harvester.ProvisionPhaseComplete:
+			provisioned = append(provisioned, path)
+		default:
+			pending = append(pending, path)
+		}
+	}
+
+	return provisioned, pending
+}
+
+// dataDiskMatches returns true if the device is selected by the paths of the configuration. Without
+// paths no device is selected, as every device includes the disk Harvester is installed on.
+func dataDiskMatches(config *equinix.DataDiskConfiguration, device harvester.BlockDevice) bool {
+	if device.DeviceType != "" && device.DeviceType != harvester.DeviceTypeDisk {
+		return false
+	}
+
+	if !containsPath(config.Paths, device.DevPath) {
+		return false
+	}
+
+	if config.MinSize != nil && device.SizeBytes < config.MinSize.Value() {
+		return false
+	}
+
+	return true
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configureBGP creates the bgp sessions of the device and publishes the neighbor information
+// as a secret for a bgp speaker on the node to consume
+func (h *handler) configureBGP(_ string, i *equinix.Instance) (*equinix.Instance, error) {
+	if i.Spec.BGP == nil {
+		return i, nil
+	}
+
+	m := equinixClient.NewClient(i.ObjectMeta.Annotations["token"], i.ObjectMeta.Annotations["projectID"])
+	status, err := m.CreateBGPSessions(i)
+	if err != nil {
+		return i, err
+	}
+
+	neighbors, err := m.BGPNeighbors(i)
+	if err != nil {
+		return i, err
+	}
+
+	err = h.applyBGPSecret(i, neighbors)
+	if err != nil {
+		return i, err
+	}
+
+	if reflect.DeepEqual(i.Status.BGPSessions, status.BGPSessions) {
+		return i, nil
+	}
+
+	i.Status = *status
+	return h.instance.UpdateStatus(i)
+}
+
+func (h *handler) applyBGPSecret(i *equinix.Instance, neighbors map[string]string) error {
+	name := bgpSecretName(i)
+	namespace := util.OperatorNamespace()
+	secret, err := h.secret.Get(namespace, name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	if apierrors.IsNotFound(err) {
+		_, err = h.secret.Create(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					"instance": i.Name,
+				},
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: "equinix.harvesterhci.io/v1",
+						Kind:       "Instance",
+						Name:       i.Name,
+						UID:        i.UID,
+					},
+				},
+			},
+			StringData: neighbors,
+		})
+		return err
+	}
+
+	if secretDataMatches(secret.Data, neighbors) {
+		return nil
+	}
+
+	secretCopy := secret.DeepCopy()
+	secretCopy.Data = nil
+	secretCopy.StringData = neighbors
+	_, err = h.secret.Update(secretCopy)
+	return err
+}
+
+func (h *handler) findAndDeleteBGPSecret(i *equinix.Instance) error {
+	if i.Spec.BGP == nil {
+		return nil
+	}
+
+	err := h.secret.Delete(util.OperatorNamespace(), bgpSecretName(i), &metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func secretDataMatches(data map[string][]byte, stringData map[string]string) bool {
+	if len(data) != len(stringData) {
+		return false
+	}
+
+	for k, v := range stringData {
+		if string(data[k]) != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func bgpSecretName(i *equinix.Instance) string {
+	return fmt.Sprintf("%s-bgp", i.Name)
+}
@@ -0,0 +1,251 @@
+package instance
+
+import (
+	"reflect"
+	"testing"
+
+	corecontrollers "github.com/rancher/wrangler/pkg/generated/controllers/core/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
+	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
+	"github.com/harvester/harvester-equinix-addon/pkg/util"
+)
+
+func TestDataDiskMatches(t *testing.T) {
+	minSize := resource.MustParse("1Ti")
+
+	tests := []struct {
+		name   string
+		config *equinix.DataDiskConfiguration
+		device harvester.BlockDevice
+		want   bool
+	}{
+		{
+			name:   "selected path",
+			config: &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb"}},
+			device: harvester.BlockDevice{DevPath: "/dev/sdb", DeviceType: harvester.DeviceTypeDisk},
+			want:   true,
+		},
+		{
+			name:   "other path",
+			config: &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb"}},
+			device: harvester.BlockDevice{DevPath: "/dev/sda", DeviceType: harvester.DeviceTypeDisk},
+		},
+		{
+			name:   "no paths selects nothing",
+			config: &equinix.DataDiskConfiguration{PlanDisks: true},
+			device: harvester.BlockDevice{DevPath: "/dev/sda", DeviceType: harvester.DeviceTypeDisk},
+		},
+		{
+			name:   "partitions are skipped",
+			config: &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb1"}},
+			device: harvester.BlockDevice{DevPath: "/dev/sdb1", DeviceType: "part"},
+		},
+		{
+			name:   "smaller disks are skipped",
+			config: &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb"}, MinSize: &minSize},
+			device: harvester.BlockDevice{DevPath: "/dev/sdb", SizeBytes: 240 << 30},
+		},
+		{
+			name:   "large enough disk",
+			config: &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb"}, MinSize: &minSize},
+			device: harvester.BlockDevice{DevPath: "/dev/sdb", SizeBytes: 2 << 40},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dataDiskMatches(tt.config, tt.device); got != tt.want {
+				t.Errorf("dataDiskMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataDiskProgress(t *testing.T) {
+	minSize := resource.MustParse("1Ti")
+	provisioned := func(path string) harvester.BlockDevice {
+		return harvester.BlockDevice{DevPath: path, SizeBytes: 2 << 40, Provisioned: true, Phase: harvester.ProvisionPhaseComplete}
+	}
+
+	tests := []struct {
+		name            string
+		config          *equinix.DataDiskConfiguration
+		devices         []harvester.BlockDevice
+		wantProvisioned []string
+		wantPending     []string
+	}{
+		{
+			name:        "no devices discovered yet",
+			config:      &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb", "/dev/sdc"}},
+			wantPending: []string{"/dev/sdb", "/dev/sdc"},
+		},
+		{
+			name:            "one of two disks provisioned",
+			config:          &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb", "/dev/sdc"}},
+			devices:         []harvester.BlockDevice{provisioned("/dev/sdb"), {DevPath: "/dev/sdc", Provisioned: true}},
+			wantProvisioned: []string{"/dev/sdb"},
+			wantPending:     []string{"/dev/sdc"},
+		},
+		{
+			name:            "all disks provisioned",
+			config:          &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb", "/dev/sdc"}},
+			devices:         []harvester.BlockDevice{provisioned("/dev/sda"), provisioned("/dev/sdb"), provisioned("/dev/sdc")},
+			wantProvisioned: []string{"/dev/sdb", "/dev/sdc"},
+		},
+		{
+			name:            "skipped disks are not pending",
+			config:          &equinix.DataDiskConfiguration{Paths: []string{"/dev/sdb", "/dev/sdc"}, MinSize: &minSize},
+			devices:         []harvester.BlockDevice{provisioned("/dev/sdb"), {DevPath: "/dev/sdc", SizeBytes: 240 << 30}},
+			wantProvisioned: []string{"/dev/sdb"},
+		},
+		{
+			name:    "no paths",
+			config:  &equinix.DataDiskConfiguration{PlanDisks: true},
+			devices: []harvester.BlockDevice{provisioned("/dev/sda")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotProvisioned, gotPending := dataDiskProgress(tt.config, tt.devices)
+			if !reflect.DeepEqual(gotProvisioned, tt.wantProvisioned) {
+				t.Errorf("dataDiskProgress() provisioned = %v, want %v", gotProvisioned, tt.wantProvisioned)
+			}
+			if !reflect.DeepEqual(gotPending, tt.wantPending) {
+				t.Errorf("dataDiskProgress() pending = %v, want %v", gotPending, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestStoppedByError(t *testing.T) {
+	instance := func(generation, failedGeneration int64, reason string) *equinix.Instance {
+		i := &equinix.Instance{}
+		i.Generation = generation
+		i.Status.FailedGeneration = failedGeneration
+		if reason != "" {
+			equinix.InstanceReconciled.False(i)
+			equinix.InstanceReconciled.Reason(i, reason)
+		}
+		return i
+	}
+
+	tests := []struct {
+		name     string
+		instance *equinix.Instance
+		want     bool
+	}{
+		{name: "no error", instance: instance(1, 0, "")},
+		{name: "invalid request", instance: instance(1, 1, string(equinixClient.ErrorClassInvalid)), want: true},
+		{name: "auth failure", instance: instance(2, 2, string(equinixClient.ErrorClassAuth)), want: true},
+		{name: "not found", instance: instance(1, 1, string(equinixClient.ErrorClassNotFound)), want: true},
+		{name: "spec changed", instance: instance(2, 1, string(equinixClient.ErrorClassInvalid))},
+		{name: "capacity is retried", instance: instance(1, 0, string(equinixClient.ErrorClassCapacity))},
+		{name: "resumed", instance: func() *equinix.Instance {
+			i := instance(1, 1, string(equinixClient.ErrorClassAuth))
+			equinix.InstanceReconciled.Unknown(i)
+			equinix.InstanceReconciled.Reason(i, "CredentialsRevalidated")
+			return i
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stoppedByError(tt.instance); got != tt.want {
+				t.Errorf("stoppedByError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeSecrets keeps secrets in memory, only the methods used by the handler are implemented
+type fakeSecrets struct {
+	corecontrollers.SecretController
+	secrets map[string]*v1.Secret
+	updates int
+}
+
+func (f *fakeSecrets) Get(namespace, name string, _ metav1.GetOptions) (*v1.Secret, error) {
+	if secret, ok := f.secrets[namespace+"/"+name]; ok {
+		return secret.DeepCopy(), nil
+	}
+	return nil, apierrors.NewNotFound(v1.Resource("secrets"), name)
+}
+
+func (f *fakeSecrets) Create(secret *v1.Secret) (*v1.Secret, error) {
+	f.store(secret)
+	return secret, nil
+}
+
+func (f *fakeSecrets) Update(secret *v1.Secret) (*v1.Secret, error) {
+	f.updates++
+	f.store(secret)
+	return secret, nil
+}
+
+// store converts the string data of the secret like the api server does
+func (f *fakeSecrets) store(secret *v1.Secret) {
+	stored := secret.DeepCopy()
+	if stored.Data == nil {
+		stored.Data = make(map[string][]byte)
+	}
+	for k, v := range stored.StringData {
+		stored.Data[k] = []byte(v)
+	}
+	stored.StringData = nil
+	f.secrets[secret.Namespace+"/"+secret.Name] = stored
+}
+
+func TestApplyBGPSecret(t *testing.T) {
+	secrets := &fakeSecrets{secrets: make(map[string]*v1.Secret)}
+	h := &handler{secret: secrets}
+	i := &equinix.Instance{ObjectMeta: metav1.ObjectMeta{Name: "instance", UID: "uid"}}
+	name := util.OperatorNamespace() + "/" + bgpSecretName(i)
+
+	applies := []struct {
+		name        string
+		neighbors   map[string]string
+		wantUpdates int
+	}{
+		{
+			name:      "created",
+			neighbors: map[string]string{"ipv4.peer-as": "65530", "ipv4.peer-ip-0": "169.254.255.1", "ipv4.md5-password": "secret"},
+		},
+		{
+			name:      "unchanged",
+			neighbors: map[string]string{"ipv4.peer-as": "65530", "ipv4.peer-ip-0": "169.254.255.1", "ipv4.md5-password": "secret"},
+		},
+		{
+			name:        "changed neighbors replace the data",
+			neighbors:   map[string]string{"ipv4.peer-as": "65530", "ipv4.peer-ip-0": "169.254.255.2"},
+			wantUpdates: 1,
+		},
+	}
+
+	for _, apply := range applies {
+		if err := h.applyBGPSecret(i, apply.neighbors); err != nil {
+			t.Fatalf("%s: %v", apply.name, err)
+		}
+
+		secret := secrets.secrets[name]
+		if secret == nil {
+			t.Fatalf("%s: secret %s was not created", apply.name, name)
+		}
+		if !secretDataMatches(secret.Data, apply.neighbors) {
+			t.Errorf("%s: secret data = %v, want %v", apply.name, secret.Data, apply.neighbors)
+		}
+		if secrets.updates != apply.wantUpdates {
+			t.Errorf("%s: secret was updated %d times, want %d", apply.name, secrets.updates, apply.wantUpdates)
+		}
+		if secret.Labels["instance"] != i.Name || len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != i.UID {
+			t.Errorf("%s: secret is not owned by the instance: %+v", apply.name, secret.ObjectMeta)
+		}
+	}
+}
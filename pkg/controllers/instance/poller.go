@@ -0,0 +1,211 @@
+package instance
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
+	controller "github.com/harvester/harvester-equinix-addon/pkg/generated/controllers/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// provisioningPollInterval is used while any instance waits for its device to change state
+	provisioningPollInterval = 15 * time.Second
+	// steadyPollInterval is used once all devices are provisioned, and is the upper bound of the
+	// backoff after failed list calls
+	steadyPollInterval = 5 * time.Minute
+	// deviceResyncInterval rechecks provisioning instances in case the poller misses a short lived
+	// state of their device
+	deviceResyncInterval = 10 * time.Minute
+	// driftedReason is the reason of the NetworkSynced condition of instances whose listed ports
+	// drifted from their NetworkingConfiguration
+	driftedReason = "Drifted"
+)
+
+// devicePoller lists the devices of every project once per interval and enqueues the instances
+// whose device changed state, so the instance handlers don't need to poll the Metal api per device
+type devicePoller struct {
+	instance  instanceQueue
+	newClient func(token, projectID string) *equinixClient.MetalClient
+	states    map[string]string
+	lock      sync.Mutex
+}
+
+// instanceQueue is the part of the instance controller used by the device poller
+type instanceQueue interface {
+	Cache() controller.InstanceCache
+	Enqueue(name string)
+	UpdateStatus(*equinix.Instance) (*equinix.Instance, error)
+}
+
+func newDevicePoller(instance instanceQueue) *devicePoller {
+	return &devicePoller{
+		instance:  instance,
+		newClient: equinixClient.NewClient,
+		states:    make(map[string]string),
+	}
+}
+
+func (p *devicePoller) run(ctx context.Context) {
+	interval := provisioningPollInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		provisioning, err := p.poll()
+		if err != nil {
+			logrus.Errorf("error polling equinix devices: %v", err)
+		}
+		interval = nextPollInterval(interval, provisioning, err)
+	}
+}
+
+// nextPollInterval doubles the interval after a failed poll, up to the steady interval, and
+// otherwise polls faster while any instance is being provisioned
+func nextPollInterval(interval time.Duration, provisioning bool, err error) time.Duration {
+	switch {
+	case err != nil:
+		interval *= 2
+		if interval > steadyPollInterval {
+			interval = steadyPollInterval
+		}
+		return interval
+	case provisioning:
+		return provisioningPollInterval
+	default:
+		return steadyPollInterval
+	}
+}
+
+// poll lists the devices of all projects with instances, and reports whether any instance is
+// still being provisioned
+func (p *devicePoller) poll() (provisioning bool, err error) {
+	instances, err := p.instance.Cache().List(labels.Everything())
+	if err != nil {
+		return false, err
+	}
+
+	type project struct {
+		token     string
+		projectID string
+	}
+
+	projects := make(map[project][]*equinix.Instance)
+	for _, i := range instances {
+		// the credentials of stopped instances may have been rejected, and aren't used until they are resumed
+		if i.DeletionTimestamp != nil || i.Status.InstanceID == "" || stoppedByError(i) {
+			continue
+		}
+
+		if isProvisioning(i) {
+			provisioning = true
+		}
+
+		key := project{token: i.Annotations["token"], projectID: i.Spec.ProjectID}
+		projects[key] = append(projects[key], i)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	seen := make(map[string]bool)
+	for key, projectInstances := range projects {
+		m := p.newClient(key.token, key.projectID)
+		devices, listErr := m.ListDevices()
+		if listErr != nil {
+			err = listErr
+			// keep the last known states, the project is retried on the next poll
+			for _, i := range projectInstances {
+				seen[i.Name] = true
+			}
+			continue
+		}
+
+		listed := make(map[string]*packngo.Device, len(devices))
+		for n := range devices {
+			listed[devices[n].ID] = &devices[n]
+		}
+
+		for _, i := range projectInstances {
+			seen[i.Name] = true
+			state := "missing"
+			if device, ok := listed[i.Status.InstanceID]; ok {
+				state = device.State
+				if err := p.refreshManagedStatus(i, device); err != nil {
+					logrus.Errorf("error refreshing the device status of instance %s: %v", i.Name, err)
+				}
+			}
+
+			previous, known := p.states[i.Name]
+			p.states[i.Name] = state
+			if known && previous == state {
+				continue
+			}
+
+			if known || isProvisioning(i) {
+				logrus.Debugf("device of instance %s changed state from %q to %q", i.Name, previous, state)
+				p.instance.Enqueue(i.Name)
+			}
+		}
+	}
+
+	for name := range p.states {
+		if !seen[name] {
+			delete(p.states, name)
+		}
+	}
+
+	return provisioning, err
+}
+
+// refreshManagedStatus updates the device metadata and ports of a managed instance from its listed
+// device, and flags the NetworkSynced condition when the listed ports drifted from the
+// NetworkingConfiguration, so the instance handler only requests the device to correct a drift
+func (p *devicePoller) refreshManagedStatus(i *equinix.Instance, device *packngo.Device) error {
+	if i.Status.Status != "managed" {
+		return nil
+	}
+
+	iCopy := i.DeepCopy()
+	iCopy.Status = *equinixClient.ListedDeviceStatus(device, i)
+
+	// a drift is only flagged once the last one has been corrected, and while no vlan batches are pending
+	if !i.Spec.NetworkingConfiguration.IsEmpty() && len(i.Status.VLANBatches) == 0 && equinix.InstanceNetworkSynced.IsTrue(i) {
+		drift, err := equinixClient.ComputeNetworkDrift(device, i.Spec.NetworkingConfiguration)
+		switch {
+		case err != nil:
+			equinix.InstanceNetworkSynced.SetError(iCopy, driftedReason, err)
+		case !drift.IsEmpty():
+			logrus.Infof("detected network drift on instance %s: %s", i.Name, drift)
+			equinix.InstanceNetworkSynced.False(iCopy)
+			equinix.InstanceNetworkSynced.Reason(iCopy, driftedReason)
+			equinix.InstanceNetworkSynced.Message(iCopy, drift.String())
+		}
+	}
+
+	if reflect.DeepEqual(i.Status, iCopy.Status) {
+		return nil
+	}
+
+	_, err := p.instance.UpdateStatus(iCopy)
+	return err
+}
+
+// isProvisioning reports whether the instance waits for its device to change state
+func isProvisioning(i *equinix.Instance) bool {
+	switch i.Status.Status {
+	case "submitted", "queued", "reinstalling":
+		return true
+	}
+
+	return false
+}
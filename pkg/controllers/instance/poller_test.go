@@ -0,0 +1,363 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
+	controller "github.com/harvester/harvester-equinix-addon/pkg/generated/controllers/equinix.harvesterhci.io/v1"
+)
+
+// fakeMetal serves the devices of each project, and records the token and project of every list call
+type fakeMetal struct {
+	lock    sync.Mutex
+	devices map[string][]packngo.Device
+	failing map[string]bool
+	calls   []string
+}
+
+func (f *fakeMetal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != http.MethodGet || len(parts) != 3 || parts[0] != "projects" || parts[2] != "devices" {
+		http.NotFound(w, r)
+		return
+	}
+
+	project := parts[1]
+	f.calls = append(f.calls, r.Header.Get("X-Auth-Token")+"/"+project)
+	if f.failing[project] {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"forbidden"}})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string][]packngo.Device{"devices": f.devices[project]})
+}
+
+func (f *fakeMetal) setState(project, id, state string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for n := range f.devices[project] {
+		if f.devices[project][n].ID == id {
+			f.devices[project][n].State = state
+		}
+	}
+}
+
+// fakeInstances records the instances enqueued and updated by the poller
+type fakeInstances struct {
+	instances []*equinix.Instance
+	enqueued  []string
+	updated   []*equinix.Instance
+}
+
+func (f *fakeInstances) Cache() controller.InstanceCache { return f }
+
+func (f *fakeInstances) Get(name string) (*equinix.Instance, error) {
+	for _, i := range f.instances {
+		if i.Name == name {
+			return i, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (f *fakeInstances) List(labels.Selector) ([]*equinix.Instance, error) { return f.instances, nil }
+
+func (f *fakeInstances) AddIndexer(string, controller.InstanceIndexer) {}
+
+func (f *fakeInstances) GetByIndex(string, string) ([]*equinix.Instance, error) { return nil, nil }
+
+func (f *fakeInstances) Enqueue(name string) { f.enqueued = append(f.enqueued, name) }
+
+func (f *fakeInstances) UpdateStatus(i *equinix.Instance) (*equinix.Instance, error) {
+	f.updated = append(f.updated, i)
+	return i, nil
+}
+
+func (f *fakeInstances) reset() {
+	f.enqueued = nil
+	f.updated = nil
+}
+
+func newTestPoller(t *testing.T, metal *fakeMetal, instances ...*equinix.Instance) (*devicePoller, *fakeInstances) {
+	t.Helper()
+	server := httptest.NewServer(metal)
+	t.Cleanup(server.Close)
+
+	queue := &fakeInstances{instances: instances}
+	p := newDevicePoller(queue)
+	p.newClient = func(token, projectID string) *equinixClient.MetalClient {
+		client, err := packngo.NewClientWithBaseURL("test", token, server.Client(), server.URL+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &equinixClient.MetalClient{Client: client, ProjectID: projectID}
+	}
+
+	return p, queue
+}
+
+func testInstance(name, token, project, deviceID, status string) *equinix.Instance {
+	i := &equinix.Instance{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{"token": token}},
+		Spec:       equinix.InstanceSpec{ProjectID: project},
+	}
+	i.Status.InstanceID = deviceID
+	i.Status.Status = status
+	return i
+}
+
+func TestNextPollInterval(t *testing.T) {
+	failed := errors.New("error listing devices")
+
+	tests := []struct {
+		name         string
+		interval     time.Duration
+		provisioning bool
+		err          error
+		want         time.Duration
+	}{
+		{name: "provisioning", interval: steadyPollInterval, provisioning: true, want: provisioningPollInterval},
+		{name: "steady", interval: provisioningPollInterval, want: steadyPollInterval},
+		{name: "error backs off", interval: provisioningPollInterval, provisioning: true, err: failed, want: 2 * provisioningPollInterval},
+		{name: "backoff is capped", interval: 4 * time.Minute, err: failed, want: steadyPollInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextPollInterval(tt.interval, tt.provisioning, tt.err); got != tt.want {
+				t.Errorf("nextPollInterval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPollGroupsByTokenAndProject(t *testing.T) {
+	metal := &fakeMetal{devices: map[string][]packngo.Device{
+		"project-a": {{ID: "device-1", State: "active"}, {ID: "device-2", State: "active"}, {ID: "device-3", State: "active"}},
+		"project-b": {{ID: "device-4", State: "queued"}},
+	}}
+
+	stopped := testInstance("stopped", "token-3", "project-a", "device-3", "managed")
+	stopped.Generation = 2
+	stopped.Status.FailedGeneration = 2
+	equinix.InstanceReconciled.SetError(stopped, string(equinixClient.ErrorClassAuth), errors.New("invalid token"))
+
+	p, _ := newTestPoller(t, metal,
+		testInstance("instance-1", "token-1", "project-a", "device-1", "managed"),
+		testInstance("instance-2", "token-1", "project-a", "device-2", "managed"),
+		testInstance("instance-3", "token-2", "project-a", "device-3", "managed"),
+		testInstance("instance-4", "token-1", "project-b", "device-4", "queued"),
+		testInstance("not-created", "token-1", "project-c", "", ""),
+		stopped,
+	)
+
+	provisioning, err := p.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !provisioning {
+		t.Error("poll() provisioning = false, want true")
+	}
+
+	sort.Strings(metal.calls)
+	want := []string{"token-1/project-a", "token-1/project-b", "token-2/project-a"}
+	if !reflect.DeepEqual(metal.calls, want) {
+		t.Errorf("poll() listed %v, want %v", metal.calls, want)
+	}
+}
+
+func TestPollEnqueuesOnStateChange(t *testing.T) {
+	metal := &fakeMetal{devices: map[string][]packngo.Device{
+		"project": {{ID: "device-1", State: "active"}, {ID: "device-2", State: "queued"}},
+	}}
+	p, queue := newTestPoller(t, metal,
+		testInstance("managed", "token", "project", "device-1", "managed"),
+		testInstance("queued", "token", "project", "device-2", "queued"),
+	)
+
+	polls := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{name: "first poll enqueues provisioning instances", want: []string{"queued"}},
+		{name: "unchanged states"},
+		{name: "device changed state", change: func() { metal.setState("project", "device-2", "active") }, want: []string{"queued"}},
+		{name: "device removed", change: func() {
+			metal.devices["project"] = metal.devices["project"][1:]
+		}, want: []string{"managed"}},
+	}
+
+	for _, poll := range polls {
+		queue.reset()
+		if poll.change != nil {
+			poll.change()
+		}
+		if _, err := p.poll(); err != nil {
+			t.Fatalf("%s: %v", poll.name, err)
+		}
+		if !reflect.DeepEqual(queue.enqueued, poll.want) {
+			t.Errorf("%s: enqueued %v, want %v", poll.name, queue.enqueued, poll.want)
+		}
+	}
+}
+
+func TestPollListError(t *testing.T) {
+	metal := &fakeMetal{
+		devices: map[string][]packngo.Device{
+			"project-a": {{ID: "device-1", State: "active"}},
+			"project-b": {{ID: "device-2", State: "active"}},
+		},
+		failing: map[string]bool{"project-a": true},
+	}
+	p, queue := newTestPoller(t, metal,
+		testInstance("instance-1", "token", "project-a", "device-1", "managed"),
+		testInstance("instance-2", "token", "project-b", "device-2", "managed"),
+	)
+	p.states["instance-1"] = "active"
+
+	if _, err := p.poll(); err == nil {
+		t.Fatal("poll() error = nil, want the list error")
+	}
+	if len(queue.enqueued) != 0 {
+		t.Errorf("poll() enqueued %v after a failed list call", queue.enqueued)
+	}
+	if state := p.states["instance-1"]; state != "active" {
+		t.Errorf("state of instance-1 = %q, want the last known state", state)
+	}
+	if _, ok := p.states["instance-2"]; !ok {
+		t.Error("the other project was not polled")
+	}
+
+	// the project recovers with the device in the same state
+	metal.failing = nil
+	if _, err := p.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.enqueued) != 0 {
+		t.Errorf("poll() enqueued %v after the project recovered", queue.enqueued)
+	}
+}
+
+func TestPollRefreshesManagedStatus(t *testing.T) {
+	device := func(vlans ...packngo.VirtualNetwork) packngo.Device {
+		return packngo.Device{
+			ID:       "device",
+			Hostname: "instance",
+			State:    "active",
+			Plan:     &packngo.Plan{Slug: "baremetal_1e"},
+			NetworkPorts: []packngo.Port{
+				{ID: "bond0", Name: "bond0", Type: "NetworkBondPort"},
+				{ID: "eth1", Name: "eth1", Type: "NetworkPort", AttachedVirtualNetworks: vlans},
+			},
+		}
+	}
+
+	networking := equinix.NetworkingConfiguration{
+		Type:       packngo.NetworkTypeHybrid,
+		Interfaces: []equinix.InterfaceConfiguration{{Name: "eth1", VlanIDS: []string{"100"}}},
+	}
+
+	tests := []struct {
+		name        string
+		device      packngo.Device
+		status      string
+		synced      bool
+		batches     []equinix.VLANBatchStatus
+		wantUpdate  bool
+		wantDrifted bool
+	}{
+		{
+			name:       "device metadata and ports",
+			device:     device(packngo.VirtualNetwork{ID: "vlan", VXLAN: 100}),
+			status:     "managed",
+			synced:     true,
+			wantUpdate: true,
+		},
+		{
+			name:        "drifted ports",
+			device:      device(packngo.VirtualNetwork{ID: "vlan", VXLAN: 200}),
+			status:      "managed",
+			synced:      true,
+			wantUpdate:  true,
+			wantDrifted: true,
+		},
+		{
+			name:       "drift is not flagged while the last one is corrected",
+			device:     device(packngo.VirtualNetwork{ID: "vlan", VXLAN: 200}),
+			status:     "managed",
+			wantUpdate: true,
+		},
+		{
+			name:       "drift is not flagged while vlan batches are pending",
+			device:     device(),
+			status:     "managed",
+			synced:     true,
+			batches:    []equinix.VLANBatchStatus{{Port: "eth1", BatchID: "batch"}},
+			wantUpdate: true,
+		},
+		{
+			name:   "instance is not managed",
+			device: device(),
+			status: "ready",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metal := &fakeMetal{devices: map[string][]packngo.Device{"project": {tt.device}}}
+			i := testInstance("instance", "token", "project", "device", tt.status)
+			i.Spec.NetworkingConfiguration = networking
+			i.Status.VLANBatches = tt.batches
+			if tt.synced {
+				equinix.InstanceNetworkSynced.SetError(i, "InSync", nil)
+			}
+
+			p, queue := newTestPoller(t, metal, i)
+			if _, err := p.poll(); err != nil {
+				t.Fatal(err)
+			}
+
+			if (len(queue.updated) != 0) != tt.wantUpdate {
+				t.Fatalf("poll() updated %d instances, want update %v", len(queue.updated), tt.wantUpdate)
+			}
+			if !tt.wantUpdate {
+				return
+			}
+
+			updated := queue.updated[0]
+			if updated.Status.Device == nil || updated.Status.Device.Plan != "baremetal_1e" {
+				t.Errorf("status.device = %+v, want the listed device metadata", updated.Status.Device)
+			}
+			if len(updated.Status.Ports) != 2 {
+				t.Errorf("status.ports = %+v, want the listed ports", updated.Status.Ports)
+			}
+
+			drifted := equinix.InstanceNetworkSynced.GetReason(updated) == driftedReason
+			if drifted != tt.wantDrifted {
+				t.Errorf("NetworkSynced reason = %q, want drifted %v", equinix.InstanceNetworkSynced.GetReason(updated), tt.wantDrifted)
+			}
+			if drifted && !equinix.InstanceNetworkSynced.IsFalse(updated) {
+				t.Error("NetworkSynced is not False after a drift")
+			}
+		})
+	}
+}
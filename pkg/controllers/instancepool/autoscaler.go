@@ -0,0 +1,378 @@
+package instancepool
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	DefaultScaleUpUtilization   = 80
+	DefaultScaleDownUtilization = 30
+	DefaultStorageUtilization   = 80
+	DefaultScaleUpCooldown      = 5 * time.Minute
+	DefaultScaleDownCooldown    = 30 * time.Minute
+	// autoscaleInterval is the interval the signals of the cluster are evaluated at
+	autoscaleInterval = time.Minute
+	virtLauncherLabel = "kubevirt.io"
+	virtLauncher      = "virt-launcher"
+)
+
+// desiredCount returns the number of instances the pool should have. With autoscaling enabled the
+// count of the spec is only the initial count. The result is bounded by minCount and maxCount.
+func desiredCount(ip *equinix.InstancePool) int {
+	count := ip.Spec.Count
+	if autoscalingEnabled(ip) && ip.Status.Autoscaler != nil {
+		count = ip.Status.Autoscaler.DesiredCount
+	}
+
+	if ip.Spec.MinCount > 0 && count < ip.Spec.MinCount {
+		count = ip.Spec.MinCount
+	}
+
+	if ip.Spec.MaxCount > 0 && count > ip.Spec.MaxCount {
+		count = ip.Spec.MaxCount
+	}
+
+	return count
+}
+
+// draining returns the instance drained for a scale-down of the pool, if any
+func draining(ip *equinix.InstancePool) string {
+	if ip.Status.Autoscaler == nil {
+		return ""
+	}
+
+	return ip.Status.Autoscaler.Draining
+}
+
+func autoscalingEnabled(ip *equinix.InstancePool) bool {
+	return ip.Spec.Autoscaling != nil && ip.Spec.Autoscaling.Enabled
+}
+
+// clusterUsage holds the requested and allocatable resources of the schedulable nodes of the cluster
+type clusterUsage struct {
+	cpuRequested      int64
+	cpuAllocatable    int64
+	memoryRequested   int64
+	memoryAllocatable int64
+	storageMaximum    int64
+	storageAvailable  int64
+	pendingVMs        int
+	// nodes holds the usage of each node, used to project the utilisation after a scale-down
+	nodes map[string]*nodeUsage
+}
+
+type nodeUsage struct {
+	cpuRequested      int64
+	cpuAllocatable    int64
+	memoryRequested   int64
+	memoryAllocatable int64
+	storage           harvester.NodeStorage
+	vms               int
+	controlPlane      bool
+}
+
+// autoscale updates the desired count of the pool from the signals of the harvester cluster. It
+// scales by one instance at a time, only once all instances of the pool are managed, and waits for
+// the cooldown after the last scaling. Scaling down records the new desired count and the instance
+// chosen by the autoscaler first, then drains its node and deletes the instance once it is drained.
+func (h *handler) autoscale(key string, ip *equinix.InstancePool, instances []equinix.Instance) error {
+	if !autoscalingEnabled(ip) {
+		if ip.Status.Autoscaler != nil && ip.Status.Autoscaler.Draining != "" {
+			if err := h.cancelDrain(ip.Status.Autoscaler.Draining); err != nil {
+				return err
+			}
+		}
+		ip.Status.Autoscaler = nil
+		return nil
+	}
+
+	h.instancePool.EnqueueAfter(key, autoscaleInterval)
+	if ip.Status.Autoscaler == nil {
+		ip.Status.Autoscaler = &equinix.AutoscalerStatus{DesiredCount: ip.Spec.Count}
+	}
+	status := ip.Status.Autoscaler
+	status.DesiredCount = desiredCount(ip)
+
+	usage, err := h.clusterUsage()
+	if err != nil {
+		return err
+	}
+
+	config := ip.Spec.Autoscaling
+	scaleUpUtilization := defaultInt(config.ScaleUpUtilization, DefaultScaleUpUtilization)
+	scaleDownUtilization := defaultInt(config.ScaleDownUtilization, DefaultScaleDownUtilization)
+	storageUtilization := defaultInt(config.StorageUtilization, DefaultStorageUtilization)
+
+	status.PendingVMs = usage.pendingVMs
+	status.CPUUtilization = utilisation(usage.cpuRequested, usage.cpuAllocatable)
+	status.MemoryUtilization = utilisation(usage.memoryRequested, usage.memoryAllocatable)
+	status.StorageUtilization = utilisation(usage.storageMaximum-usage.storageAvailable, usage.storageMaximum)
+
+	if status.Draining != "" {
+		return h.continueDrain(key, ip)
+	}
+
+	for _, i := range instances {
+		if i.DeletionTimestamp != nil || i.Status.Status != "managed" {
+			// wait for the previous scaling to complete
+			return nil
+		}
+	}
+
+	if len(instances) != status.DesiredCount {
+		return nil
+	}
+
+	var reason string
+	switch {
+	case status.PendingVMs > 0:
+		reason = fmt.Sprintf("%d VMs can't be scheduled for lack of cpu or memory", status.PendingVMs)
+	case status.CPUUtilization >= scaleUpUtilization:
+		reason = fmt.Sprintf("cpu utilisation %d%% reached %d%%", status.CPUUtilization, scaleUpUtilization)
+	case status.MemoryUtilization >= scaleUpUtilization:
+		reason = fmt.Sprintf("memory utilisation %d%% reached %d%%", status.MemoryUtilization, scaleUpUtilization)
+	case status.StorageUtilization >= storageUtilization:
+		reason = fmt.Sprintf("storage utilisation %d%% reached %d%%", status.StorageUtilization, storageUtilization)
+	}
+
+	if reason != "" {
+		if ip.Spec.MaxCount > 0 && status.DesiredCount >= ip.Spec.MaxCount {
+			logrus.Debugf("not scaling up instancePool %s beyond maxCount %d: %s", ip.Name, ip.Spec.MaxCount, reason)
+			return nil
+		}
+
+		if !cooledDown(status, config.ScaleUpCooldown, DefaultScaleUpCooldown) {
+			return nil
+		}
+
+		// a scale-up which can't be submitted would stop the autoscaler, as it waits for the
+		// instances of the previous scaling
+		withinBudget, exceeded, err := h.withinBudget(ip, status.DesiredCount+1)
+		if err != nil {
+			return err
+		}
+		if !withinBudget {
+			logrus.Infof("not scaling up instancePool %s: %s", ip.Name, exceeded)
+			status.ScaleUpBlocked = exceeded
+			return nil
+		}
+
+		logrus.Infof("scaling up instancePool %s to %d instances: %s", ip.Name, status.DesiredCount+1, reason)
+		recordScaling(status, status.DesiredCount+1, "ScaleUp: "+reason)
+		return nil
+	}
+	status.ScaleUpBlocked = ""
+
+	if status.CPUUtilization >= scaleDownUtilization || status.MemoryUtilization >= scaleDownUtilization {
+		return nil
+	}
+
+	if status.DesiredCount <= ip.Spec.MinCount || status.DesiredCount <= 1 {
+		return nil
+	}
+
+	if !cooledDown(status, config.ScaleDownCooldown, DefaultScaleDownCooldown) {
+		return nil
+	}
+
+	candidate := scaleDownCandidate(instances, usage, scaleUpUtilization, storageUtilization)
+	if candidate == "" {
+		logrus.Debugf("no instance of instancePool %s can be drained for scale-down", ip.Name)
+		return nil
+	}
+
+	// the node is only drained once the new desired count is persisted with the status of the pool
+	reason = fmt.Sprintf("cpu utilisation %d%% and memory utilisation %d%% below %d%%, removing instance %s",
+		status.CPUUtilization, status.MemoryUtilization, scaleDownUtilization, candidate)
+	logrus.Infof("scaling down instancePool %s to %d instances: %s", ip.Name, status.DesiredCount-1, reason)
+	recordScaling(status, status.DesiredCount-1, "ScaleDown: "+reason)
+	status.Draining = candidate
+	h.instancePool.EnqueueAfter(key, drainPollInterval)
+	return nil
+}
+
+// scaleDownCandidate returns an instance whose node can be drained: it is not part of the control
+// plane, runs no VMs, and the remaining nodes stay below the scale-up thresholds without it
+func scaleDownCandidate(instances []equinix.Instance, usage *clusterUsage, scaleUpUtilization, storageUtilization int) string {
+	for i := len(instances) - 1; i >= 0; i-- {
+		name := instances[i].Name
+		n, ok := usage.nodes[name]
+		if !ok || n.controlPlane || n.vms > 0 {
+			continue
+		}
+
+		// pods of the node other than daemonsets move to the remaining nodes
+		if utilisation(usage.cpuRequested, usage.cpuAllocatable-n.cpuAllocatable) >= scaleUpUtilization ||
+			utilisation(usage.memoryRequested, usage.memoryAllocatable-n.memoryAllocatable) >= scaleUpUtilization {
+			continue
+		}
+
+		storageMaximum := usage.storageMaximum - n.storage.Maximum
+		storageUsed := usage.storageMaximum - usage.storageAvailable
+		if storageMaximum > 0 && utilisation(storageUsed, storageMaximum) >= storageUtilization {
+			continue
+		}
+
+		return name
+	}
+
+	return ""
+}
+
+// clusterUsage sums the resource requests of the pods on the schedulable nodes of the cluster and
+// their allocatable resources, and counts the VMs which can't be scheduled for lack of cpu or memory
+func (h *handler) clusterUsage() (*clusterUsage, error) {
+	nodes, err := h.node.Cache().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := h.pod.Cache().List("", labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := h.longhorn.Storage(h.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &clusterUsage{nodes: make(map[string]*nodeUsage)}
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || !nodeReady(node) {
+			continue
+		}
+
+		n := &nodeUsage{
+			cpuAllocatable:    node.Status.Allocatable.Cpu().MilliValue(),
+			memoryAllocatable: node.Status.Allocatable.Memory().Value(),
+			storage:           storage[node.Name],
+			controlPlane:      isControlPlane(node),
+		}
+		usage.nodes[node.Name] = n
+		usage.cpuAllocatable += n.cpuAllocatable
+		usage.memoryAllocatable += n.memoryAllocatable
+		usage.storageMaximum += n.storage.Maximum
+		usage.storageAvailable += n.storage.Available
+	}
+
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		if pod.Spec.NodeName == "" {
+			if pod.Labels[virtLauncherLabel] == virtLauncher && unschedulableForResources(pod) {
+				usage.pendingVMs++
+			}
+			continue
+		}
+
+		n, ok := usage.nodes[pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+
+		cpu, memory := podRequests(pod)
+		n.cpuRequested += cpu
+		n.memoryRequested += memory
+		usage.cpuRequested += cpu
+		usage.memoryRequested += memory
+		if pod.Labels[virtLauncherLabel] == virtLauncher {
+			n.vms++
+		}
+	}
+
+	return usage, nil
+}
+
+func podRequests(pod *corev1.Pod) (cpu int64, memory int64) {
+	for _, container := range pod.Spec.Containers {
+		cpu += container.Resources.Requests.Cpu().MilliValue()
+		memory += container.Resources.Requests.Memory().Value()
+	}
+
+	if pod.Spec.Overhead != nil {
+		cpu += pod.Spec.Overhead.Cpu().MilliValue()
+		memory += pod.Spec.Overhead.Memory().Value()
+	}
+
+	return cpu, memory
+}
+
+func unschedulableForResources(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse &&
+			condition.Reason == corev1.PodReasonUnschedulable {
+			return strings.Contains(condition.Message, "Insufficient cpu") ||
+				strings.Contains(condition.Message, "Insufficient memory")
+		}
+	}
+
+	return false
+}
+
+func nodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+func isControlPlane(node *corev1.Node) bool {
+	for _, role := range []string{"control-plane", "master", "etcd"} {
+		if node.Labels["node-role.kubernetes.io/"+role] == "true" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func cooledDown(status *equinix.AutoscalerStatus, cooldown *metav1.Duration, defaultCooldown time.Duration) bool {
+	if status.LastScaleTime == nil {
+		return true
+	}
+
+	wait := defaultCooldown
+	if cooldown != nil {
+		wait = cooldown.Duration
+	}
+
+	return time.Since(status.LastScaleTime.Time) >= wait
+}
+
+func recordScaling(status *equinix.AutoscalerStatus, desired int, reason string) {
+	now := metav1.Now()
+	status.DesiredCount = desired
+	status.LastScaleTime = &now
+	status.LastScaleReason = reason
+}
+
+func utilisation(used, total int64) int {
+	if total <= 0 {
+		return 0
+	}
+
+	return int(used * 100 / total)
+}
+
+func defaultInt(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+
+	return value
+}
@@ -0,0 +1,202 @@
+package instancepool
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
+)
+
+func TestDesiredCount(t *testing.T) {
+	autoscaling := &equinix.AutoscalingConfiguration{Enabled: true}
+
+	tests := []struct {
+		name string
+		spec equinix.InstancePoolSpec
+		auto *equinix.AutoscalerStatus
+		want int
+	}{
+		{
+			name: "count",
+			spec: equinix.InstancePoolSpec{Count: 3},
+			want: 3,
+		},
+		{
+			name: "count below minCount",
+			spec: equinix.InstancePoolSpec{Count: 1, MinCount: 2},
+			want: 2,
+		},
+		{
+			name: "count above maxCount",
+			spec: equinix.InstancePoolSpec{Count: 5, MaxCount: 4},
+			want: 4,
+		},
+		{
+			name: "autoscaler status ignored while disabled",
+			spec: equinix.InstancePoolSpec{Count: 3},
+			auto: &equinix.AutoscalerStatus{DesiredCount: 5},
+			want: 3,
+		},
+		{
+			name: "autoscaler without status",
+			spec: equinix.InstancePoolSpec{Count: 3, Autoscaling: autoscaling},
+			want: 3,
+		},
+		{
+			name: "autoscaler desired count",
+			spec: equinix.InstancePoolSpec{Count: 3, MaxCount: 8, Autoscaling: autoscaling},
+			auto: &equinix.AutoscalerStatus{DesiredCount: 5},
+			want: 5,
+		},
+		{
+			name: "autoscaler desired count bounded",
+			spec: equinix.InstancePoolSpec{Count: 3, MinCount: 3, MaxCount: 4, Autoscaling: autoscaling},
+			auto: &equinix.AutoscalerStatus{DesiredCount: 6},
+			want: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := &equinix.InstancePool{Spec: tt.spec}
+			ip.Status.Autoscaler = tt.auto
+			if got := desiredCount(ip); got != tt.want {
+				t.Errorf("desiredCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScaleDownCandidate(t *testing.T) {
+	const gib = int64(1) << 30
+
+	instances := func(names ...string) []equinix.Instance {
+		var result []equinix.Instance
+		for _, name := range names {
+			result = append(result, equinix.Instance{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		}
+		return result
+	}
+
+	// four nodes of 4 cpus, 16GiB of memory and 100GiB of storage
+	usage := func(modify func(nodes map[string]*nodeUsage)) *clusterUsage {
+		u := &clusterUsage{nodes: make(map[string]*nodeUsage)}
+		for _, name := range []string{"node-0", "node-1", "node-2", "node-3"} {
+			u.nodes[name] = &nodeUsage{
+				cpuRequested:      1000,
+				cpuAllocatable:    4000,
+				memoryRequested:   4 * gib,
+				memoryAllocatable: 16 * gib,
+				storage:           harvester.NodeStorage{Maximum: 100 * gib, Available: 80 * gib},
+			}
+		}
+		u.nodes["node-0"].controlPlane = true
+		if modify != nil {
+			modify(u.nodes)
+		}
+
+		for _, n := range u.nodes {
+			u.cpuRequested += n.cpuRequested
+			u.cpuAllocatable += n.cpuAllocatable
+			u.memoryRequested += n.memoryRequested
+			u.memoryAllocatable += n.memoryAllocatable
+			u.storageMaximum += n.storage.Maximum
+			u.storageAvailable += n.storage.Available
+		}
+		return u
+	}
+
+	tests := []struct {
+		name      string
+		instances []equinix.Instance
+		usage     *clusterUsage
+		want      string
+	}{
+		{
+			name:      "last instance",
+			instances: instances("node-0", "node-1", "node-2", "node-3"),
+			usage:     usage(nil),
+			want:      "node-3",
+		},
+		{
+			name:      "instance running vms is skipped",
+			instances: instances("node-0", "node-1", "node-2", "node-3"),
+			usage:     usage(func(nodes map[string]*nodeUsage) { nodes["node-3"].vms = 1 }),
+			want:      "node-2",
+		},
+		{
+			name:      "control plane is never removed",
+			instances: instances("node-1", "node-0"),
+			usage:     usage(func(nodes map[string]*nodeUsage) { nodes["node-1"].vms = 1 }),
+		},
+		{
+			name:      "unschedulable node is skipped",
+			instances: instances("node-0", "node-1", "node-2", "node-4"),
+			usage:     usage(nil),
+			want:      "node-2",
+		},
+		{
+			name:      "remaining cpu would reach the scale-up threshold",
+			instances: instances("node-0", "node-1", "node-2", "node-3"),
+			usage: usage(func(nodes map[string]*nodeUsage) {
+				for _, n := range nodes {
+					n.cpuRequested = 2500
+				}
+			}),
+		},
+		{
+			name:      "remaining storage would reach the storage threshold",
+			instances: instances("node-0", "node-1", "node-2", "node-3"),
+			usage: usage(func(nodes map[string]*nodeUsage) {
+				for _, n := range nodes {
+					n.storage.Available = 35 * gib
+				}
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scaleDownCandidate(tt.instances, tt.usage, DefaultScaleUpUtilization, DefaultStorageUtilization); got != tt.want {
+				t.Errorf("scaleDownCandidate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictable(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  corev1.Pod
+		want bool
+	}{
+		{
+			name: "deployment pod",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet"}}}},
+			want: true,
+		},
+		{
+			name: "daemonset pod",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet"}}}},
+		},
+		{
+			name: "static pod",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{mirrorPodAnnotation: "hash"}}},
+		},
+		{
+			name: "completed pod",
+			pod:  corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodSucceeded}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := evictable(&tt.pod); got != tt.want {
+				t.Errorf("evictable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
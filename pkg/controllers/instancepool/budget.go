@@ -0,0 +1,205 @@
+package instancepool
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
+	"github.com/harvester/harvester-equinix-addon/pkg/util"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DefaultBudgets = "equinix-addon-budgets"
+	// budgetRetryInterval is the interval blocked scale-ups are reevaluated at, as the budget of the
+	// project also depends on other pools
+	budgetRetryInterval = 10 * time.Minute
+	// statusBudgetBlocked is the status of a pool whose missing instances are not created, as they
+	// would exceed its budget or the budget of its project
+	statusBudgetBlocked = "budgetBlocked"
+)
+
+// checkBudget updates the estimated cost of the pool and reports whether it fits the budgets of the
+// pool and of its project, recording the result in the WithinBudget condition
+func (h *handler) checkBudget(ip *equinix.InstancePool) (bool, error) {
+	token, projectID, err := h.credentials()
+	if err != nil {
+		return false, err
+	}
+
+	if err := h.estimateCost(ip, h.newClient(token, projectID)); err != nil {
+		return false, err
+	}
+
+	projectBudget, err := h.projectBudget(projectID)
+	if err != nil {
+		return false, err
+	}
+
+	if ip.Spec.Budget == nil && projectBudget == nil {
+		if equinix.InstancePoolWithinBudget.GetStatus(ip) != "" {
+			equinix.InstancePoolWithinBudget.SetError(ip, "NoBudget", nil)
+		}
+		return true, nil
+	}
+
+	hourly, monthly := estimatedCost(ip)
+	if hourly == 0 {
+		equinix.InstancePoolWithinBudget.False(ip)
+		equinix.InstancePoolWithinBudget.Reason(ip, "PriceUnknown")
+		equinix.InstancePoolWithinBudget.Message(ip, fmt.Sprintf("no price known for plan %s, add it to configmap %s", ip.Status.EstimatedCost.Plan, DefaultPlanCatalogue))
+		return false, nil
+	}
+
+	if exceeded := budgetExceeded(ip.Spec.Budget, hourly, monthly); exceeded != "" {
+		equinix.InstancePoolWithinBudget.False(ip)
+		equinix.InstancePoolWithinBudget.Reason(ip, "PoolBudgetExceeded")
+		equinix.InstancePoolWithinBudget.Message(ip, fmt.Sprintf("%d instances of plan %s exceed the %s budget of the pool", desiredCount(ip), ip.Status.EstimatedCost.Plan, exceeded))
+		return false, nil
+	}
+
+	otherHourly, otherMonthly, err := h.projectCost(ip)
+	if err != nil {
+		return false, err
+	}
+
+	if exceeded := budgetExceeded(projectBudget, hourly+otherHourly, monthly+otherMonthly); exceeded != "" {
+		equinix.InstancePoolWithinBudget.False(ip)
+		equinix.InstancePoolWithinBudget.Reason(ip, "ProjectBudgetExceeded")
+		equinix.InstancePoolWithinBudget.Message(ip, fmt.Sprintf("%d instances of plan %s exceed the %s budget of project %s", desiredCount(ip), ip.Status.EstimatedCost.Plan, exceeded, projectID))
+		return false, nil
+	}
+
+	equinix.InstancePoolWithinBudget.SetError(ip, "WithinBudget", nil)
+	return true, nil
+}
+
+// withinBudget reports whether count instances would fit the budgets of the pool and its project,
+// and otherwise which budget they exceed. The estimate and conditions of the pool are left as is.
+func (h *handler) withinBudget(ip *equinix.InstancePool, count int) (bool, string, error) {
+	ipCopy := ip.DeepCopy()
+	ipCopy.Status.Autoscaler.DesiredCount = count
+	within, err := h.checkBudget(ipCopy)
+	if err != nil || within {
+		return within, "", err
+	}
+
+	return false, equinix.InstancePoolWithinBudget.GetMessage(ipCopy), nil
+}
+
+// estimateCost records the cost of the requested instances in the status of the pool. Spot instances
+// are estimated at their maximum bid.
+func (h *handler) estimateCost(ip *equinix.InstancePool, m *equinixClient.MetalClient) error {
+	template := instanceTemplate(ip)
+	count := desiredCount(ip)
+	spot := template.Spec.SpotInstance
+	profile, err := h.planProfile(m, template.Spec.Plan)
+	if err != nil {
+		return err
+	}
+
+	hourly, monthly := profile.HourlyPrice, profile.Monthly()
+	if spot {
+		if bid := template.Spec.SpotPriceMax.AsApproximateFloat64(); bid > 0 {
+			hourly, monthly = bid, bid*equinixClient.HoursPerMonth
+		}
+	}
+
+	// the price of the plan or the maximum bid may have changed since the last estimate
+	perInstance := formatCost(hourly)
+	estimate := ip.Status.EstimatedCost
+	if estimate != nil && estimate.Plan == template.Spec.Plan && estimate.Instances == count && estimate.Spot == spot &&
+		estimate.HourlyPerInstance == perInstance {
+		return nil
+	}
+
+	ip.Status.EstimatedCost = &equinix.CostEstimate{
+		Plan:              template.Spec.Plan,
+		Instances:         count,
+		HourlyPerInstance: perInstance,
+		Hourly:            formatCost(hourly * float64(count)),
+		Monthly:           formatCost(monthly * float64(count)),
+		Spot:              spot,
+	}
+
+	return nil
+}
+
+// projectBudget returns the budget of the project from the budgets ConfigMap, keyed by project id
+func (h *handler) projectBudget(projectID string) (*equinix.Budget, error) {
+	cm, err := h.configMap.Get(util.OperatorNamespace(), DefaultBudgets, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	data, ok := cm.Data[projectID]
+	if !ok {
+		return nil, nil
+	}
+
+	budget := &equinix.Budget{}
+	if err := yaml.UnmarshalStrict([]byte(data), budget); err != nil {
+		return nil, errors.Wrapf(err, "error parsing budget of project %s in configmap %s", projectID, DefaultBudgets)
+	}
+
+	return budget, nil
+}
+
+// projectCost sums the estimated cost of the other pools, which share the project of the operator credentials
+func (h *handler) projectCost(ip *equinix.InstancePool) (hourly float64, monthly float64, err error) {
+	pools, err := h.instancePool.Cache().List(labels.Everything())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, pool := range pools {
+		if pool.Name == ip.Name || pool.DeletionTimestamp != nil {
+			continue
+		}
+		poolHourly, poolMonthly := estimatedCost(pool)
+		hourly += poolHourly
+		monthly += poolMonthly
+	}
+
+	return hourly, monthly, nil
+}
+
+// budgetExceeded returns which limit of the budget the cost exceeds, if any
+func budgetExceeded(budget *equinix.Budget, hourly, monthly float64) string {
+	if budget == nil {
+		return ""
+	}
+
+	if budget.MaxHourlyCost != nil && hourly > budget.MaxHourlyCost.AsApproximateFloat64() {
+		return fmt.Sprintf("hourly (%s > %s)", formatCost(hourly), budget.MaxHourlyCost.String())
+	}
+
+	if budget.MaxMonthlyCost != nil && monthly > budget.MaxMonthlyCost.AsApproximateFloat64() {
+		return fmt.Sprintf("monthly (%s > %s)", formatCost(monthly), budget.MaxMonthlyCost.String())
+	}
+
+	return ""
+}
+
+func estimatedCost(ip *equinix.InstancePool) (hourly float64, monthly float64) {
+	if ip.Status.EstimatedCost == nil {
+		return 0, 0
+	}
+
+	hourly, _ = strconv.ParseFloat(ip.Status.EstimatedCost.Hourly, 64)
+	monthly, _ = strconv.ParseFloat(ip.Status.EstimatedCost.Monthly, 64)
+	return hourly, monthly
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 2, 64)
+}
@@ -0,0 +1,71 @@
+package instancepool
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+)
+
+func TestBudgetExceeded(t *testing.T) {
+	quantity := func(value string) *resource.Quantity {
+		q := resource.MustParse(value)
+		return &q
+	}
+
+	tests := []struct {
+		name    string
+		budget  *equinix.Budget
+		hourly  float64
+		monthly float64
+		want    string
+	}{
+		{
+			name:    "no budget",
+			hourly:  100,
+			monthly: 73000,
+		},
+		{
+			name:    "within both limits",
+			budget:  &equinix.Budget{MaxHourlyCost: quantity("10"), MaxMonthlyCost: quantity("7300")},
+			hourly:  9.5,
+			monthly: 6935,
+		},
+		{
+			name:    "at the limit",
+			budget:  &equinix.Budget{MaxHourlyCost: quantity("10")},
+			hourly:  10,
+			monthly: 7300,
+		},
+		{
+			name:    "hourly exceeded",
+			budget:  &equinix.Budget{MaxHourlyCost: quantity("10"), MaxMonthlyCost: quantity("10000")},
+			hourly:  10.5,
+			monthly: 7665,
+			want:    "hourly (10.50 > 10)",
+		},
+		{
+			name:    "monthly exceeded",
+			budget:  &equinix.Budget{MaxMonthlyCost: quantity("5k")},
+			hourly:  10,
+			monthly: 7300,
+			want:    "monthly (7300.00 > 5k)",
+		},
+		{
+			name:    "fractional limit",
+			budget:  &equinix.Budget{MaxHourlyCost: quantity("1500m")},
+			hourly:  2,
+			monthly: 1460,
+			want:    "hourly (2.00 > 1500m)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := budgetExceeded(tt.budget, tt.hourly, tt.monthly); got != tt.want {
+				t.Errorf("budgetExceeded() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package instancepool
+
+import (
+	"fmt"
+	"time"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// drainPollInterval is the interval the drain of a node removed by a scale-down is checked at
+	drainPollInterval = 15 * time.Second
+	// drainTimeout cancels a scale-down whose node can't be drained, for example because a pod
+	// disruption budget never allows the eviction of its pods
+	drainTimeout        = 30 * time.Minute
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+)
+
+// continueDrain drains the node of the instance chosen for a scale-down, and deletes the instance
+// once the node is drained. A drain which doesn't complete within drainTimeout is cancelled, and
+// the desired count restored.
+func (h *handler) continueDrain(key string, ip *equinix.InstancePool) error {
+	status := ip.Status.Autoscaler
+	name := status.Draining
+	h.instancePool.EnqueueAfter(key, drainPollInterval)
+
+	if status.LastScaleTime != nil && time.Since(status.LastScaleTime.Time) > drainTimeout {
+		logrus.Warnf("node %s was not drained within %s, cancelling the scale-down of instancePool %s", name, drainTimeout, ip.Name)
+		if err := h.cancelDrain(name); err != nil {
+			return err
+		}
+		status.Draining = ""
+		recordScaling(status, status.DesiredCount+1, fmt.Sprintf("ScaleDownCancelled: node %s was not drained within %s", name, drainTimeout))
+		return nil
+	}
+
+	drained, err := h.drainNode(name)
+	if err != nil || !drained {
+		return err
+	}
+
+	logrus.Infof("node %s is drained, removing instance %s of instancePool %s", name, name, ip.Name)
+	if err := h.instance.Delete(name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	status.Draining = ""
+	return nil
+}
+
+// drainNode cordons the node, evicts its pods through the eviction api so that their disruption
+// budgets are respected, and has Longhorn move the replicas on the node to the other nodes. It
+// reports whether the node is drained: only daemonset and static pods are left and it holds no
+// replicas.
+func (h *handler) drainNode(name string) (bool, error) {
+	node, err := h.node.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !node.Spec.Unschedulable {
+		nodeCopy := node.DeepCopy()
+		nodeCopy.Spec.Unschedulable = true
+		if _, err := h.node.Update(nodeCopy); err != nil {
+			return false, errors.Wrapf(err, "error cordoning node %s", name)
+		}
+		logrus.Infof("cordoned node %s", name)
+	}
+
+	pods, err := h.pod.Cache().List("", labels.Everything())
+	if err != nil {
+		return false, err
+	}
+
+	drained := true
+	for _, pod := range pods {
+		if pod.Spec.NodeName != name || !evictable(pod) {
+			continue
+		}
+
+		drained = false
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		err := h.evictions.Pods(pod.Namespace).Evict(h.ctx, &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+			},
+		})
+		switch {
+		case err == nil || apierrors.IsNotFound(err):
+		case apierrors.IsTooManyRequests(err):
+			// the disruption budget of the pod doesn't allow its eviction yet
+			logrus.Debugf("eviction of pod %s/%s from node %s is blocked: %v", pod.Namespace, pod.Name, name, err)
+		default:
+			return false, errors.Wrapf(err, "error evicting pod %s/%s from node %s", pod.Namespace, pod.Name, name)
+		}
+	}
+
+	if err := h.longhorn.SetEviction(h.ctx, name, true); err != nil {
+		return false, errors.Wrapf(err, "error evicting longhorn replicas from node %s", name)
+	}
+
+	replicas, err := h.longhorn.Replicas(h.ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	return drained && replicas == 0, nil
+}
+
+// cancelDrain makes the node schedulable again for pods and Longhorn replicas
+func (h *handler) cancelDrain(name string) error {
+	if err := h.longhorn.SetEviction(h.ctx, name, false); err != nil {
+		return errors.Wrapf(err, "error cancelling the eviction of longhorn replicas from node %s", name)
+	}
+
+	node, err := h.node.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if node.Spec.Unschedulable {
+		nodeCopy := node.DeepCopy()
+		nodeCopy.Spec.Unschedulable = false
+		if _, err := h.node.Update(nodeCopy); err != nil {
+			return errors.Wrapf(err, "error uncordoning node %s", name)
+		}
+		logrus.Infof("uncordoned node %s", name)
+	}
+
+	return nil
+}
+
+// evictable reports whether the pod has to be evicted to drain its node. Daemonset and static pods
+// stay on the node until it is removed.
+func evictable(pod *corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+
+	if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+		return false
+	}
+
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,155 @@
+package instancepool
+
+import (
+	"fmt"
+	"reflect"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// handleError records equinix metal api errors in the conditions of the pool. Auth failures pause
+// the pool, permanent errors are not retried until the pool changes, capacity errors are retried
+// after a long backoff, and all other errors are returned to be retried by the controller.
+func (h *handler) handleError(key string, ip *equinix.InstancePool, result *equinix.InstancePool, err error) (*equinix.InstancePool, error) {
+	if err == nil {
+		if result == nil || !equinix.InstancePoolReconciled.IsFalse(result) {
+			return result, nil
+		}
+		resultCopy := result.DeepCopy()
+		equinix.InstancePoolReconciled.SetError(resultCopy, "", nil)
+		return h.instancePool.UpdateStatus(resultCopy)
+	}
+
+	classified := equinixClient.ClassifyError(err)
+	if classified == nil || classified.Class == equinixClient.ErrorClassTransient {
+		return result, err
+	}
+
+	// the pool may have been updated before the error occurred
+	latest, getErr := h.instancePool.Get(ip.Name, metav1.GetOptions{})
+	if getErr != nil {
+		return result, err
+	}
+
+	latestCopy := latest.DeepCopy()
+	if classified.Class == equinixClient.ErrorClassAuth {
+		equinix.InstancePoolCredentialsValid.False(latestCopy)
+		equinix.InstancePoolCredentialsValid.Reason(latestCopy, string(classified.Class))
+		equinix.InstancePoolCredentialsValid.Message(latestCopy, classified.Error())
+	} else {
+		equinix.InstancePoolReconciled.False(latestCopy)
+		equinix.InstancePoolReconciled.Reason(latestCopy, string(classified.Class))
+		equinix.InstancePoolReconciled.Message(latestCopy, classified.Error())
+	}
+
+	if !reflect.DeepEqual(latest.Status, latestCopy.Status) {
+		latest, err = h.instancePool.UpdateStatus(latestCopy)
+		if err != nil {
+			return latest, err
+		}
+	}
+
+	switch classified.Class {
+	case equinixClient.ErrorClassAuth:
+		logrus.Errorf("equinix metal rejected the credentials of instancePool %s, pausing it: %v", ip.Name, classified)
+		h.instancePool.EnqueueAfter(key, equinixClient.AuthRetryInterval)
+	case equinixClient.ErrorClassCapacity:
+		logrus.Warnf("equinix metal capacity exhausted for instancePool %s, retrying in %s: %v", ip.Name, equinixClient.CapacityRetryInterval, classified)
+		h.instancePool.EnqueueAfter(key, equinixClient.CapacityRetryInterval)
+	default:
+		logrus.Errorf("not retrying instancePool %s: %v", ip.Name, classified)
+	}
+
+	return latest, nil
+}
+
+// pauseOnAuthFailure stops reconciling the pool while the equinix metal api rejects its
+// credentials, either in calls of the pool or of its instances. The credentials are revalidated
+// periodically, and the paused instances are resumed with the current credentials once they are
+// accepted again.
+func (h *handler) pauseOnAuthFailure(key string, ip *equinix.InstancePool) (*equinix.InstancePool, bool, error) {
+	failed, err := h.instancesWithAuthFailure(ip)
+	if err != nil {
+		return ip, false, err
+	}
+
+	if !equinix.InstancePoolCredentialsValid.IsFalse(ip) {
+		if len(failed) == 0 {
+			return ip, false, nil
+		}
+
+		ipCopy := ip.DeepCopy()
+		equinix.InstancePoolCredentialsValid.False(ipCopy)
+		equinix.InstancePoolCredentialsValid.Reason(ipCopy, string(equinixClient.ErrorClassAuth))
+		equinix.InstancePoolCredentialsValid.Message(ipCopy, fmt.Sprintf("credentials of instance %s were rejected", failed[0].Name))
+		logrus.Errorf("equinix metal rejected the credentials of instance %s, pausing instancePool %s", failed[0].Name, ip.Name)
+		h.instancePool.EnqueueAfter(key, equinixClient.AuthRetryInterval)
+		ip, err = h.instancePool.UpdateStatus(ipCopy)
+		return ip, true, err
+	}
+
+	token, projectID, err := h.credentials()
+	if err != nil {
+		return ip, true, err
+	}
+
+	if err := h.newClient(token, projectID).ValidateCredentials(); err != nil {
+		if classified := equinixClient.ClassifyError(err); classified != nil && classified.Class == equinixClient.ErrorClassAuth {
+			h.instancePool.EnqueueAfter(key, equinixClient.AuthRetryInterval)
+			return ip, true, nil
+		}
+		return ip, true, err
+	}
+
+	for _, i := range failed {
+		if err := h.resumeInstance(i, token); err != nil {
+			return ip, true, err
+		}
+	}
+
+	logrus.Infof("credentials of instancePool %s are valid again, resuming it", ip.Name)
+	ipCopy := ip.DeepCopy()
+	equinix.InstancePoolCredentialsValid.SetError(ipCopy, "", nil)
+	ip, err = h.instancePool.UpdateStatus(ipCopy)
+	return ip, false, err
+}
+
+// instancesWithAuthFailure returns the instances of the pool which stopped after their credentials were rejected
+func (h *handler) instancesWithAuthFailure(ip *equinix.InstancePool) ([]*equinix.Instance, error) {
+	instances, err := h.instance.Cache().List(labels.SelectorFromSet(labels.Set{"instancePool": ip.Name}))
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []*equinix.Instance
+	for _, i := range instances {
+		if equinix.InstanceReconciled.IsFalse(i) && equinix.InstanceReconciled.GetReason(i) == string(equinixClient.ErrorClassAuth) {
+			failed = append(failed, i)
+		}
+	}
+
+	return failed, nil
+}
+
+// resumeInstance updates the credentials of an instance stopped by an auth failure and clears the failure
+func (h *handler) resumeInstance(i *equinix.Instance, token string) error {
+	iCopy := i.DeepCopy()
+	if iCopy.Annotations["token"] != token {
+		iCopy.Annotations["token"] = token
+		updated, err := h.instance.Update(iCopy)
+		if err != nil {
+			return err
+		}
+		iCopy = updated.DeepCopy()
+	}
+
+	equinix.InstanceReconciled.Unknown(iCopy)
+	equinix.InstanceReconciled.Reason(iCopy, "CredentialsRevalidated")
+	equinix.InstanceReconciled.Message(iCopy, "")
+	_, err := h.instance.UpdateStatus(iCopy)
+	return err
+}
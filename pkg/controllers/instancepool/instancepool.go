@@ -4,30 +4,54 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/artifact"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
 	controller "github.com/harvester/harvester-equinix-addon/pkg/generated/controllers/equinix.harvesterhci.io/v1"
 	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
 	"github.com/harvester/harvester-equinix-addon/pkg/util"
+	"github.com/harvester/harvester-equinix-addon/pkg/webhook"
+	"github.com/imdario/mergo"
 	"github.com/pkg/errors"
 	corecontrollers "github.com/rancher/wrangler/pkg/generated/controllers/core/v1"
 	"github.com/rancher/wrangler/pkg/relatedresource"
 	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 const (
-	DefaultCredentialSecret = "equinix-addon"
-	DefaultNamespace        = "harvester-system"
-	DefaultISOURL           = "https://releases.rancher.com/harvester/master/harvester-master-amd64.iso"
-	DefaultIPXEScriptURL    = "https://raw.githubusercontent.com/ibrokethecloud/custom_pxe/master/master.ipxe"
-	InitialIPXEScriptURL    = "https://raw.githubusercontent.com/ibrokethecloud/custom_pxe/master/shell.ipxe"
-	DefaultInterface        = "eth0"
-	DefaultIngressService   = "ingress-expose"
+	DefaultCredentialSecret   = "equinix-addon"
+	DefaultNamespace          = util.DefaultNamespace
+	DefaultISOURL             = "https://releases.rancher.com/harvester/master/harvester-master-amd64.iso"
+	DefaultIPXEScriptURL      = "https://raw.githubusercontent.com/ibrokethecloud/custom_pxe/master/master.ipxe"
+	InitialIPXEScriptURL      = "https://raw.githubusercontent.com/ibrokethecloud/custom_pxe/master/shell.ipxe"
+	DefaultInterface          = equinixClient.DefaultManagementNIC
+	DefaultIngressService     = "ingress-expose"
+	DefaultHarvesterConfigKey = "config.yaml"
+	DefaultPlanCatalogue      = "equinix-addon-plans"
+	DefaultVersionCatalogue   = "equinix-addon-versions"
+	DefaultNodeSettings       = "equinix-addon-node-settings"
+	DefaultPasswordLength     = 24
+	DefaultWebhookTokenLength = 32
+	DefaultUsername           = "rancher"
+	// legacyPasswordAnnotation held the plaintext os password of instances before it was kept in a secret
+	legacyPasswordAnnotation = "password"
+	// legacyWebhookTokenAnnotation held the install webhook token of instances before it was kept in a secret
+	legacyWebhookTokenAnnotation = "install-webhook-token"
+	// artifactPollInterval is the interval pools are requeued at while their artifacts are downloaded
+	artifactPollInterval = 30 * time.Second
 )
 
 var instanceLock sync.Mutex
@@ -37,23 +61,42 @@ type handler struct {
 	instancePool controller.InstancePoolController
 	instance     controller.InstanceController
 	secret       corecontrollers.SecretController
+	configMap    corecontrollers.ConfigMapController
 	node         corecontrollers.NodeController
 	service      corecontrollers.ServiceController
+	setting      *harvester.SettingClient
+	artifacts    *artifact.Cache
+	pod          corecontrollers.PodController
+	longhorn     *harvester.LonghornNodeClient
+	evictions    corev1client.PodsGetter
+	newClient    func(token, projectID string) *equinixClient.MetalClient
 }
 
 func Register(ctx context.Context, instancePool controller.InstancePoolController,
 	instance controller.InstanceController, secret corecontrollers.SecretController,
-	node corecontrollers.NodeController, service corecontrollers.ServiceController) {
+	configMap corecontrollers.ConfigMapController, node corecontrollers.NodeController, service corecontrollers.ServiceController,
+	setting *harvester.SettingClient, artifacts *artifact.Cache, pod corecontrollers.PodController,
+	longhorn *harvester.LonghornNodeClient, evictions corev1client.PodsGetter) {
 	ipHandler := &handler{
 		ctx:          ctx,
 		instancePool: instancePool,
 		instance:     instance,
 		secret:       secret,
+		configMap:    configMap,
 		node:         node,
 		service:      service,
+		setting:      setting,
+		artifacts:    artifacts,
+		pod:          pod,
+		longhorn:     longhorn,
+		evictions:    evictions,
+		newClient:    equinixClient.NewClient,
 	}
+	// the pod cache is only read by the autoscaler, and has to be registered before the caches are started
+	pod.Cache()
 	relatedresource.WatchClusterScoped(ctx, "instancePool-instance-change", ipHandler.ReconcileNodePool, instancePool, instance)
 	instancePool.OnChange(ctx, "instancePool-change", ipHandler.wrapper)
+	instancePool.OnRemove(ctx, "instancePool-remove", ipHandler.OnInstancePoolRemove)
 }
 
 func (h *handler) wrapper(key string, ip *equinix.InstancePool) (*equinix.InstancePool, error) {
@@ -61,12 +104,22 @@ func (h *handler) wrapper(key string, ip *equinix.InstancePool) (*equinix.Instan
 		return ip, nil
 	}
 
+	ip, paused, err := h.pauseOnAuthFailure(key, ip)
+	if err != nil || paused {
+		return ip, err
+	}
+
+	result, err := h.reconcile(key, ip)
+	return h.handleError(key, ip, result, err)
+}
+
+func (h *handler) reconcile(key string, ip *equinix.InstancePool) (*equinix.InstancePool, error) {
 	switch ip.Status.Status {
 	case "":
 		return h.prepareInstancePool(key, ip)
 	case "tokenReady":
 		return h.submitInstances(key, ip)
-	case "submitted", "ready":
+	case "submitted", "ready", statusBudgetBlocked:
 		return h.reconcileInstances(key, ip)
 	case "cleanupNodes":
 		return h.removeInstances(key, ip)
@@ -77,7 +130,7 @@ func (h *handler) wrapper(key string, ip *equinix.InstancePool) (*equinix.Instan
 
 func (h *handler) ReconcileNodePool(_ string, _ string, obj runtime.Object) ([]relatedresource.Key, error) {
 	if instance, ok := obj.(*equinix.Instance); ok {
-		if instance.Status.Status == "managed" || instance.DeletionTimestamp != nil {
+		if instance.Status.Status == "managed" || instance.DeletionTimestamp != nil || equinix.InstanceReconciled.IsFalse(instance) {
 			instancePoolName := instance.Labels["instancePool"]
 			logrus.Infof("instance %s got updated. Reconcilling instancePool %s", instance.Name, instancePoolName)
 			return []relatedresource.Key{
@@ -118,9 +171,20 @@ func (h *handler) prepareInstancePool(key string, ip *equinix.InstancePool) (*eq
 
 		ip.Status.Token = token.(string)
 	}
-	ip.Status.Needed = ip.Spec.Count
+	ip.Status.Needed = desiredCount(ip)
 	ip.Status.Status = "tokenReady"
-	ip.Status.Requested = ip.Spec.Count
+	ip.Status.Requested = desiredCount(ip)
+
+	withinBudget, err := h.checkBudget(ip)
+	if err != nil {
+		return ip, err
+	}
+
+	if !withinBudget {
+		// reconcileInstances submits the instances once they fit the budget
+		ip.Status.Status = statusBudgetBlocked
+		h.instancePool.EnqueueAfter(key, budgetRetryInterval)
+	}
 
 	return h.instancePool.UpdateStatus(ip)
 }
@@ -128,29 +192,31 @@ func (h *handler) prepareInstancePool(key string, ip *equinix.InstancePool) (*eq
 // submitInstances will create instance objects
 func (h *handler) submitInstances(key string, ip *equinix.InstancePool) (*equinix.InstancePool, error) {
 	instanceLock.Lock()
+	defer instanceLock.Unlock()
 	logrus.Infof("submitting instances for instancePool %s", key)
-	credSecret := os.Getenv("EQUINIX_SECRET")
-	if credSecret == "" {
-		credSecret = DefaultCredentialSecret
-	}
-	namespace := os.Getenv("NAMESPACE")
-	if namespace == "" {
-		namespace = DefaultNamespace
+	err := validateIPAddresses(ip)
+	if err != nil {
+		return ip, err
 	}
 
-	secret, err := h.secret.Get(namespace, credSecret, metav1.GetOptions{})
+	ip, err = h.resolveRelease(ip)
 	if err != nil {
 		return ip, err
 	}
 
-	token, ok := secret.Data["METAL_AUTH_TOKEN"]
-	if !ok {
-		return ip, fmt.Errorf("operator secret doesnt contain a key METAL_AUTH_TOKEN")
+	ip, verified, err := h.verifyArtifacts(key, ip)
+	if err != nil || !verified {
+		return ip, err
 	}
 
-	projectID, ok := secret.Data["PROJECT_ID"]
-	if !ok {
-		return ip, fmt.Errorf("operator secret doesnt contain a key PROJECT_ID")
+	ip, mirrored, err := h.mirrorArtifacts(key, ip)
+	if err != nil || !mirrored {
+		return ip, err
+	}
+
+	token, projectID, err := h.credentials()
+	if err != nil {
+		return ip, err
 	}
 
 	nodes, err := h.node.List(metav1.ListOptions{
@@ -169,6 +235,75 @@ func (h *handler) submitInstances(key string, ip *equinix.InstancePool) (*equini
 		return ip, err
 	}
 
+	m := h.newClient(token, projectID)
+	if ip.Spec.BGP != nil {
+		err = m.EnsureProjectBGPConfig(ip.Spec.BGP)
+		if err != nil {
+			return ip, err
+		}
+	}
+
+	if ip.Spec.NetworkingConfiguration.MetalGateway != nil {
+		ip, err = h.ensureMetalGateway(ip, m)
+		if err != nil {
+			return ip, err
+		}
+	}
+
+	override, err := h.harvesterConfigOverride(ip)
+	if err != nil {
+		return ip, err
+	}
+
+	template := instanceTemplate(ip)
+	sshKeys, err := h.sshAuthorizedKeys(ip, &template.Spec, m)
+	if err != nil {
+		return ip, err
+	}
+
+	// nodes without a password can only be reached with ssh keys
+	if ip.Spec.DisablePasswordLogin && len(sshKeys) == 0 && (override == nil || len(override.SSHAuthorizedKeys) == 0) {
+		return ip, fmt.Errorf("instancePool %s disables password login but has no ssh keys", ip.Name)
+	}
+
+	profile, err := h.planProfile(m, template.Spec.Plan)
+	if err != nil {
+		return ip, err
+	}
+
+	installScriptURL, err := h.installScript(ip, profile)
+	if err != nil {
+		return ip, err
+	}
+
+	settings, err := h.nodeSettings()
+	if err != nil {
+		return ip, err
+	}
+
+	config := cloudInitConfig{
+		joinAddress:       joinAddress,
+		sshAuthorizedKeys: sshKeys,
+		profile:           profile,
+		settings:          settings,
+		override:          override,
+		webhookURL:        webhook.URL(),
+	}
+
+	staticIPPool := effectiveStaticIPPool(ip)
+	usedAddresses, err := h.allocatedAddresses(ip)
+	if err != nil {
+		return ip, err
+	}
+
+	var reservedAddresses []string
+	if ip.Spec.ReservedIPBlock != nil {
+		ip, reservedAddresses, err = h.availableReservedAddresses(ip, m)
+		if err != nil {
+			return ip, err
+		}
+	}
+
 	// lookup token and project id from secret
 	// set up as annotation
 
@@ -178,34 +313,27 @@ func (h *handler) submitInstances(key string, ip *equinix.InstancePool) (*equini
 			ObjectMeta: metav1.ObjectMeta{
 				Name: fmt.Sprintf("%s-%s", ip.Name, suffix),
 			},
-			Spec: equinix.InstanceSpec{
-				OS:             "custom_ipxe",
-				Plan:           ip.Spec.Plan,
-				BillingCycle:   ip.Spec.BillingCycle,
-				Metro:          ip.Spec.Metro,
-				Facility:       ip.Spec.Facility,
-				SpotInstance:   ip.Spec.SpotInstance,
-				SpotPriceMax:   ip.Spec.SpotPriceMax,
-				UserSSHKeys:    ip.Spec.UserSSHKeys,
-				ProjectSSHKeys: ip.Spec.ProjectSSHKeys,
-				ProjectID:      string(projectID),
-			},
+			Spec: *template.Spec.DeepCopy(),
 		}
+		i.Spec.OS = "custom_ipxe"
+		i.Spec.ProjectID = projectID
 
-		i.Spec.IPXEScriptURL = InitialIPXEScriptURL
-
-		if ip.Spec.ManagementBondingOptions != nil {
-			i.Spec.ManagementBondingOptions = ip.Spec.ManagementBondingOptions
+		if ip.Spec.ReservedIPBlock != nil {
+			if len(reservedAddresses) == 0 {
+				return ip, fmt.Errorf("no free addresses left in reserved ip block %s of instancePool %s", ip.Status.ReservedIPBlockID, ip.Name)
+			}
+			i.Spec.ReservedIPAddress = reservedAddresses[0]
+			reservedAddresses = reservedAddresses[1:]
 		}
 
-		if ip.Spec.NodeCleanupWaitInterval != nil {
-			i.Spec.NodeCleanupWaitInterval = ip.Spec.NodeCleanupWaitInterval
+		i.Spec.IPXEScriptURL = mirroredURL(ip, InitialIPXEScriptURL)
+
+		if ip.Spec.DataDisks != nil {
+			i.Spec.DataDisks = dataDiskConfiguration(ip.Spec.DataDisks, profile)
 		}
 
-		if len(ip.Spec.ManagementInterfaces) != 0 {
-			i.Spec.ManagementInterfaces = ip.Spec.ManagementInterfaces
-		} else {
-			i.Spec.ManagementInterfaces = []string{DefaultInterface}
+		if len(i.Spec.ManagementInterfaces) == 0 {
+			i.Spec.ManagementInterfaces = append([]string{}, profile.Interfaces...)
 		}
 		i.SetOwnerReferences([]metav1.OwnerReference{
 			{
@@ -216,35 +344,70 @@ func (h *handler) submitInstances(key string, ip *equinix.InstancePool) (*equini
 			},
 		})
 		labels := make(map[string]string)
+		for k, v := range template.Metadata.Labels {
+			labels[k] = v
+		}
 		labels["instancePool"] = ip.Name
 		i.SetLabels(labels)
 		annotations := make(map[string]string)
-		annotations["token"] = string(token)
-		annotations["password"] = util.RandStringRunes(16)
+		for k, v := range template.Metadata.Annotations {
+			annotations[k] = v
+		}
+		annotations["token"] = token
 
-		if ip.Spec.IPXEScriptURL != "" {
-			annotations["reconfig_ipxe_url"] = ip.Spec.IPXEScriptURL
-		} else {
-			annotations["reconfig_ipxe_url"] = DefaultIPXEScriptURL
+		var password, passwordHash string
+		if !ip.Spec.DisablePasswordLogin {
+			password, err = util.GeneratePassword(DefaultPasswordLength)
+			if err != nil {
+				return ip, errors.Wrap(err, "error generating password")
+			}
+			passwordHash, err = util.HashPassword(password)
+			if err != nil {
+				return ip, errors.Wrap(err, "error hashing password")
+			}
 		}
 
-		if !ip.Spec.NetworkingConfiguration.IsEmpty() {
-			if ip.Spec.NetworkingConfiguration.IsValidType() {
-				i.Spec.NetworkingConfiguration = ip.Spec.NetworkingConfiguration
-			} else {
-				return ip, fmt.Errorf("invalid network configuration type %s in instancePool %s", ip.Spec.NetworkingConfiguration.Type, ip.Name)
+		annotations["reconfig_ipxe_url"] = installScriptURL
+
+		var webhookToken string
+		if config.webhookURL != "" {
+			webhookToken, err = util.GeneratePassword(DefaultWebhookTokenLength)
+			if err != nil {
+				return ip, errors.Wrap(err, "error generating install webhook token")
 			}
+		}
 
+		if !ip.Spec.NetworkingConfiguration.IsEmpty() && !ip.Spec.NetworkingConfiguration.IsValidType() {
+			return ip, fmt.Errorf("invalid network configuration type %s in instancePool %s", ip.Spec.NetworkingConfiguration.Type, ip.Name)
+		}
+
+		if staticIPPool != nil {
+			i.Spec.ManagementAddress, err = allocateManagementAddress(staticIPPool, usedAddresses)
+			if err != nil {
+				return ip, errors.Wrapf(err, "unable to allocate management address in instancePool %s", ip.Name)
+			}
 		}
+
 		i.SetAnnotations(annotations)
 		// generateCloudInit //
-		userData, err := generateCloudInit(ip, i, joinAddress)
+		config.passwordHash = passwordHash
+		config.webhookToken = webhookToken
+		userData, err := generateCloudInit(ip, i, config)
 		if err != nil {
 			return ip, err
 		}
 		i.Spec.UserData = userData
-		_, err = h.instance.Create(i)
+		created, err := h.instance.Create(i)
+		if err != nil {
+			return ip, err
+		}
+
+		err = h.createInstanceSecrets(created, password, webhookToken)
 		if err != nil {
+			// without the secrets the password of the node would be lost and its install webhooks rejected
+			if deleteErr := h.instance.Delete(created.Name, &metav1.DeleteOptions{}); deleteErr != nil {
+				return ip, errors.Wrapf(deleteErr, "error removing instance %s after failing to store its secrets: %v", created.Name, err)
+			}
 			return ip, err
 		}
 	}
@@ -252,7 +415,6 @@ func (h *handler) submitInstances(key string, ip *equinix.InstancePool) (*equini
 	ip.Status.Status = "submitted"
 	ip.Status.Needed = 0
 	_, err = h.instancePool.UpdateStatus(ip)
-	instanceLock.Unlock()
 	if err != nil {
 		return ip, err
 	}
@@ -261,7 +423,7 @@ func (h *handler) submitInstances(key string, ip *equinix.InstancePool) (*equini
 }
 
 // identify instances will reconcile instance states
-func (h *handler) reconcileInstances(_ string, ip *equinix.InstancePool) (*equinix.InstancePool, error) {
+func (h *handler) reconcileInstances(key string, ip *equinix.InstancePool) (*equinix.InstancePool, error) {
 
 	logrus.Infof("ready to fetch instances to reoncile instancePool state %s", ip.Name)
 	instanceList, err := h.instance.List(metav1.ListOptions{
@@ -272,9 +434,29 @@ func (h *handler) reconcileInstances(_ string, ip *equinix.InstancePool) (*equin
 		return ip, err
 	}
 
+	err = h.syncNetworkingConfiguration(ip, instanceList.Items)
+	if err != nil {
+		return ip, err
+	}
+
+	err = h.migrateSecrets(instanceList.Items)
+	if err != nil {
+		return ip, err
+	}
+
+	err = h.autoscale(key, ip, instanceList.Items)
+	if err != nil {
+		return ip, err
+	}
+
+	count := desiredCount(ip)
 	readyCount := 0
 	presentCount := 0
 	for _, instance := range instanceList.Items {
+		// instances being removed, such as the one drained for a scale-down, are no longer part of the pool
+		if instance.DeletionTimestamp != nil || instance.Name == draining(ip) {
+			continue
+		}
 		if instance.Status.Status == "managed" {
 			readyCount++
 		}
@@ -282,19 +464,29 @@ func (h *handler) reconcileInstances(_ string, ip *equinix.InstancePool) (*equin
 	}
 
 	modified := false
-	if ip.Status.Requested == readyCount && ip.Status.Requested == ip.Spec.Count {
+	if ip.Status.Requested == readyCount && ip.Status.Requested == count {
 		ip.Status.Status = "ready"
 		ip.Status.Needed = 0
 		modified = true
 	} else {
-		ip.Status.Requested = ip.Spec.Count
-		ip.Status.Needed = ip.Spec.Count - presentCount
+		ip.Status.Requested = count
+		ip.Status.Needed = count - presentCount
 		if ip.Status.Needed < 0 {
 			ip.Status.Status = "cleanupNodes"
 		}
 
+		withinBudget, err := h.checkBudget(ip)
+		if err != nil {
+			return ip, err
+		}
+
 		if ip.Status.Needed > 0 {
-			ip.Status.Status = "tokenReady"
+			if withinBudget {
+				ip.Status.Status = "tokenReady"
+			} else {
+				ip.Status.Status = statusBudgetBlocked
+				h.instancePool.EnqueueAfter(key, budgetRetryInterval)
+			}
 		}
 		modified = true
 	}
@@ -308,35 +500,1010 @@ func (h *handler) reconcileInstances(_ string, ip *equinix.InstancePool) (*equin
 
 }
 
-func generateCloudInit(ip *equinix.InstancePool, i *equinix.Instance, joinAddress string) (string, error) {
+// syncNetworkingConfiguration propagates changes to the networkingConfiguration of the pool to
+// existing instances. The instance controller converges the device ports with the new configuration
+func (h *handler) syncNetworkingConfiguration(ip *equinix.InstancePool, instances []equinix.Instance) error {
+	if !ip.Spec.NetworkingConfiguration.IsEmpty() && !ip.Spec.NetworkingConfiguration.IsValidType() {
+		return fmt.Errorf("invalid network configuration type %s in instancePool %s", ip.Spec.NetworkingConfiguration.Type, ip.Name)
+	}
 
-	hc := harvester.HarvesterConfig{
-		ServerURL: fmt.Sprintf("https://%s:8443", joinAddress),
-		Token:     ip.Status.Token,
-		OS: harvester.OS{
-			Hostname: i.Name,
-			Password: i.Annotations["password"],
-		},
-		Install: harvester.Install{
-			Automatic: true,
-			Mode:      "join",
-			TTY:       "ttyS1,115200n8",
-			Device:    "/dev/sda",
-		},
+	for _, instance := range instances {
+		if instance.DeletionTimestamp != nil || reflect.DeepEqual(instance.Spec.NetworkingConfiguration, ip.Spec.NetworkingConfiguration) {
+			continue
+		}
+
+		logrus.Infof("updating networking configuration of instance %s from instancePool %s", instance.Name, ip.Name)
+		iCopy := instance.DeepCopy()
+		iCopy.Spec.NetworkingConfiguration = *ip.Spec.NetworkingConfiguration.DeepCopy()
+		if _, err := h.instance.Update(iCopy); err != nil {
+			return err
+		}
 	}
 
-	// set ISO URL //
-	if ip.Spec.ISOURL != "" {
-		hc.Install.ISOURL = ip.Spec.ISOURL
-	} else {
-		hc.Install.ISOURL = DefaultISOURL
+	return nil
+}
+
+// validateIPAddresses checks the address families requested for the pool. Harvester only supports
+// IPv4 management networks, so layer3 and hybrid pools need an IPv4 address for DHCP to hand out,
+// while IPv6 addresses are recorded on the instance for dual-stack workloads. Layer2 pools take their
+// management address from the static IP pool instead, so they may request IPv6 addresses only.
+func validateIPAddresses(ip *equinix.InstancePool) error {
+	if len(ip.Spec.IPAddresses) == 0 {
+		return nil
+	}
+
+	hasIPv4 := false
+	for _, address := range ip.Spec.IPAddresses {
+		switch address.AddressFamily {
+		case 4:
+			hasIPv4 = true
+		case 6:
+		default:
+			return fmt.Errorf("invalid address family %d in instancePool %s", address.AddressFamily, ip.Name)
+		}
+	}
+
+	if hasIPv4 {
+		return nil
+	}
+
+	if strings.HasPrefix(ip.Spec.NetworkingConfiguration.Type, "layer2") {
+		logrus.Debugf("instancePool %s requests no IPv4 address, layer2 nodes use the static IP pool for management", ip.Name)
+		return nil
+	}
+
+	return fmt.Errorf("instancePool %s needs an IPv4 address for the harvester management network", ip.Name)
+}
+
+// credentials returns the Equinix Metal token and project from the operator secret
+func (h *handler) credentials() (token string, projectID string, err error) {
+	credSecret := os.Getenv("EQUINIX_SECRET")
+	if credSecret == "" {
+		credSecret = DefaultCredentialSecret
+	}
+	secret, err := h.secret.Get(util.OperatorNamespace(), credSecret, metav1.GetOptions{})
+	if err != nil {
+		return token, projectID, err
+	}
+
+	tokenBytes, ok := secret.Data["METAL_AUTH_TOKEN"]
+	if !ok {
+		return token, projectID, fmt.Errorf("operator secret doesnt contain a key METAL_AUTH_TOKEN")
+	}
+
+	projectIDBytes, ok := secret.Data["PROJECT_ID"]
+	if !ok {
+		return token, projectID, fmt.Errorf("operator secret doesnt contain a key PROJECT_ID")
+	}
+
+	return string(tokenBytes), string(projectIDBytes), nil
+}
+
+// availableReservedAddresses returns the addresses of the reserved ip block which are neither assigned
+// to a device nor allocated to an instance of the pool. A block is requested if the pool does not
+// reference an existing one.
+func (h *handler) availableReservedAddresses(ip *equinix.InstancePool, m *equinixClient.MetalClient) (*equinix.InstancePool, []string, error) {
+	var err error
+	if ip.Spec.ReservedIPBlock.ID != "" {
+		ip.Status.ReservedIPBlockID = ip.Spec.ReservedIPBlock.ID
+	}
+
+	if ip.Status.ReservedIPBlockID == "" {
+		blockID, err := m.RequestIPBlock(ip)
+		if err != nil {
+			return ip, nil, err
+		}
+
+		logrus.Infof("reserved ip block %s for instancePool %s", blockID, ip.Name)
+		ip.Status.ReservedIPBlockID = blockID
+		ip, err = h.instancePool.UpdateStatus(ip)
+		if err != nil {
+			return ip, nil, err
+		}
+	}
+
+	available, err := m.AvailableAddresses(ip.Status.ReservedIPBlockID, ip.Spec.ReservedIPBlock.AssignmentCIDR)
+	if err != nil {
+		return ip, nil, err
+	}
+
+	instanceList, err := h.instance.List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("instancePool=%s", ip.Name),
+	})
+	if err != nil {
+		return ip, nil, err
+	}
+
+	allocated := make(map[string]bool)
+	for _, instance := range instanceList.Items {
+		allocated[instance.Spec.ReservedIPAddress] = true
+	}
+
+	var free []string
+	for _, address := range available {
+		if !allocated[address] {
+			free = append(free, address)
+		}
+	}
+
+	return ip, free, nil
+}
+
+// OnInstancePoolRemove releases the Metal Gateway and reserved ip block requested for the pool. The instances of the pool
+// are removed first, as Metal refuses to remove a block with assigned addresses.
+func (h *handler) OnInstancePoolRemove(key string, ip *equinix.InstancePool) (*equinix.InstancePool, error) {
+	if ip == nil {
+		return ip, nil
+	}
+
+	if ip.Status.MetalGateway != nil {
+		token, projectID, err := h.credentials()
+		if err != nil {
+			return ip, err
+		}
+
+		if err := h.releaseMetalGateway(ip, h.newClient(token, projectID)); err != nil {
+			return ip, err
+		}
+	}
+
+	if ip.Status.ReservedIPBlockID == "" ||
+		(ip.Spec.ReservedIPBlock != nil && ip.Spec.ReservedIPBlock.ID == ip.Status.ReservedIPBlockID) {
+		return ip, nil
+	}
+
+	instanceList, err := h.instance.List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("instancePool=%s", ip.Name),
+	})
+	if err != nil {
+		return ip, err
+	}
+
+	if len(instanceList.Items) != 0 {
+		for _, instance := range instanceList.Items {
+			if instance.DeletionTimestamp != nil {
+				continue
+			}
+			if err := h.instance.Delete(instance.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return ip, err
+			}
+		}
+		return ip, fmt.Errorf("waiting for %d instances of instancePool %s to be removed", len(instanceList.Items), key)
+	}
+
+	token, projectID, err := h.credentials()
+	if err != nil {
+		return ip, err
+	}
+
+	logrus.Infof("releasing ip block %s of instancePool %s", ip.Status.ReservedIPBlockID, ip.Name)
+	return ip, h.newClient(token, projectID).ReleaseIPBlock(ip.Status.ReservedIPBlockID)
+}
+
+// allocatedAddresses returns the management addresses already in use by instances of the pool
+func (h *handler) allocatedAddresses(ip *equinix.InstancePool) (map[string]bool, error) {
+	used := make(map[string]bool)
+	if effectiveStaticIPPool(ip) == nil {
+		return used, nil
+	}
+
+	instanceList, err := h.instance.List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("instancePool=%s", ip.Name),
+	})
+	if err != nil {
+		return used, err
+	}
+
+	for _, instance := range instanceList.Items {
+		if instance.Spec.ManagementAddress != nil {
+			used[instance.Spec.ManagementAddress.IP] = true
+		}
+	}
+
+	return used, nil
+}
+
+// ensureMetalGateway records the Metal Gateway routing the VLAN of the pool. A gateway found on the VLAN
+// is considered managed by the operator if another pool already manages it.
+func (h *handler) ensureMetalGateway(ip *equinix.InstancePool, m *equinixClient.MetalClient) (*equinix.InstancePool, error) {
+	gateway, err := m.EnsureMetalGateway(ip)
+	if gateway == nil {
+		return ip, err
+	}
+
+	if !gateway.Managed && ip.Spec.NetworkingConfiguration.MetalGateway.ID == "" {
+		pools, err := h.poolsUsingGateway(ip, gateway.ID)
+		if err != nil {
+			return ip, err
+		}
+		for _, pool := range pools {
+			if pool.Status.MetalGateway.Managed {
+				gateway.Managed = true
+				gateway.VRFReservationID = pool.Status.MetalGateway.VRFReservationID
+			}
+		}
+	}
+
+	// the gateway is recorded even if its details are not available yet, so it is removed along with the pool
+	if !reflect.DeepEqual(ip.Status.MetalGateway, gateway) {
+		logrus.Infof("instancePool %s uses metal gateway %s for network %s", ip.Name, gateway.ID, gateway.Network)
+		ip.Status.MetalGateway = gateway
+		updated, updateErr := h.instancePool.UpdateStatus(ip)
+		if updateErr != nil {
+			return ip, updateErr
+		}
+		ip = updated
+	}
+
+	if err != nil {
+		return ip, err
+	}
+
+	if gateway.Network == "" {
+		return ip, fmt.Errorf("waiting for the ip reservation of metal gateway %s", gateway.ID)
+	}
+
+	return ip, nil
+}
+
+// releaseMetalGateway removes the Metal Gateway managed by the operator once no other pool uses it
+func (h *handler) releaseMetalGateway(ip *equinix.InstancePool, m *equinixClient.MetalClient) error {
+	gateway := ip.Status.MetalGateway
+	if gateway == nil || !gateway.Managed {
+		return nil
 	}
-	config, err := yaml.Marshal(hc)
+
+	pools, err := h.poolsUsingGateway(ip, gateway.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(pools) != 0 {
+		logrus.Infof("metal gateway %s is still used by instancePool %s", gateway.ID, pools[0].Name)
+		return nil
+	}
+
+	logrus.Infof("removing metal gateway %s of instancePool %s", gateway.ID, ip.Name)
+	return m.DeleteMetalGateway(gateway)
+}
+
+// poolsUsingGateway returns the pools other than ip which are not being deleted and use the gateway
+func (h *handler) poolsUsingGateway(ip *equinix.InstancePool, gatewayID string) ([]equinix.InstancePool, error) {
+	poolList, err := h.instancePool.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var pools []equinix.InstancePool
+	for _, pool := range poolList.Items {
+		if pool.Name == ip.Name || pool.DeletionTimestamp != nil || pool.Status.MetalGateway == nil {
+			continue
+		}
+		if pool.Status.MetalGateway.ID == gatewayID {
+			pools = append(pools, pool)
+		}
+	}
+
+	return pools, nil
+}
+
+// effectiveStaticIPPool fills in the network and gateway of the static ip pool from the Metal Gateway
+// of the pool. When no static ip pool is specified for a layer2 pool, addresses are allocated from the
+// whole gateway network, as the management network is carried by the gateway VLAN.
+func effectiveStaticIPPool(ip *equinix.InstancePool) *equinix.StaticIPPool {
+	gateway := ip.Status.MetalGateway
+	if gateway == nil || gateway.Network == "" {
+		return ip.Spec.StaticIPPool
+	}
+
+	if ip.Spec.StaticIPPool == nil && !strings.HasPrefix(ip.Spec.NetworkingConfiguration.Type, "layer2") {
+		return nil
+	}
+
+	pool := &equinix.StaticIPPool{}
+	if ip.Spec.StaticIPPool != nil {
+		pool = ip.Spec.StaticIPPool.DeepCopy()
+	}
+
+	if pool.CIDR == "" {
+		pool.CIDR = gateway.Network
+	}
+
+	if pool.Gateway == "" {
+		pool.Gateway = gateway.Gateway
+	}
+
+	return pool
+}
+
+func allocateManagementAddress(pool *equinix.StaticIPPool, used map[string]bool) (*equinix.ManagementAddress, error) {
+	address, mask, err := util.AllocateIP(pool.CIDR, pool.RangeStart, pool.RangeEnd, pool.Gateway, used)
+	if err != nil {
+		return nil, err
+	}
+
+	used[address] = true
+	return &equinix.ManagementAddress{
+		IP:             address,
+		SubnetMask:     mask,
+		Gateway:        pool.Gateway,
+		DNSNameservers: pool.DNSNameservers,
+	}, nil
+}
+
+// resolveRelease looks up the install artifacts of the harvesterVersion of the pool and verifies
+// the version matches the running cluster, as nodes with a different version can't join it.
+// Instances are only submitted while the versions match, which also holds back scaling a pool
+// until its harvesterVersion follows a cluster upgrade.
+func (h *handler) resolveRelease(ip *equinix.InstancePool) (*equinix.InstancePool, error) {
+	if ip.Spec.HarvesterVersion == "" {
+		return ip, nil
+	}
+
+	serverVersion, err := h.setting.ServerVersion(h.ctx)
+	if err != nil {
+		return ip, errors.Wrap(err, "error looking up harvester server version")
+	}
+
+	if !harvester.VersionsMatch(ip.Spec.HarvesterVersion, serverVersion) {
+		err = fmt.Errorf("harvesterVersion %s of instancePool %s does not match cluster version %s", ip.Spec.HarvesterVersion, ip.Name, serverVersion)
+		ipCopy := ip.DeepCopy()
+		equinix.InstancePoolVersionCompatible.False(ipCopy)
+		equinix.InstancePoolVersionCompatible.Reason(ipCopy, "VersionMismatch")
+		equinix.InstancePoolVersionCompatible.Message(ipCopy, err.Error())
+		if !reflect.DeepEqual(ip.Status, ipCopy.Status) {
+			if _, updateErr := h.instancePool.UpdateStatus(ipCopy); updateErr != nil {
+				return ip, updateErr
+			}
+		}
+		return ip, err
+	}
+
+	release := harvester.DefaultRelease(ip.Spec.HarvesterVersion)
+	cm, err := h.configMap.Get(util.OperatorNamespace(), DefaultVersionCatalogue, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ip, err
+	}
+
+	if err == nil {
+		if data, ok := cm.Data[ip.Spec.HarvesterVersion]; ok {
+			release, err = harvester.ParseRelease(ip.Spec.HarvesterVersion, data)
+			if err != nil {
+				return ip, errors.Wrapf(err, "error parsing configmap %s", DefaultVersionCatalogue)
+			}
+		}
+	}
+
+	ip.Status.Release = release
+	equinix.InstancePoolVersionCompatible.True(ip)
+	equinix.InstancePoolVersionCompatible.Reason(ip, "")
+	equinix.InstancePoolVersionCompatible.Message(ip, "")
+	return ip, nil
+}
+
+// verifyArtifacts checks the install artifacts of the pool against their pinned checksums. The artifacts
+// are downloaded in the background, and the pool is requeued until they are verified. Instances are not
+// submitted while an artifact is downloading or fails verification.
+func (h *handler) verifyArtifacts(key string, ip *equinix.InstancePool) (*equinix.InstancePool, bool, error) {
+	checksums := ip.Spec.Checksums
+	if checksums == nil {
+		return ip, true, nil
+	}
+
+	release := ip.Status.Release
+	if release == nil {
+		release = &equinix.HarvesterRelease{}
+	}
+
+	artifacts := []struct {
+		name     string
+		url      string
+		checksum string
+	}{
+		{"iso", isoURL(ip), checksums.ISO},
+		{"kernel", release.KernelURL, checksums.Kernel},
+		{"initrd", release.InitrdURL, checksums.Initrd},
+		{"rootfs", release.RootFSURL, checksums.RootFS},
+	}
+
+	var downloading []string
+	for _, a := range artifacts {
+		if a.checksum == "" {
+			continue
+		}
+
+		var err error
+		verified := false
+		reason := "VerificationFailed"
+		if a.url == "" {
+			err = fmt.Errorf("no %s url to verify in instancePool %s, harvesterVersion is needed to resolve it", a.name, ip.Name)
+		} else {
+			verified, err = h.artifacts.Verify(h.ctx, a.url, a.checksum)
+		}
+
+		if err != nil {
+			mismatch := &artifact.ChecksumMismatchError{}
+			if errors.As(err, &mismatch) {
+				reason = "ChecksumMismatch"
+			}
+
+			ipCopy := ip.DeepCopy()
+			equinix.InstancePoolArtifactsVerified.False(ipCopy)
+			equinix.InstancePoolArtifactsVerified.Reason(ipCopy, reason)
+			equinix.InstancePoolArtifactsVerified.Message(ipCopy, err.Error())
+			if !reflect.DeepEqual(ip.Status, ipCopy.Status) {
+				if _, updateErr := h.instancePool.UpdateStatus(ipCopy); updateErr != nil {
+					return ip, false, updateErr
+				}
+			}
+			return ip, false, err
+		}
+
+		if !verified {
+			downloading = append(downloading, a.name)
+		}
+	}
+
+	if len(downloading) != 0 {
+		h.instancePool.EnqueueAfter(key, artifactPollInterval)
+		ipCopy := ip.DeepCopy()
+		equinix.InstancePoolArtifactsVerified.Unknown(ipCopy)
+		equinix.InstancePoolArtifactsVerified.Reason(ipCopy, "Downloading")
+		equinix.InstancePoolArtifactsVerified.Message(ipCopy, fmt.Sprintf("downloading %s", strings.Join(downloading, ",")))
+		if !reflect.DeepEqual(ip.Status, ipCopy.Status) {
+			if _, updateErr := h.instancePool.UpdateStatus(ipCopy); updateErr != nil {
+				return ip, false, updateErr
+			}
+		}
+		return ip, false, nil
+	}
+
+	equinix.InstancePoolArtifactsVerified.True(ip)
+	equinix.InstancePoolArtifactsVerified.Reason(ip, "")
+	equinix.InstancePoolArtifactsVerified.Message(ip, "")
+	return ip, true, nil
+}
+
+// mirrorArtifacts fetches the install artifacts of the pool into the artifact cache of the operator,
+// so devices download them from the cache instead of the internet. The iPXE scripts are mirrored along
+// with the kernel, initrd and rootfs they boot, and point at the mirrored copies. The artifacts are
+// fetched in the background, and the pool is requeued until all of them are mirrored.
+func (h *handler) mirrorArtifacts(key string, ip *equinix.InstancePool) (*equinix.InstancePool, bool, error) {
+	if !h.artifacts.MirrorEnabled() {
+		ip.Status.MirroredArtifacts = nil
+		return ip, true, nil
+	}
+
+	checksums := ip.Spec.Checksums
+	if checksums == nil {
+		checksums = &equinix.ArtifactChecksums{}
+	}
+
+	artifacts := map[string]string{
+		isoURL(ip): checksums.ISO,
+	}
+
+	release := ip.Status.Release
+	scripts := []string{InitialIPXEScriptURL}
+	if rendersInstallScript(ip) {
+		artifacts[release.KernelURL] = checksums.Kernel
+		artifacts[release.InitrdURL] = checksums.Initrd
+		artifacts[release.RootFSURL] = checksums.RootFS
+	} else {
+		scripts = append(scripts, ipxeScriptURL(ip))
+	}
+
+	mirrored := make(map[string]string, len(artifacts)+len(scripts))
+	var pending []string
+	for url, checksum := range artifacts {
+		mirrorURL, ok, err := h.artifacts.Mirror(h.ctx, url, checksum)
+		if err != nil {
+			return ip, false, errors.Wrapf(err, "error mirroring artifacts of instancePool %s", ip.Name)
+		}
+		if !ok {
+			pending = append(pending, url)
+			continue
+		}
+		mirrored[url] = mirrorURL
+	}
+
+	for _, url := range scripts {
+		mirrorURL, ok, err := h.artifacts.MirrorIPXEScript(h.ctx, url, artifacts)
+		if err != nil {
+			return ip, false, errors.Wrapf(err, "error mirroring artifacts of instancePool %s", ip.Name)
+		}
+		if !ok {
+			pending = append(pending, url)
+			continue
+		}
+		mirrored[url] = mirrorURL
+	}
+
+	if len(pending) != 0 {
+		logrus.Infof("waiting for artifacts %s of instancePool %s to be mirrored", strings.Join(pending, ","), ip.Name)
+		h.instancePool.EnqueueAfter(key, artifactPollInterval)
+		return ip, false, nil
+	}
+
+	ip.Status.MirroredArtifacts = mirrored
+	return ip, true, nil
+}
+
+// mirroredURL returns the url of the artifact in the mirror of the operator if it has been mirrored
+func mirroredURL(ip *equinix.InstancePool, url string) string {
+	if mirrored, ok := ip.Status.MirroredArtifacts[url]; ok {
+		return mirrored
+	}
+
+	return url
+}
+
+// installScript returns the url of the iPXE script booted to install harvester on the nodes of the pool.
+// With a harvesterVersion and no iPXE script of its own, a script booting the kernel, initrd and rootfs
+// of the release is rendered and published, so the version pins what is installed. The script boots the
+// mirrored artifacts, or the release artifacts directly when the mirror is disabled.
+func (h *handler) installScript(ip *equinix.InstancePool, profile *equinixClient.PlanProfile) (string, error) {
+	release := ip.Status.Release
+	if !rendersInstallScript(ip) {
+		return mirroredURL(ip, ipxeScriptURL(ip)), nil
+	}
+
+	if !h.artifacts.PublishEnabled() {
+		return "", fmt.Errorf("harvesterVersion %s of instancePool %s needs the artifact mirror or the install webhook receiver to serve its iPXE script", release.Version, ip.Name)
+	}
+
+	script := harvester.IPXEScript(mirroredURL(ip, release.KernelURL), mirroredURL(ip, release.InitrdURL), mirroredURL(ip, release.RootFSURL), profile.TTY)
+	url, err := h.artifacts.Publish(ip.Name+".ipxe", []byte(script))
+	if err != nil {
+		return "", errors.Wrapf(err, "error publishing iPXE script of instancePool %s", ip.Name)
+	}
+
+	return url, nil
+}
+
+// rendersInstallScript returns true if the install script of the pool is rendered from its release
+func rendersInstallScript(ip *equinix.InstancePool) bool {
+	return ip.Spec.IPXEScriptURL == "" && ip.Status.Release != nil
+}
+
+// ipxeScriptURL returns the iPXE script booted to install harvester on the nodes of the pool
+func ipxeScriptURL(ip *equinix.InstancePool) string {
+	if ip.Spec.IPXEScriptURL != "" {
+		return ip.Spec.IPXEScriptURL
+	}
+
+	return DefaultIPXEScriptURL
+}
+
+// isoURL returns the ISO installed on the nodes of the pool
+func isoURL(ip *equinix.InstancePool) string {
+	if ip.Spec.ISOURL != "" {
+		return ip.Spec.ISOURL
+	}
+
+	if ip.Status.Release != nil {
+		return ip.Status.Release.ISOURL
+	}
+
+	return DefaultISOURL
+}
+
+// instanceTemplate returns the template the instances of the pool are created from. The template of
+// the pool is copied as is, with empty fields filled in from the pool spec, and the fields managed by
+// the operator are always taken from the pool spec. As false is the empty value of a bool, the template
+// can't turn off spotInstance, noSSHKeys or consoleLog when they are set on the pool.
+func instanceTemplate(ip *equinix.InstancePool) *equinix.InstanceTemplate {
+	template := &equinix.InstanceTemplate{}
+	if ip.Spec.Template != nil {
+		template = ip.Spec.Template.DeepCopy()
+	}
+
+	spec := &template.Spec
+	if spec.Plan == "" {
+		spec.Plan = ip.Spec.Plan
+	}
+	if spec.BillingCycle == "" {
+		spec.BillingCycle = ip.Spec.BillingCycle
+	}
+	if spec.Metro == "" {
+		spec.Metro = ip.Spec.Metro
+	}
+	if len(spec.Facility) == 0 {
+		spec.Facility = ip.Spec.Facility
+	}
+	if !spec.SpotInstance {
+		spec.SpotInstance = ip.Spec.SpotInstance
+	}
+	if spec.SpotPriceMax.IsZero() {
+		spec.SpotPriceMax = ip.Spec.SpotPriceMax
+	}
+	if spec.CustomData == "" {
+		spec.CustomData = ip.Spec.CustomData
+	}
+	if len(spec.UserSSHKeys) == 0 {
+		spec.UserSSHKeys = ip.Spec.UserSSHKeys
+	}
+	if len(spec.ProjectSSHKeys) == 0 {
+		spec.ProjectSSHKeys = ip.Spec.ProjectSSHKeys
+	}
+	if len(spec.Features) == 0 {
+		spec.Features = ip.Spec.Features
+	}
+	if !spec.NoSSHKeys {
+		spec.NoSSHKeys = ip.Spec.NoSSHKeys
+	}
+	if spec.PublicIPv4SubnetSize == 0 {
+		spec.PublicIPv4SubnetSize = ip.Spec.PublicIPv4SubnetSize
+	}
+	if len(spec.IPAddresses) == 0 {
+		spec.IPAddresses = ip.Spec.IPAddresses
+	}
+	if spec.NodeCleanupWaitInterval == nil {
+		spec.NodeCleanupWaitInterval = ip.Spec.NodeCleanupWaitInterval
+	}
+	if len(spec.ManagementInterfaces) == 0 {
+		spec.ManagementInterfaces = ip.Spec.ManagementInterfaces
+	}
+	if len(spec.ManagementBondingOptions) == 0 {
+		spec.ManagementBondingOptions = ip.Spec.ManagementBondingOptions
+	}
+	if !spec.ConsoleLog {
+		spec.ConsoleLog = ip.Spec.ConsoleLog
+	}
+
+	// fields managed by the operator
+	spec.UserData = ""
+	spec.NetworkingConfiguration = ip.Spec.NetworkingConfiguration
+	spec.ManagementAddress = nil
+	spec.ReservedIPAddress = ""
+	spec.BGP = ip.Spec.BGP
+	spec.DataDisks = nil
+
+	return template.DeepCopy()
+}
+
+// dataDiskConfiguration resolves the data disks of the plan catalogue into the paths selected for the instance
+func dataDiskConfiguration(config *equinix.DataDiskConfiguration, profile *equinixClient.PlanProfile) *equinix.DataDiskConfiguration {
+	resolved := config.DeepCopy()
+	if resolved.PlanDisks {
+		resolved.Paths = append(resolved.Paths, profile.DataDisks...)
+	}
+
+	return resolved
+}
+
+// planProfile looks up the install layout of the plan in the Metal plan catalogue, applying the
+// overrides for the plan found in the plan catalogue ConfigMap of the operator namespace
+func (h *handler) planProfile(m *equinixClient.MetalClient, plan string) (*equinixClient.PlanProfile, error) {
+	catalogue, err := m.PlanCatalogue()
+	if err != nil {
+		return nil, err
+	}
+
+	profile, ok := catalogue[plan]
+	if !ok {
+		logrus.Warnf("plan %s not found in plan catalogue, using default install layout", plan)
+		profile = equinixClient.DefaultPlanProfile()
+	}
+
+	cm, err := h.configMap.Get(util.OperatorNamespace(), DefaultPlanCatalogue, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return profile, nil
+		}
+		return nil, err
+	}
+
+	if data, ok := cm.Data[plan]; ok {
+		override, err := equinixClient.ParsePlanProfile(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing plan %s in configmap %s", plan, DefaultPlanCatalogue)
+		}
+		profile.Merge(override)
+	}
+
+	return profile, nil
+}
+
+// createInstanceSecrets stores the generated os password and install webhook token of the instance,
+// when it has them, in secrets owned by it
+func (h *handler) createInstanceSecrets(i *equinix.Instance, password, webhookToken string) error {
+	if password != "" {
+		if err := h.createPasswordSecret(i, password); err != nil {
+			return err
+		}
+	}
+
+	if webhookToken != "" {
+		if err := h.createWebhookTokenSecret(i, webhookToken); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createPasswordSecret stores the generated os password of the instance in a secret owned by it,
+// as only the hash of the password is part of the node config
+func (h *handler) createPasswordSecret(i *equinix.Instance, password string) error {
+	err := h.createInstanceSecret(i, PasswordSecretName(i.Name), map[string]string{
+		"username": DefaultUsername,
+		"password": password,
+	})
+
+	return errors.Wrapf(err, "error storing password of instance %s", i.Name)
+}
+
+// createWebhookTokenSecret stores the install webhook token of the instance in a secret owned by it,
+// which the install webhook receiver authenticates the installer with
+func (h *handler) createWebhookTokenSecret(i *equinix.Instance, token string) error {
+	err := h.createInstanceSecret(i, webhook.TokenSecretName(i.Name), map[string]string{
+		webhook.TokenKey: token,
+	})
+
+	return errors.Wrapf(err, "error storing install webhook token of instance %s", i.Name)
+}
+
+func (h *handler) createInstanceSecret(i *equinix.Instance, name string, data map[string]string) error {
+	_, err := h.secret.Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: util.OperatorNamespace(),
+			Labels: map[string]string{
+				"instance":     i.Name,
+				"instancePool": i.Labels["instancePool"],
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "equinix.harvesterhci.io/v1",
+					Kind:       "Instance",
+					Name:       i.Name,
+					UID:        i.UID,
+				},
+			},
+		},
+		StringData: data,
+	})
+
+	return err
+}
+
+// migrateSecrets moves the plaintext password and install webhook token annotations of instances created
+// before they were stored in secrets into the secrets of the instance
+func (h *handler) migrateSecrets(instances []equinix.Instance) error {
+	for idx := range instances {
+		i := &instances[idx]
+		password, hasPassword := i.Annotations[legacyPasswordAnnotation]
+		token, hasToken := i.Annotations[legacyWebhookTokenAnnotation]
+		if (!hasPassword && !hasToken) || i.DeletionTimestamp != nil {
+			continue
+		}
+
+		if hasPassword {
+			if err := h.createPasswordSecret(i, password); err != nil && !apierrors.IsAlreadyExists(errors.Cause(err)) {
+				return err
+			}
+		}
+
+		if hasToken {
+			if err := h.createWebhookTokenSecret(i, token); err != nil && !apierrors.IsAlreadyExists(errors.Cause(err)) {
+				return err
+			}
+		}
+
+		iCopy := i.DeepCopy()
+		delete(iCopy.Annotations, legacyPasswordAnnotation)
+		delete(iCopy.Annotations, legacyWebhookTokenAnnotation)
+		if _, err := h.instance.Update(iCopy); err != nil {
+			return errors.Wrapf(err, "error removing secret annotations of instance %s", i.Name)
+		}
+		logrus.Infof("moved secret annotations of instance %s into secrets", i.Name)
+	}
+
+	return nil
+}
+
+// PasswordSecretName returns the name of the secret holding the os password of an instance
+func PasswordSecretName(instance string) string {
+	return fmt.Sprintf("%s-password", instance)
+}
+
+// sshAuthorizedKeys collects the keys allowed to ssh into the nodes of the pool: the referenced
+// Metal user and project keys, the raw keys of the pool and the keys in the referenced secret
+func (h *handler) sshAuthorizedKeys(ip *equinix.InstancePool, spec *equinix.InstanceSpec, m *equinixClient.MetalClient) ([]string, error) {
+	keys, err := m.ResolveSSHKeys(spec.UserSSHKeys, spec.ProjectSSHKeys, spec.NoSSHKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	keys = append(keys, ip.Spec.SSHAuthorizedKeys...)
+	if ip.Spec.SSHAuthorizedKeysSecret != "" {
+		secret, err := h.secret.Get(util.OperatorNamespace(), ip.Spec.SSHAuthorizedKeysSecret, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading sshAuthorizedKeysSecret of instancePool %s", ip.Name)
+		}
+
+		for _, k := range sortedSecretKeys(secret.Data) {
+			keys = append(keys, strings.Split(string(secret.Data[k]), "\n")...)
+		}
+	}
+
+	var authorizedKeys []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || strings.HasPrefix(key, "#") || seen[key] {
+			continue
+		}
+		seen[key] = true
+		authorizedKeys = append(authorizedKeys, key)
+	}
+
+	return authorizedKeys, nil
+}
+
+func sortedSecretKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nodeSettings reads the operator wide proxy, registry and CA settings applied to every node
+func (h *handler) nodeSettings() (*harvester.NodeSettings, error) {
+	cm, err := h.configMap.Get(util.OperatorNamespace(), DefaultNodeSettings, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	settings := &harvester.NodeSettings{
+		HTTPProxy:    cm.Data["http-proxy"],
+		HTTPSProxy:   cm.Data["https-proxy"],
+		NoProxy:      cm.Data["no-proxy"],
+		AdditionalCA: cm.Data["additional-ca"],
+	}
+
+	if data := cm.Data["registry-mirrors"]; data != "" {
+		settings.RegistryMirrors, err = harvester.ParseRegistryMirrors(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing configmap %s", DefaultNodeSettings)
+		}
+	}
+
+	return settings, nil
+}
+
+// harvesterConfigOverride returns the partial harvester config of the pool, merging the referenced
+// ConfigMap or Secret with the inline harvesterConfig, which takes precedence
+func (h *handler) harvesterConfigOverride(ip *equinix.InstancePool) (*harvester.HarvesterConfig, error) {
+	if ip.Spec.HarvesterConfig == "" && ip.Spec.HarvesterConfigRef == nil {
+		return nil, nil
+	}
+
+	override := harvester.NewHarvesterConfig()
+	if ref := ip.Spec.HarvesterConfigRef; ref != nil {
+		data, err := h.harvesterConfigRefData(ref)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading harvesterConfigRef of instancePool %s", ip.Name)
+		}
+
+		override, err = harvester.ParseHarvesterConfig(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing harvesterConfigRef of instancePool %s", ip.Name)
+		}
+	}
+
+	if ip.Spec.HarvesterConfig != "" {
+		inline, err := harvester.ParseHarvesterConfig(ip.Spec.HarvesterConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing harvesterConfig of instancePool %s", ip.Name)
+		}
+
+		if err := mergo.Merge(override, inline, mergo.WithOverride); err != nil {
+			return nil, err
+		}
+	}
+
+	return override, nil
+}
+
+func (h *handler) harvesterConfigRefData(ref *equinix.HarvesterConfigRef) (string, error) {
+	key := ref.Key
+	if key == "" {
+		key = DefaultHarvesterConfigKey
+	}
+
+	switch ref.Kind {
+	case "ConfigMap":
+		cm, err := h.configMap.Get(util.OperatorNamespace(), ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		data, ok := cm.Data[key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in configmap %s", key, ref.Name)
+		}
+		return data, nil
+	case "Secret":
+		secret, err := h.secret.Get(util.OperatorNamespace(), ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		data, ok := secret.Data[key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in secret %s", key, ref.Name)
+		}
+		return string(data), nil
+	}
+
+	return "", fmt.Errorf("unsupported kind %s, expected ConfigMap or Secret", ref.Kind)
+}
+
+// cloudInitConfig holds the inputs of the harvester config generated for the instances of a pool
+type cloudInitConfig struct {
+	joinAddress       string
+	passwordHash      string
+	sshAuthorizedKeys []string
+	profile           *equinixClient.PlanProfile
+	settings          *harvester.NodeSettings
+	override          *harvester.HarvesterConfig
+	webhookURL        string
+	webhookToken      string
+}
+
+func generateCloudInit(ip *equinix.InstancePool, i *equinix.Instance, config cloudInitConfig) (string, error) {
+
+	hc := harvester.HarvesterConfig{
+		ServerURL: fmt.Sprintf("https://%s:8443", config.joinAddress),
+		Token:     ip.Status.Token,
+		OS: harvester.OS{
+			Hostname:          i.Name,
+			Password:          config.passwordHash,
+			SSHAuthorizedKeys: config.sshAuthorizedKeys,
+		},
+		Install: harvester.Install{
+			Automatic: true,
+			Mode:      "join",
+			TTY:       config.profile.TTY,
+			Device:    config.profile.Device,
+		},
+	}
+
+	// set ISO URL //
+	hc.Install.ISOURL = mirroredURL(ip, isoURL(ip))
+
+	if config.override != nil {
+		if err := hc.MergeOverride(config.override); err != nil {
+			return "", errors.Wrapf(err, "error applying harvester config of instancePool %s", ip.Name)
+		}
+	}
+
+	// install webhooks and node settings are applied after the override, so they are kept when
+	// the override replaces the webhooks or writeFiles lists
+	if config.webhookURL != "" {
+		hc.Install.Webhooks = append(hc.Install.Webhooks, webhook.InstallWebhooks(config.webhookURL, i.Name, config.webhookToken)...)
+	}
+
+	settings := config.settings
+	if settings == nil {
+		settings = &harvester.NodeSettings{}
+	}
+
+	if err := hc.ApplyNodeSettings(settings, config.joinAddress); err != nil {
+		return "", errors.Wrap(err, "error applying node settings")
+	}
+
+	userData, err := yaml.Marshal(hc)
 	if err != nil {
 		return "", errors.Wrap(err, "error during marshalling harverster config to cloudInit")
 	}
 
-	return fmt.Sprintf("#cloud-config\n%s", string(config)), nil
+	return fmt.Sprintf("#cloud-config\n%s", string(userData)), nil
 }
 
 func (h *handler) removeInstances(_ string, ip *equinix.InstancePool) (*equinix.InstancePool, error) {
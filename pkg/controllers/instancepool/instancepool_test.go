@@ -0,0 +1,486 @@
+package instancepool
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/packethost/packngo"
+	corecontrollers "github.com/rancher/wrangler/pkg/generated/controllers/core/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/artifact"
+	equinixClient "github.com/harvester/harvester-equinix-addon/pkg/equinix"
+	controller "github.com/harvester/harvester-equinix-addon/pkg/generated/controllers/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
+)
+
+// fakeMetal answers the requests of the handler with fixed status codes and bodies, and records every request
+type fakeMetal struct {
+	lock      sync.Mutex
+	responses map[string]int
+	bodies    map[string]interface{}
+	requests  []string
+}
+
+func (f *fakeMetal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	request := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, request)
+	code, ok := f.responses[request]
+	if !ok {
+		code = http.StatusNotFound
+		if _, ok := f.bodies[request]; ok {
+			code = http.StatusOK
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if code >= http.StatusBadRequest {
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {http.StatusText(code)}})
+		return
+	}
+	if body, ok := f.bodies[request]; ok {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// fakeInstances keeps the instances of a pool in memory, only the methods used by the handler are implemented
+type fakeInstances struct {
+	controller.InstanceController
+	instances []equinix.Instance
+	deleted   []string
+}
+
+func (f *fakeInstances) List(metav1.ListOptions) (*equinix.InstanceList, error) {
+	return &equinix.InstanceList{Items: f.instances}, nil
+}
+
+func (f *fakeInstances) Delete(name string, _ *metav1.DeleteOptions) error {
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+// fakePools keeps instance pools in memory, only the methods used by the handler are implemented
+type fakePools struct {
+	controller.InstancePoolController
+	pools   []equinix.InstancePool
+	updated []*equinix.InstancePool
+}
+
+func (f *fakePools) List(metav1.ListOptions) (*equinix.InstancePoolList, error) {
+	return &equinix.InstancePoolList{Items: f.pools}, nil
+}
+
+func (f *fakePools) UpdateStatus(ip *equinix.InstancePool) (*equinix.InstancePool, error) {
+	f.updated = append(f.updated, ip.DeepCopy())
+	return ip, nil
+}
+
+// fakeCredentials returns the operator secret holding the Metal credentials
+type fakeCredentials struct {
+	corecontrollers.SecretController
+}
+
+func (f *fakeCredentials) Get(namespace, name string, _ metav1.GetOptions) (*v1.Secret, error) {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data:       map[string][]byte{"METAL_AUTH_TOKEN": []byte("token"), "PROJECT_ID": []byte("project")},
+	}, nil
+}
+
+func newTestClient(t *testing.T, handler http.Handler) *equinixClient.MetalClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := packngo.NewClientWithBaseURL("test", "token", server.Client(), server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &equinixClient.MetalClient{Client: client, ProjectID: "project"}
+}
+
+func newTestHandler(t *testing.T, metal http.Handler, instances *fakeInstances) *handler {
+	t.Helper()
+	m := newTestClient(t, metal)
+	return &handler{
+		instance:  instances,
+		secret:    &fakeCredentials{},
+		newClient: func(string, string) *equinixClient.MetalClient { return m },
+	}
+}
+
+func TestInstanceTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     equinix.InstancePoolSpec
+		template *equinix.InstanceTemplate
+		want     equinix.InstanceSpec
+	}{
+		{
+			name: "pool fields without template",
+			pool: equinix.InstancePoolSpec{Plan: "c3.small.x86", Metro: "sv", UserSSHKeys: []string{"user"}, NoSSHKeys: true},
+			want: equinix.InstanceSpec{Plan: "c3.small.x86", Metro: "sv", UserSSHKeys: []string{"user"}, NoSSHKeys: true},
+		},
+		{
+			name:     "template fields win",
+			pool:     equinix.InstancePoolSpec{Plan: "c3.small.x86", Metro: "sv", UserSSHKeys: []string{"user"}},
+			template: &equinix.InstanceTemplate{Spec: equinix.InstanceSpec{Plan: "m3.large.x86", ProjectSSHKeys: []string{"project"}}},
+			want:     equinix.InstanceSpec{Plan: "m3.large.x86", Metro: "sv", UserSSHKeys: []string{"user"}, ProjectSSHKeys: []string{"project"}},
+		},
+		{
+			name:     "template can't turn off pool bools",
+			pool:     equinix.InstancePoolSpec{SpotInstance: true},
+			template: &equinix.InstanceTemplate{Spec: equinix.InstanceSpec{SpotInstance: false}},
+			want:     equinix.InstanceSpec{SpotInstance: true},
+		},
+		{
+			name:     "operator managed fields",
+			template: &equinix.InstanceTemplate{Spec: equinix.InstanceSpec{UserData: "#cloud-config", ReservedIPAddress: "10.0.0.1"}},
+			want:     equinix.InstanceSpec{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := &equinix.InstancePool{Spec: tt.pool}
+			ip.Spec.Template = tt.template
+			got := instanceTemplate(ip).Spec
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("instanceTemplate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallScript(t *testing.T) {
+	release := harvester.DefaultRelease("v1.0.3")
+	pool := func(ipxeScriptURL string, mirrored map[string]string) *equinix.InstancePool {
+		ip := &equinix.InstancePool{ObjectMeta: metav1.ObjectMeta{Name: "pool"}}
+		ip.Spec.IPXEScriptURL = ipxeScriptURL
+		ip.Status.Release = release
+		ip.Status.MirroredArtifacts = mirrored
+		return ip
+	}
+
+	tests := []struct {
+		name       string
+		ip         *equinix.InstancePool
+		mirrorURL  string
+		publishURL string
+		want       string
+		wantKernel string
+		wantErr    bool
+	}{
+		{
+			name: "pool ipxe script",
+			ip:   pool("https://example.com/install.ipxe", nil),
+			want: "https://example.com/install.ipxe",
+		},
+		{
+			name:       "mirrored release artifacts",
+			ip:         pool("", map[string]string{release.KernelURL: "http://mirror/artifacts/kernel"}),
+			mirrorURL:  "http://mirror",
+			want:       "http://mirror/artifacts/published/pool.ipxe",
+			wantKernel: "http://mirror/artifacts/kernel",
+		},
+		{
+			name:       "release artifacts without the mirror",
+			ip:         pool("", nil),
+			publishURL: "http://webhook",
+			want:       "http://webhook/artifacts/published/pool.ipxe",
+			wantKernel: release.KernelURL,
+		},
+		{
+			name:    "nowhere to publish the script",
+			ip:      pool("", nil),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			h := &handler{artifacts: artifact.NewCache(dir, tt.mirrorURL)}
+			if tt.publishURL != "" {
+				h.artifacts.PublishAt(tt.publishURL)
+			}
+
+			got, err := h.installScript(tt.ip, &equinixClient.PlanProfile{TTY: "ttyS1,115200n8"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("installScript() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("installScript() = %q, want %q", got, tt.want)
+			}
+			if tt.wantKernel == "" {
+				return
+			}
+
+			script, err := os.ReadFile(filepath.Join(dir, "published", "pool.ipxe"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(script), "kernel "+tt.wantKernel+" ") {
+				t.Errorf("published script boots the wrong kernel:\n%s", script)
+			}
+		})
+	}
+}
+
+func TestValidateIPAddresses(t *testing.T) {
+	tests := []struct {
+		name        string
+		networkType string
+		addresses   []equinix.IPAddressRequest
+		wantErr     bool
+	}{
+		{
+			name: "default addresses",
+		},
+		{
+			name:      "layer3 private IPv4 only",
+			addresses: []equinix.IPAddressRequest{{AddressFamily: 4, Public: false}},
+		},
+		{
+			name:      "public IPv4 subnet size",
+			addresses: []equinix.IPAddressRequest{{AddressFamily: 4, Public: true, CIDR: 29}, {AddressFamily: 6, Public: true, CIDR: 64}},
+		},
+		{
+			name:      "layer3 without IPv4",
+			addresses: []equinix.IPAddressRequest{{AddressFamily: 6, Public: true}},
+			wantErr:   true,
+		},
+		{
+			name:        "hybrid without IPv4",
+			networkType: "hybrid",
+			addresses:   []equinix.IPAddressRequest{{AddressFamily: 6, Public: true}},
+			wantErr:     true,
+		},
+		{
+			name:        "layer2 without IPv4",
+			networkType: "layer2-bonded",
+			addresses:   []equinix.IPAddressRequest{{AddressFamily: 6, Public: true}},
+		},
+		{
+			name:        "invalid address family",
+			networkType: "layer2-bonded",
+			addresses:   []equinix.IPAddressRequest{{AddressFamily: 5}},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := &equinix.InstancePool{Spec: equinix.InstancePoolSpec{IPAddresses: tt.addresses}}
+			ip.Name = "pool"
+			ip.Spec.NetworkingConfiguration.Type = tt.networkType
+			if err := validateIPAddresses(ip); (err != nil) != tt.wantErr {
+				t.Errorf("validateIPAddresses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOnInstancePoolRemove(t *testing.T) {
+	pool := func(spec *equinix.ReservedIPBlock, blockID string) *equinix.InstancePool {
+		ip := &equinix.InstancePool{ObjectMeta: metav1.ObjectMeta{Name: "pool"}}
+		ip.Spec.ReservedIPBlock = spec
+		ip.Status.ReservedIPBlockID = blockID
+		return ip
+	}
+	instance := equinix.Instance{ObjectMeta: metav1.ObjectMeta{Name: "pool-1"}}
+
+	tests := []struct {
+		name         string
+		ip           *equinix.InstancePool
+		instances    []equinix.Instance
+		responses    map[string]int
+		wantDeleted  []string
+		wantRequests []string
+		wantErr      bool
+	}{
+		{
+			name: "no reserved block",
+			ip:   pool(nil, ""),
+		},
+		{
+			name:      "referenced block is kept",
+			ip:        pool(&equinix.ReservedIPBlock{ID: "block"}, "block"),
+			instances: []equinix.Instance{instance},
+		},
+		{
+			name:        "requested block waits for the instances",
+			ip:          pool(&equinix.ReservedIPBlock{Quantity: 4}, "block"),
+			instances:   []equinix.Instance{instance},
+			wantDeleted: []string{"pool-1"},
+			wantErr:     true,
+		},
+		{
+			name:         "requested block is released",
+			ip:           pool(&equinix.ReservedIPBlock{Quantity: 4}, "block"),
+			responses:    map[string]int{"DELETE /ips/block": http.StatusNoContent},
+			wantRequests: []string{"DELETE /ips/block"},
+		},
+		{
+			name:         "requested block is already gone",
+			ip:           pool(&equinix.ReservedIPBlock{Quantity: 4}, "block"),
+			wantRequests: []string{"DELETE /ips/block"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metal := &fakeMetal{responses: tt.responses}
+			instances := &fakeInstances{instances: tt.instances}
+			h := newTestHandler(t, metal, instances)
+
+			_, err := h.OnInstancePoolRemove("pool", tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OnInstancePoolRemove() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(instances.deleted, tt.wantDeleted) {
+				t.Errorf("OnInstancePoolRemove() deleted instances %v, want %v", instances.deleted, tt.wantDeleted)
+			}
+			if !reflect.DeepEqual(metal.requests, tt.wantRequests) {
+				t.Errorf("OnInstancePoolRemove() sent %v, want %v", metal.requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestEnsureMetalGateway(t *testing.T) {
+	gateway := packngo.MetalGateway{
+		ID:             "gateway",
+		State:          packngo.MetalGatewayReady,
+		VirtualNetwork: &packngo.VirtualNetwork{ID: "vlan", VXLAN: 1000},
+		IPReservation:  &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Network: "10.0.0.0", CIDR: 29}},
+	}
+	usingPool := func(name string, status *equinix.MetalGatewayStatus) equinix.InstancePool {
+		pool := equinix.InstancePool{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		pool.Status.MetalGateway = status
+		return pool
+	}
+
+	tests := []struct {
+		name   string
+		config equinix.MetalGatewayConfiguration
+		pools  []equinix.InstancePool
+		want   *equinix.MetalGatewayStatus
+	}{
+		{
+			name:   "unmanaged gateway on the vlan",
+			config: equinix.MetalGatewayConfiguration{VLAN: "1000"},
+			pools:  []equinix.InstancePool{usingPool("other", &equinix.MetalGatewayStatus{ID: "gateway"})},
+			want:   &equinix.MetalGatewayStatus{ID: "gateway", State: "ready", VLAN: "1000", Network: "10.0.0.0/29", Gateway: "10.0.0.1"},
+		},
+		{
+			name:   "gateway managed by another pool",
+			config: equinix.MetalGatewayConfiguration{VLAN: "1000"},
+			pools: []equinix.InstancePool{
+				usingPool("pool", nil),
+				usingPool("other", &equinix.MetalGatewayStatus{ID: "gateway", Managed: true, VRFReservationID: "vrf-range"}),
+			},
+			want: &equinix.MetalGatewayStatus{ID: "gateway", State: "ready", VLAN: "1000", Network: "10.0.0.0/29", Gateway: "10.0.0.1", Managed: true, VRFReservationID: "vrf-range"},
+		},
+		{
+			name:   "referenced gateway is never managed",
+			config: equinix.MetalGatewayConfiguration{ID: "gateway"},
+			pools:  []equinix.InstancePool{usingPool("other", &equinix.MetalGatewayStatus{ID: "gateway", Managed: true})},
+			want:   &equinix.MetalGatewayStatus{ID: "gateway", State: "ready", VLAN: "1000", Network: "10.0.0.0/29", Gateway: "10.0.0.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metal := &fakeMetal{bodies: map[string]interface{}{
+				"GET /projects/project/virtual-networks": packngo.VirtualNetworkListResponse{VirtualNetworks: []packngo.VirtualNetwork{{ID: "vlan", VXLAN: 1000}}},
+				"GET /projects/project/metal-gateways":   map[string][]packngo.MetalGateway{"metal_gateways": {gateway}},
+				"GET /metal-gateways/gateway":            gateway,
+			}}
+			pools := &fakePools{pools: tt.pools}
+			h := &handler{instancePool: pools}
+
+			ip := &equinix.InstancePool{ObjectMeta: metav1.ObjectMeta{Name: "pool"}}
+			ip.Spec.NetworkingConfiguration.MetalGateway = &tt.config
+			ip, err := h.ensureMetalGateway(ip, newTestClient(t, metal))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ip.Status.MetalGateway, tt.want) {
+				t.Errorf("ensureMetalGateway() = %+v, want %+v", ip.Status.MetalGateway, tt.want)
+			}
+			if len(pools.updated) != 1 {
+				t.Errorf("ensureMetalGateway() updated the pool status %d times, want 1", len(pools.updated))
+			}
+		})
+	}
+}
+
+func TestReleaseMetalGateway(t *testing.T) {
+	managed := &equinix.MetalGatewayStatus{ID: "gateway", Managed: true, VRFReservationID: "vrf-range"}
+	usingPool := func(name string, deleting bool) equinix.InstancePool {
+		pool := equinix.InstancePool{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if deleting {
+			now := metav1.Now()
+			pool.DeletionTimestamp = &now
+		}
+		pool.Status.MetalGateway = managed.DeepCopy()
+		return pool
+	}
+
+	tests := []struct {
+		name         string
+		gateway      *equinix.MetalGatewayStatus
+		pools        []equinix.InstancePool
+		wantRequests []string
+	}{
+		{
+			name:    "unmanaged gateway is kept",
+			gateway: &equinix.MetalGatewayStatus{ID: "gateway"},
+		},
+		{
+			name:    "gateway still used by another pool",
+			gateway: managed,
+			pools:   []equinix.InstancePool{usingPool("pool", true), usingPool("other", false)},
+		},
+		{
+			name:         "last pool removes the gateway",
+			gateway:      managed,
+			pools:        []equinix.InstancePool{usingPool("pool", true), usingPool("other", true)},
+			wantRequests: []string{"DELETE /metal-gateways/gateway", "DELETE /ips/vrf-range"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metal := &fakeMetal{responses: map[string]int{
+				"DELETE /metal-gateways/gateway": http.StatusNoContent,
+				"DELETE /ips/vrf-range":          http.StatusNoContent,
+			}}
+			h := &handler{instancePool: &fakePools{pools: tt.pools}}
+
+			ip := &equinix.InstancePool{ObjectMeta: metav1.ObjectMeta{Name: "pool"}}
+			ip.Status.MetalGateway = tt.gateway
+			if err := h.releaseMetalGateway(ip, newTestClient(t, metal)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(metal.requests, tt.wantRequests) {
+				t.Errorf("releaseMetalGateway() sent %v, want %v", metal.requests, tt.wantRequests)
+			}
+		})
+	}
+}
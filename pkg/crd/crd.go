@@ -80,14 +80,19 @@ func List() []crd.CRD {
 				WithColumn("Status", ".status.status").
 				WithColumn("InstanceID", ".status.instanceID").
 				WithColumn("publicIP", ".status.publicIP").
-				WithColumn("privateIP", ".status.privateIP")
+				WithColumn("privateIP", ".status.privateIP").
+				WithColumn("publicIPv6", ".status.publicIPv6").
+				WithColumn("Plan", ".status.device.plan").
+				WithColumn("Metro", ".status.device.metro")
 
 		}),
 		newCRD(&equinix.InstancePool{}, func(c crd.CRD) crd.CRD {
 			return c.
 				WithColumn("Status", ".status.status").
 				WithColumn("Ready", ".status.ready").
-				WithColumn("Requested", ".status.requested")
+				WithColumn("Requested", ".status.requested").
+				WithColumn("Hourly Cost", ".status.estimatedCost.hourly").
+				WithColumn("Monthly Cost", ".status.estimatedCost.monthly")
 
 		}),
 	}
@@ -0,0 +1,133 @@
+package equinix
+
+import (
+	"strconv"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultBGPDeploymentType = "local"
+	DefaultBGPASN            = 65000
+	DefaultBGPAddressFamily  = "ipv4"
+)
+
+// EnsureProjectBGPConfig enables BGP on the project. An existing project configuration is left untouched,
+// as it can't be removed or changed through the API.
+func (m *MetalClient) EnsureProjectBGPConfig(bgp *api.BGPConfiguration) error {
+	config, resp, err := m.BGPConfig.Get(m.ProjectID, nil)
+	if err != nil && !isNotFound(resp) {
+		return err
+	}
+
+	if config != nil && config.ID != "" {
+		return nil
+	}
+
+	request := packngo.CreateBGPConfigRequest{
+		DeploymentType: bgp.DeploymentType,
+		Asn:            bgp.ASN,
+		Md5:            bgp.MD5,
+		UseCase:        bgp.UseCase,
+	}
+
+	if request.DeploymentType == "" {
+		request.DeploymentType = DefaultBGPDeploymentType
+	}
+
+	if request.Asn == 0 {
+		request.Asn = DefaultBGPASN
+	}
+
+	_, err = m.BGPConfig.Create(m.ProjectID, request)
+	return errors.Wrap(err, "error enabling bgp on project")
+}
+
+// CreateBGPSessions creates a session for every address family requested for the instance which does
+// not have one yet
+func (m *MetalClient) CreateBGPSessions(instance *api.Instance) (status *api.InstanceStatus, err error) {
+	status = instance.Status.DeepCopy()
+	sessions, _, err := m.Devices.ListBGPSessions(instance.Status.InstanceID, nil)
+	if err != nil {
+		return status, err
+	}
+
+	status.BGPSessions = nil
+	existing := make(map[string]bool)
+	for _, session := range sessions {
+		existing[session.AddressFamily] = true
+		status.BGPSessions = append(status.BGPSessions, bgpSessionStatus(&session))
+	}
+
+	for _, family := range bgpAddressFamilies(instance.Spec.BGP) {
+		if existing[family] {
+			continue
+		}
+
+		session, _, err := m.BGPSessions.Create(instance.Status.InstanceID, packngo.CreateBGPSessionRequest{
+			AddressFamily: family,
+			DefaultRoute:  &instance.Spec.BGP.DefaultRoute,
+		})
+		if err != nil {
+			return status, errors.Wrapf(err, "error creating %s bgp session", family)
+		}
+		status.BGPSessions = append(status.BGPSessions, bgpSessionStatus(session))
+	}
+
+	return status, nil
+}
+
+// BGPNeighbors returns the peering information a bgp speaker on the device needs, keyed by address family
+func (m *MetalClient) BGPNeighbors(instance *api.Instance) (map[string]string, error) {
+	neighbors, _, err := m.Devices.ListBGPNeighbors(instance.Status.InstanceID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string)
+	for _, neighbor := range neighbors {
+		prefix := "ipv" + strconv.Itoa(neighbor.AddressFamily) + "."
+		data[prefix+"customer-as"] = strconv.Itoa(neighbor.CustomerAs)
+		data[prefix+"customer-ip"] = neighbor.CustomerIP
+		data[prefix+"peer-as"] = strconv.Itoa(neighbor.PeerAs)
+		data[prefix+"multihop"] = strconv.FormatBool(neighbor.Multihop)
+		for i, peerIP := range neighbor.PeerIps {
+			data[prefix+"peer-ip-"+strconv.Itoa(i)] = peerIP
+		}
+		if neighbor.Md5Enabled {
+			data[prefix+"md5-password"] = neighbor.Md5Password
+		}
+	}
+
+	return data, nil
+}
+
+// DeleteBGPSessions removes the bgp sessions of the instance
+func (m *MetalClient) DeleteBGPSessions(instance *api.Instance) error {
+	for _, session := range instance.Status.BGPSessions {
+		resp, err := m.BGPSessions.Delete(session.ID)
+		if err != nil && !isNotFound(resp) {
+			return errors.Wrapf(err, "error deleting bgp session %s", session.ID)
+		}
+	}
+
+	return nil
+}
+
+func bgpAddressFamilies(bgp *api.BGPConfiguration) []string {
+	if len(bgp.AddressFamilies) == 0 {
+		return []string{DefaultBGPAddressFamily}
+	}
+
+	return bgp.AddressFamilies
+}
+
+func bgpSessionStatus(session *packngo.BGPSession) api.BGPSessionStatus {
+	return api.BGPSessionStatus{
+		ID:            session.ID,
+		AddressFamily: session.AddressFamily,
+		Status:        session.Status,
+	}
+}
@@ -0,0 +1,155 @@
+package equinix
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+)
+
+func TestEnsureProjectBGPConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    *packngo.BGPConfig
+		bgp         api.BGPConfiguration
+		wantCreated *packngo.CreateBGPConfigRequest
+	}{
+		{
+			name:     "existing project config is kept",
+			existing: &packngo.BGPConfig{ID: "config", DeploymentType: "global", Asn: 64512},
+			bgp:      api.BGPConfiguration{ASN: 65001},
+		},
+		{
+			name:        "defaults",
+			wantCreated: &packngo.CreateBGPConfigRequest{DeploymentType: DefaultBGPDeploymentType, Asn: DefaultBGPASN},
+		},
+		{
+			name:        "requested config",
+			bgp:         api.BGPConfiguration{DeploymentType: "global", ASN: 65001, MD5: "secret"},
+			wantCreated: &packngo.CreateBGPConfigRequest{DeploymentType: "global", Asn: 65001, Md5: "secret"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var created *packngo.CreateBGPConfigRequest
+			mux := http.NewServeMux()
+			mux.HandleFunc("/projects/project/bgp-config", func(w http.ResponseWriter, r *http.Request) {
+				if tt.existing == nil {
+					w.WriteHeader(http.StatusNotFound)
+					json.NewEncoder(w).Encode(map[string][]string{"errors": {"Not found"}})
+					return
+				}
+				json.NewEncoder(w).Encode(tt.existing)
+			})
+			mux.HandleFunc("/projects/project/bgp-configs", func(w http.ResponseWriter, r *http.Request) {
+				created = &packngo.CreateBGPConfigRequest{}
+				json.NewDecoder(r.Body).Decode(created)
+				w.WriteHeader(http.StatusCreated)
+			})
+
+			bgp := tt.bgp
+			if err := newTestClient(t, mux).EnsureProjectBGPConfig(&bgp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(created, tt.wantCreated) {
+				t.Errorf("EnsureProjectBGPConfig() created %+v, want %+v", created, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func TestCreateBGPSessions(t *testing.T) {
+	var created []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices/device/bgp/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(map[string][]packngo.BGPSession{
+				"bgp_sessions": {{ID: "session-ipv4", AddressFamily: "ipv4", Status: "up"}},
+			})
+			return
+		}
+
+		request := packngo.CreateBGPSessionRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		created = append(created, request.AddressFamily)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(packngo.BGPSession{ID: "session-" + request.AddressFamily, AddressFamily: request.AddressFamily, Status: "unknown"})
+	})
+
+	i := &api.Instance{Spec: api.InstanceSpec{BGP: &api.BGPConfiguration{AddressFamilies: []string{"ipv4", "ipv6"}}}}
+	i.Status.InstanceID = "device"
+
+	status, err := newTestClient(t, mux).CreateBGPSessions(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"ipv6"}; !reflect.DeepEqual(created, want) {
+		t.Errorf("CreateBGPSessions() created sessions for %v, want %v", created, want)
+	}
+
+	want := []api.BGPSessionStatus{
+		{ID: "session-ipv4", AddressFamily: "ipv4", Status: "up"},
+		{ID: "session-ipv6", AddressFamily: "ipv6", Status: "unknown"},
+	}
+	if !reflect.DeepEqual(status.BGPSessions, want) {
+		t.Errorf("CreateBGPSessions() sessions = %+v, want %+v", status.BGPSessions, want)
+	}
+}
+
+func TestBGPNeighbors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices/device/bgp/neighbors", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]packngo.BGPNeighbor{
+			"bgp_neighbors": {
+				{
+					AddressFamily: 4,
+					CustomerAs:    65000,
+					CustomerIP:    "10.0.0.2",
+					Md5Enabled:    true,
+					Md5Password:   "secret",
+					PeerAs:        65530,
+					PeerIps:       []string{"169.254.255.1", "169.254.255.2"},
+				},
+				{
+					AddressFamily: 6,
+					CustomerAs:    65000,
+					CustomerIP:    "2604:1380::2",
+					Multihop:      true,
+					PeerAs:        65530,
+					PeerIps:       []string{"fc00::e"},
+				},
+			},
+		})
+	})
+
+	i := &api.Instance{}
+	i.Status.InstanceID = "device"
+
+	got, err := newTestClient(t, mux).BGPNeighbors(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"ipv4.customer-as":  "65000",
+		"ipv4.customer-ip":  "10.0.0.2",
+		"ipv4.peer-as":      "65530",
+		"ipv4.multihop":     "false",
+		"ipv4.peer-ip-0":    "169.254.255.1",
+		"ipv4.peer-ip-1":    "169.254.255.2",
+		"ipv4.md5-password": "secret",
+		"ipv6.customer-as":  "65000",
+		"ipv6.customer-ip":  "2604:1380::2",
+		"ipv6.peer-as":      "65530",
+		"ipv6.multihop":     "true",
+		"ipv6.peer-ip-0":    "fc00::e",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BGPNeighbors() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,172 @@
+package equinix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultRateLimit is the number of requests per second sent to the Metal api per credential
+	DefaultRateLimit = 5
+	DefaultRateBurst = 10
+	DefaultRetries   = 4
+	retryBaseDelay   = time.Second
+	retryMaxDelay    = 30 * time.Second
+	// retryBudget bounds the total time a request spends waiting for retries, so that a throttled
+	// credential doesn't hold the controller workers for minutes
+	retryBudget     = 20 * time.Second
+	requestIDHeader = "X-Request-Id"
+)
+
+var (
+	httpClients    = make(map[string]*http.Client)
+	httpClientLock sync.Mutex
+)
+
+// credentialKey returns a hash of the token, used to key state shared per credential without
+// keeping the token itself around
+func credentialKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sharedHTTPClient returns the http client shared by all MetalClients using the same token, so
+// the rate limit applies to all requests made with the credential
+func sharedHTTPClient(token string) *http.Client {
+	httpClientLock.Lock()
+	defer httpClientLock.Unlock()
+
+	key := credentialKey(token)
+	client, ok := httpClients[key]
+	if !ok {
+		client = &http.Client{
+			Transport: &retryTransport{
+				base:    http.DefaultTransport,
+				limiter: rate.NewLimiter(DefaultRateLimit, DefaultRateBurst),
+				retries: DefaultRetries,
+				budget:  retryBudget,
+			},
+		}
+		httpClients[key] = client
+	}
+
+	return client
+}
+
+// retryTransport rate limits requests with a token bucket, and retries throttled requests as well
+// as idempotent requests failing with server errors
+type retryTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+	retries int
+	budget  time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		r := req
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		retry := attempt < t.retries && retryable(req, resp, err)
+		var delay time.Duration
+		if retry {
+			delay = retryDelay(resp, attempt)
+		}
+		if !retry || time.Since(start)+delay > t.budget {
+			if resp != nil && resp.StatusCode >= http.StatusBadRequest {
+				logrus.Debugf("equinix api %s %s returned %s, request id %s", req.Method, req.URL.Path,
+					resp.Status, resp.Header.Get(requestIDHeader))
+			}
+			return resp, err
+		}
+
+		if err != nil {
+			logrus.Warnf("retrying equinix api %s %s in %s: %v", req.Method, req.URL.Path, delay, err)
+		} else {
+			logrus.Warnf("retrying equinix api %s %s in %s: %s, request id %s", req.Method, req.URL.Path, delay,
+				resp.Status, resp.Header.Get(requestIDHeader))
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryable reports whether the request can be sent again. Throttled requests were not processed
+// and are always retried, while server and network errors are only retried for idempotent methods
+// so that devices are never created twice.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// retryDelay honours the Retry-After header of the response, and otherwise uses exponential
+// backoff with full jitter
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if resp != nil {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if seconds, err := strconv.Atoi(after); err == nil {
+				return capDelay(time.Duration(seconds) * time.Second)
+			}
+			if at, err := http.ParseTime(after); err == nil {
+				return capDelay(time.Until(at))
+			}
+		}
+	}
+
+	backoff := capDelay(retryBaseDelay << uint(attempt))
+	return time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond
+}
+
+func capDelay(delay time.Duration) time.Duration {
+	if delay < 0 {
+		return 0
+	}
+
+	if delay > retryMaxDelay {
+		return retryMaxDelay
+	}
+
+	return delay
+}
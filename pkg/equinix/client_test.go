@@ -0,0 +1,143 @@
+package equinix
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRetryable(t *testing.T) {
+	request := func(method string, body bool) *http.Request {
+		var req *http.Request
+		if body {
+			req = httptest.NewRequest(method, "/devices", strings.NewReader("{}"))
+			req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("{}")), nil }
+		} else {
+			req = httptest.NewRequest(method, "/devices", nil)
+			req.Body = nil
+		}
+		return req
+	}
+	response := func(code int) *http.Response {
+		return &http.Response{StatusCode: code}
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{name: "throttled get", req: request(http.MethodGet, false), resp: response(http.StatusTooManyRequests), want: true},
+		{name: "throttled post", req: request(http.MethodPost, true), resp: response(http.StatusTooManyRequests), want: true},
+		{name: "server error get", req: request(http.MethodGet, false), resp: response(http.StatusBadGateway), want: true},
+		{name: "server error delete", req: request(http.MethodDelete, false), resp: response(http.StatusServiceUnavailable), want: true},
+		{name: "server error post", req: request(http.MethodPost, true), resp: response(http.StatusBadGateway)},
+		{name: "network error get", req: request(http.MethodGet, false), err: errors.New("connection reset"), want: true},
+		{name: "network error post", req: request(http.MethodPost, true), err: errors.New("connection reset")},
+		{name: "client error", req: request(http.MethodGet, false), resp: response(http.StatusNotFound)},
+		{name: "success", req: request(http.MethodGet, false), resp: response(http.StatusOK)},
+		{name: "body can't be replayed", req: func() *http.Request {
+			req := request(http.MethodPut, true)
+			req.GetBody = nil
+			return req
+		}(), resp: response(http.StatusTooManyRequests)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.req, tt.resp, tt.err); got != tt.want {
+				t.Errorf("retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryAfter := func(value string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": {value}}}
+	}
+
+	tests := []struct {
+		name    string
+		resp    *http.Response
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "retry after seconds", resp: retryAfter("3"), min: 3 * time.Second, max: 3 * time.Second},
+		{name: "retry after is capped", resp: retryAfter("600"), min: retryMaxDelay, max: retryMaxDelay},
+		{name: "retry after in the past", resp: retryAfter("Mon, 02 Jan 2006 15:04:05 GMT"), min: 0, max: 0},
+		{name: "first backoff", attempt: 0, min: time.Millisecond, max: retryBaseDelay + time.Millisecond},
+		{name: "third backoff", resp: retryAfter("invalid"), attempt: 2, min: time.Millisecond, max: 4*retryBaseDelay + time.Millisecond},
+		{name: "backoff is capped", attempt: 10, min: time.Millisecond, max: retryMaxDelay + time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for n := 0; n < 20; n++ {
+				if got := retryDelay(tt.resp, tt.attempt); got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay() = %s, want between %s and %s", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &retryTransport{
+			base:    http.DefaultTransport,
+			limiter: rate.NewLimiter(rate.Inf, 1),
+			retries: DefaultRetries,
+			budget:  1500 * time.Millisecond,
+		},
+	}
+
+	resp, err := client.Post(server.URL, "application/json", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	// the second retry would exceed the budget
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("sent %d requests, want 2", got)
+	}
+}
+
+func TestSharedHTTPClient(t *testing.T) {
+	if sharedHTTPClient("token") != sharedHTTPClient("token") {
+		t.Error("sharedHTTPClient() returned different clients for the same token")
+	}
+	if sharedHTTPClient("token") == sharedHTTPClient("other") {
+		t.Error("sharedHTTPClient() returned the same client for different tokens")
+	}
+
+	httpClientLock.Lock()
+	defer httpClientLock.Unlock()
+	if _, ok := httpClients["token"]; ok {
+		t.Error("http clients are keyed by the plaintext token")
+	}
+}
@@ -2,23 +2,28 @@ package equinix
 
 import (
 	"fmt"
+	"time"
 
 	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
 	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
 	"github.com/packethost/packngo"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type MetalClient struct {
 	*packngo.Client
 	ProjectID string
+	// credential identifies the token of the client without exposing it
+	credential string
 }
 
 func NewClient(token, projectID string) *MetalClient {
 	m := &MetalClient{
-		Client:    packngo.NewClientWithAuth("packngo lib", token, nil),
-		ProjectID: projectID,
+		Client:     packngo.NewClientWithAuth("packngo lib", token, sharedHTTPClient(token)),
+		ProjectID:  projectID,
+		credential: credentialKey(token),
 	}
 
 	return m
@@ -61,6 +66,14 @@ func (m *MetalClient) generateDeviceCreationRequest(instance *api.Instance) (dsr
 		IPXEScriptURL:         instance.Spec.IPXEScriptURL,
 	}
 
+	for _, address := range instance.Spec.IPAddresses {
+		dsr.IPAddresses = append(dsr.IPAddresses, packngo.IPAddressCreateRequest{
+			AddressFamily: address.AddressFamily,
+			Public:        address.Public,
+			CIDR:          address.CIDR,
+		})
+	}
+
 	if dsr.ProjectID == "" {
 		dsr.ProjectID = m.ProjectID
 	}
@@ -69,15 +82,24 @@ func (m *MetalClient) generateDeviceCreationRequest(instance *api.Instance) (dsr
 
 func (m *MetalClient) CheckDeviceStatus(instance *api.Instance) (status *api.InstanceStatus, err error) {
 	status = instance.Status.DeepCopy()
-	deviceStatus, _, err := m.Devices.Get(instance.Status.InstanceID, nil)
+	deviceStatus, _, err := m.Devices.Get(instance.Status.InstanceID, portVLANIncludes)
 	if err != nil {
 		return status, err
 	}
 
+	status.Device = deviceMetadata(deviceStatus, status.Device)
+	status.Ports = PortStatus(deviceStatus)
 	if deviceStatus.State == "active" {
 		status.Status = "ready"
 		status.PrivateIP = deviceStatus.GetNetworkInfo().PrivateIPv4
 		status.PublicIP = deviceStatus.GetNetworkInfo().PublicIPv4
+		status.PublicIPv6 = deviceStatus.GetNetworkInfo().PublicIPv6
+		status.Addresses = addressStatus(deviceStatus)
+		// the device is provisioned once it is active again after the reinstall with harvester
+		if instance.Status.Status == "reinstalling" && status.Device.ProvisionedAt == nil {
+			now := metav1.Now()
+			status.Device.ProvisionedAt = &now
+		}
 	} else {
 		status.Status = deviceStatus.State
 	}
@@ -103,35 +125,56 @@ func (m *MetalClient) DeleteDevice(instance *api.Instance) (err error) {
 	return nil
 }
 
-func (m *MetalClient) deviceExists(instanceID string) (ok bool, err error) {
-	devices, _, err := m.Devices.List(m.ProjectID, nil)
+// ListDevices returns all devices of the project, including the VLANs of their ports, with a
+// single paginated list call
+func (m *MetalClient) ListDevices() ([]packngo.Device, error) {
+	devices, _, err := m.Devices.List(m.ProjectID, portVLANIncludes)
 	if err != nil {
-		return ok, err
+		return nil, errors.Wrapf(err, "error listing devices of project %s", m.ProjectID)
 	}
 
-	for _, device := range devices {
-		if device.ID == instanceID {
-			ok = true
-			return ok, nil
-		}
+	return devices, nil
+}
+
+// deviceExists looks up the device by id, a missing device is reported as gone
+func (m *MetalClient) deviceExists(instanceID string) (ok bool, err error) {
+	_, resp, err := m.Devices.Get(instanceID, nil)
+	if isNotFound(resp) {
+		return false, nil
 	}
 
-	return ok, nil
+	if err != nil {
+		return false, err
+	}
 
+	return true, nil
 }
 
 func (m *MetalClient) ReInstallDevice(instance *api.Instance) (status *api.InstanceStatus, err error) {
 	status = instance.Status.DeepCopy()
 
-	device, _, err := m.Devices.Get(instance.Status.InstanceID, nil)
+	// the device is only reinstalled once the ports have been converged with the network configuration
+	status.VLANBatches, err = m.CheckVLANBatches(status.VLANBatches)
+	if err != nil || len(status.VLANBatches) != 0 {
+		return status, err
+	}
+
+	device, _, err := m.Devices.Get(instance.Status.InstanceID, portVLANIncludes)
 	if err != nil {
 		return status, err
 	}
 
-	err = m.UpdateNetworkConfig(device, instance.Spec.NetworkingConfiguration)
+	status.VLANBatches, err = m.UpdateNetworkConfig(device, instance.Spec.NetworkingConfiguration, instance.Spec.IPAddresses)
+	if err != nil || len(status.VLANBatches) != 0 {
+		return status, err
+	}
+
+	// record the resulting port and vlan assignments
+	device, _, err = m.Devices.Get(instance.Status.InstanceID, portVLANIncludes)
 	if err != nil {
 		return status, err
 	}
+	status.Ports = PortStatus(device)
 	// find mac addresses //
 	macAddresses := []string{}
 
@@ -144,7 +187,7 @@ func (m *MetalClient) ReInstallDevice(instance *api.Instance) (status *api.Insta
 		macAddresses = append(macAddresses, port.Data.MAC)
 	}
 
-	cloudInit, err := updateCloudInit(instance.Spec.UserData, macAddresses, instance.Spec.ManagementBondingOptions)
+	cloudInit, err := updateCloudInit(instance.Spec.UserData, macAddresses, instance.Spec.ManagementBondingOptions, instance.Spec.ManagementAddress)
 	if err != nil {
 		return status, err
 	}
@@ -167,10 +210,14 @@ func (m *MetalClient) ReInstallDevice(instance *api.Instance) (status *api.Insta
 	}
 
 	status.Status = "reinstalling"
+	if status.Device != nil {
+		status.Device.ProvisionedAt = nil
+	}
+	status.NetworkType = instance.Spec.NetworkingConfiguration.Type
 	return status, nil
 }
 
-func updateCloudInit(baseCloudInit string, macAddresses []string, bondOptions map[string]string) (string, error) {
+func updateCloudInit(baseCloudInit string, macAddresses []string, bondOptions map[string]string, address *api.ManagementAddress) (string, error) {
 
 	hc := &harvester.HarvesterConfig{}
 	err := yaml.Unmarshal([]byte(baseCloudInit), hc)
@@ -197,6 +244,17 @@ func updateCloudInit(baseCloudInit string, macAddresses []string, bondOptions ma
 		mgmtNetwork.BondOptions = bondOptions
 	}
 
+	// layer2 networks have no dhcp, so a static address is allocated by the instancePool
+	if address != nil {
+		mgmtNetwork.Method = "static"
+		mgmtNetwork.IP = address.IP
+		mgmtNetwork.SubnetMask = address.SubnetMask
+		mgmtNetwork.Gateway = address.Gateway
+		if len(address.DNSNameservers) != 0 {
+			hc.DNSNameservers = address.DNSNameservers
+		}
+	}
+
 	hc.Networks["harvester-mgmt"] = mgmtNetwork
 	updatedCloudInit, err := yaml.Marshal(hc)
 	if err != nil {
@@ -206,39 +264,43 @@ func updateCloudInit(baseCloudInit string, macAddresses []string, bondOptions ma
 	return fmt.Sprintf("#cloud-config\n%s", string(updatedCloudInit)), nil
 }
 
-func (m *MetalClient) UpdateNetworkConfig(device *packngo.Device, network api.NetworkingConfiguration) error {
+// UpdateNetworkConfig converges the ports of the device with the network configuration, and returns
+// the submitted VLAN assignment batches. The configuration is converged once no batches are returned.
+func (m *MetalClient) UpdateNetworkConfig(device *packngo.Device, network api.NetworkingConfiguration, addresses []api.IPAddressRequest) ([]api.VLANBatchStatus, error) {
 
 	if network.Type == "" {
 		// no actual network reconfig is needed
-		return nil
-	}
-
-	err := m.ConvertDevice(device, network.Type)
-	if err != nil {
-		return err
+		return nil, nil
 	}
 
-	// apply VLANS
-	for _, netInterface := range network.Interfaces {
-		port, err := device.GetPortByName(netInterface.Name)
+	// a conversion without vlan changes completes synchronously, after which the drift is recomputed
+	for pass := 0; pass < 2; pass++ {
+		drift, err := ComputeNetworkDrift(device, network)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		for _, vlan := range netInterface.VlanIDS {
-			_, _, err = m.Client.Ports.Assign(port.ID, vlan)
-			if err != nil {
-				return err
-			}
+		if drift.IsEmpty() {
+			return nil, nil
+		}
+
+		batches, err := m.ApplyNetworkDrift(device, drift, addresses)
+		if err != nil || len(batches) != 0 {
+			return batches, err
+		}
+
+		device, _, err = m.Devices.Get(device.ID, portVLANIncludes)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	return nil, fmt.Errorf("network configuration of device %s did not converge", device.ID)
 }
 
 // ConvertDevice is fork from Packngo ConvertDevice. Changed to use non deprecated port service
-// methods
-func (m *MetalClient) ConvertDevice(d *packngo.Device, targetType string) error {
+// methods. The addresses are requested when converting back to layer3.
+func (m *MetalClient) ConvertDevice(d *packngo.Device, targetType string, addresses []api.IPAddressRequest) error {
 	bondPorts := d.GetBondPorts()
 	allEthPorts := d.GetPhysicalPorts()
 
@@ -252,7 +314,13 @@ func (m *MetalClient) ConvertDevice(d *packngo.Device, targetType string) error
 	}
 
 	if targetType == "layer3" {
-		// TODO: remove vlans from all the ports
+		// Metal refuses to convert ports with vlans attached, ApplyNetworkDrift removes them first
+		for _, p := range d.NetworkPorts {
+			if len(p.AttachedVirtualNetworks) != 0 {
+				return fmt.Errorf("port %s still has vlans attached, unable to convert device %s to layer3", p.Name, d.ID)
+			}
+		}
+
 		for _, p := range bondPorts {
 			_, _, err := m.Client.Ports.Bond(p.ID, false)
 			if err != nil {
@@ -260,11 +328,7 @@ func (m *MetalClient) ConvertDevice(d *packngo.Device, targetType string) error
 			}
 		}
 
-		_, _, err := m.Client.Ports.ConvertToLayerThree(bond0Port.ID, []packngo.AddressRequest{
-			{AddressFamily: 4, Public: true},
-			{AddressFamily: 4, Public: false},
-			{AddressFamily: 6, Public: true},
-		})
+		_, _, err := m.Client.Ports.ConvertToLayerThree(bond0Port.ID, layer3AddressRequests(addresses))
 
 		if err != nil {
 			return err
@@ -333,3 +397,92 @@ func (m *MetalClient) ConvertDevice(d *packngo.Device, targetType string) error
 
 	return fmt.Errorf("invalid network type %s in instance", targetType)
 }
+
+// ListedDeviceStatus returns the status of the instance with the device metadata and ports taken
+// from its listed device, so they can be refreshed without a request per device
+func ListedDeviceStatus(device *packngo.Device, instance *api.Instance) *api.InstanceStatus {
+	status := instance.Status.DeepCopy()
+	status.Device = deviceMetadata(device, status.Device)
+	status.Ports = PortStatus(device)
+	return status
+}
+
+// deviceMetadata returns the details of the device, keeping the time the device was provisioned
+func deviceMetadata(device *packngo.Device, previous *api.DeviceMetadata) *api.DeviceMetadata {
+	metadata := &api.DeviceMetadata{
+		Hostname:               device.Hostname,
+		State:                  device.State,
+		ProvisioningPercentage: int(device.ProvisionPer),
+		SpotInstance:           device.SpotInstance,
+	}
+
+	if device.Plan != nil {
+		metadata.Plan = device.Plan.Slug
+	}
+
+	if device.Facility != nil {
+		metadata.Facility = device.Facility.Code
+		// the serial over ssh console is reached as <device id>@sos.<facility>.platformequinix.com
+		metadata.SOS = fmt.Sprintf("%s@sos.%s.platformequinix.com", device.ID, device.Facility.Code)
+	}
+
+	if device.Metro != nil {
+		metadata.Metro = device.Metro.Code
+	}
+
+	if device.HardwareReservation != nil {
+		metadata.HardwareReservationID = device.HardwareReservation.ID
+	}
+
+	if created, err := time.Parse(time.RFC3339, device.Created); err == nil {
+		metadata.CreatedAt = &metav1.Time{Time: created}
+	}
+
+	if device.TerminationTime != nil {
+		metadata.TerminationTime = &metav1.Time{Time: device.TerminationTime.Time}
+	}
+
+	if previous != nil {
+		metadata.ProvisionedAt = previous.ProvisionedAt
+	}
+
+	return metadata
+}
+
+// layer3AddressRequests defaults to the addresses Metal assigns to a new device
+func layer3AddressRequests(addresses []api.IPAddressRequest) []packngo.AddressRequest {
+	if len(addresses) == 0 {
+		return []packngo.AddressRequest{
+			{AddressFamily: 4, Public: true},
+			{AddressFamily: 4, Public: false},
+			{AddressFamily: 6, Public: true},
+		}
+	}
+
+	var requests []packngo.AddressRequest
+	for _, address := range addresses {
+		requests = append(requests, packngo.AddressRequest{
+			AddressFamily: address.AddressFamily,
+			Public:        address.Public,
+		})
+	}
+
+	return requests
+}
+
+func addressStatus(device *packngo.Device) []api.AddressStatus {
+	var addresses []api.AddressStatus
+	for _, address := range device.Network {
+		addresses = append(addresses, api.AddressStatus{
+			Address:       address.Address,
+			AddressFamily: address.AddressFamily,
+			Public:        address.Public,
+			CIDR:          address.CIDR,
+			Network:       address.Network,
+			Gateway:       address.Gateway,
+			Management:    address.Management,
+		})
+	}
+
+	return addresses
+}
@@ -0,0 +1,151 @@
+package equinix
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckDeviceStatusProvisionedAt(t *testing.T) {
+	provisioned := metav1.Unix(1700000000, 0)
+
+	tests := []struct {
+		name            string
+		state           string
+		status          api.InstanceStatus
+		wantProvisioned bool
+		wantPrevious    bool
+	}{
+		{
+			name:   "active before the reinstall",
+			state:  "active",
+			status: api.InstanceStatus{Status: "submitted"},
+		},
+		{
+			name:   "still reinstalling",
+			state:  "reinstalling",
+			status: api.InstanceStatus{Status: "reinstalling"},
+		},
+		{
+			name:            "active after the reinstall",
+			state:           "active",
+			status:          api.InstanceStatus{Status: "reinstalling"},
+			wantProvisioned: true,
+		},
+		{
+			name:            "provisioned time is kept",
+			state:           "active",
+			status:          api.InstanceStatus{Status: "managed", Device: &api.DeviceMetadata{ProvisionedAt: &provisioned}},
+			wantProvisioned: true,
+			wantPrevious:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(packngo.Device{ID: "device", State: tt.state})
+			}))
+
+			tt.status.InstanceID = "device"
+			status, err := m.CheckDeviceStatus(&api.Instance{Status: tt.status})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := status.Device.ProvisionedAt
+			if (got != nil) != tt.wantProvisioned {
+				t.Fatalf("CheckDeviceStatus() provisionedAt = %v, want set %v", got, tt.wantProvisioned)
+			}
+			if tt.wantPrevious && !got.Equal(&provisioned) {
+				t.Errorf("CheckDeviceStatus() provisionedAt = %v, want %v", got, provisioned)
+			}
+		})
+	}
+}
+
+func TestGenerateDeviceCreationRequestAddresses(t *testing.T) {
+	i := &api.Instance{Spec: api.InstanceSpec{
+		PublicIPv4SubnetSize: 29,
+		IPAddresses: []api.IPAddressRequest{
+			{AddressFamily: 4, Public: true, CIDR: 29},
+			{AddressFamily: 4, Public: false},
+			{AddressFamily: 6, Public: true, CIDR: 64},
+		},
+	}}
+
+	dsr := (&MetalClient{ProjectID: "project"}).generateDeviceCreationRequest(i)
+	if dsr.PublicIPv4SubnetSize != 29 {
+		t.Errorf("generateDeviceCreationRequest() publicIPv4SubnetSize = %d, want 29", dsr.PublicIPv4SubnetSize)
+	}
+
+	want := []packngo.IPAddressCreateRequest{
+		{AddressFamily: 4, Public: true, CIDR: 29},
+		{AddressFamily: 4, Public: false},
+		{AddressFamily: 6, Public: true, CIDR: 64},
+	}
+	if !reflect.DeepEqual(dsr.IPAddresses, want) {
+		t.Errorf("generateDeviceCreationRequest() ipAddresses = %+v, want %+v", dsr.IPAddresses, want)
+	}
+}
+
+func TestLayer3AddressRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []api.IPAddressRequest
+		want      []packngo.AddressRequest
+	}{
+		{
+			name: "defaults",
+			want: []packngo.AddressRequest{
+				{AddressFamily: 4, Public: true},
+				{AddressFamily: 4, Public: false},
+				{AddressFamily: 6, Public: true},
+			},
+		},
+		{
+			name:      "private IPv4 only",
+			addresses: []api.IPAddressRequest{{AddressFamily: 4, Public: false}},
+			want:      []packngo.AddressRequest{{AddressFamily: 4, Public: false}},
+		},
+		{
+			name:      "subnet size is only used at creation",
+			addresses: []api.IPAddressRequest{{AddressFamily: 4, Public: true, CIDR: 29}, {AddressFamily: 4, Public: false}},
+			want:      []packngo.AddressRequest{{AddressFamily: 4, Public: true}, {AddressFamily: 4, Public: false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := layer3AddressRequests(tt.addresses); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("layer3AddressRequests() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressStatus(t *testing.T) {
+	device := &packngo.Device{Network: []*packngo.IPAddressAssignment{
+		{IpAddressCommon: packngo.IpAddressCommon{Address: "147.75.0.2", AddressFamily: 4, Public: true, CIDR: 29, Network: "147.75.0.0", Gateway: "147.75.0.1", Management: true}},
+		{IpAddressCommon: packngo.IpAddressCommon{Address: "10.0.0.2", AddressFamily: 4, Public: false, CIDR: 31, Network: "10.0.0.2", Gateway: "10.0.0.3", Management: true}},
+		{IpAddressCommon: packngo.IpAddressCommon{Address: "2604:1380::2", AddressFamily: 6, Public: true, CIDR: 64, Network: "2604:1380::", Gateway: "2604:1380::1"}},
+	}}
+
+	want := []api.AddressStatus{
+		{Address: "147.75.0.2", AddressFamily: 4, Public: true, CIDR: 29, Network: "147.75.0.0", Gateway: "147.75.0.1", Management: true},
+		{Address: "10.0.0.2", AddressFamily: 4, Public: false, CIDR: 31, Network: "10.0.0.2", Gateway: "10.0.0.3", Management: true},
+		{Address: "2604:1380::2", AddressFamily: 6, Public: true, CIDR: 64, Network: "2604:1380::", Gateway: "2604:1380::1"},
+	}
+	if got := addressStatus(device); !reflect.DeepEqual(got, want) {
+		t.Errorf("addressStatus() = %+v, want %+v", got, want)
+	}
+
+	if got := addressStatus(&packngo.Device{}); got != nil {
+		t.Errorf("addressStatus() without addresses = %+v, want nil", got)
+	}
+}
@@ -0,0 +1,134 @@
+package equinix
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+// ErrorClass groups the errors of the Metal api by how the controllers handle them
+type ErrorClass string
+
+const (
+	// ErrorClassAuth is returned for invalid or revoked credentials
+	ErrorClassAuth ErrorClass = "AuthFailure"
+	// ErrorClassCapacity is returned when the requested plan is out of stock or a project quota is reached
+	ErrorClassCapacity ErrorClass = "CapacityExhausted"
+	// ErrorClassInvalid is returned for requests which can't succeed, such as an unknown plan or metro
+	ErrorClassInvalid ErrorClass = "InvalidRequest"
+	// ErrorClassNotFound is returned when the referenced resource no longer exists
+	ErrorClassNotFound ErrorClass = "NotFound"
+	// ErrorClassTransient is returned for server errors which may succeed when retried
+	ErrorClassTransient ErrorClass = "Transient"
+)
+
+const (
+	// AuthRetryInterval is the interval credentials are revalidated at after an auth failure
+	AuthRetryInterval = 15 * time.Minute
+	// CapacityRetryInterval is the backoff after a capacity or quota error
+	CapacityRetryInterval = 30 * time.Minute
+)
+
+var capacityMessages = []string{"capacity", "quota", "limit reached", "limit exceeded", "out of stock", "not enough"}
+
+// Error is a classified error of the Metal api
+type Error struct {
+	Class      ErrorClass
+	StatusCode int
+	RequestID  string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%s: %v (request id %s)", e.Class, e.Err, e.RequestID)
+	}
+	return fmt.Sprintf("%s: %v", e.Class, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Permanent reports whether retrying the request without changes can't succeed
+func (e *Error) Permanent() bool {
+	return e.Class.Permanent()
+}
+
+// Permanent reports whether retrying requests failing with errors of the class without changes
+// can't succeed
+func (c ErrorClass) Permanent() bool {
+	switch c {
+	case ErrorClassAuth, ErrorClassInvalid, ErrorClassNotFound:
+		return true
+	}
+
+	return false
+}
+
+// ClassifyError returns the classified Metal api error wrapped in err, or nil if err was not
+// returned by the Metal api
+func ClassifyError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified
+	}
+
+	var response *packngo.ErrorResponse
+	if !errors.As(err, &response) || response.Response == nil {
+		return nil
+	}
+
+	classified = &Error{
+		StatusCode: response.Response.StatusCode,
+		RequestID:  response.Response.Header.Get(requestIDHeader),
+		Err:        err,
+	}
+
+	message := strings.ToLower(strings.Join(append(response.Errors, response.SingleError), " "))
+	switch status := response.Response.StatusCode; {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		classified.Class = ErrorClassAuth
+	case status == http.StatusNotFound:
+		classified.Class = ErrorClassNotFound
+	case status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+		// checked before the capacity messages, as throttling reports "rate limit exceeded"
+		classified.Class = ErrorClassTransient
+	case containsAny(message, capacityMessages):
+		classified.Class = ErrorClassCapacity
+	case status >= http.StatusBadRequest:
+		classified.Class = ErrorClassInvalid
+	default:
+		classified.Class = ErrorClassTransient
+	}
+
+	return classified
+}
+
+// ValidateCredentials checks that the token can access the project
+func (m *MetalClient) ValidateCredentials() error {
+	_, _, err := m.Projects.Get(m.ProjectID, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error validating credentials of project %s", m.ProjectID)
+	}
+
+	return nil
+}
+
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+
+	return false
+}
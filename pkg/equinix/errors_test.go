@@ -0,0 +1,61 @@
+package equinix
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	apiError := func(status int, messages ...string) error {
+		return &packngo.ErrorResponse{
+			Response: &http.Response{StatusCode: status, Header: http.Header{requestIDHeader: {"request"}}},
+			Errors:   messages,
+		}
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		want      ErrorClass
+		permanent bool
+	}{
+		{name: "unauthorized", err: apiError(http.StatusUnauthorized, "invalid token"), want: ErrorClassAuth, permanent: true},
+		{name: "forbidden", err: apiError(http.StatusForbidden), want: ErrorClassAuth, permanent: true},
+		{name: "not found", err: apiError(http.StatusNotFound, "device not found"), want: ErrorClassNotFound, permanent: true},
+		{name: "out of stock", err: apiError(http.StatusUnprocessableEntity, "Plan c3.small.x86 is Out of Stock in sv"), want: ErrorClassCapacity},
+		{name: "quota", err: apiError(http.StatusUnprocessableEntity, "project quota reached"), want: ErrorClassCapacity},
+		{name: "unknown plan", err: apiError(http.StatusUnprocessableEntity, "plan is not valid"), want: ErrorClassInvalid, permanent: true},
+		{name: "throttled", err: apiError(http.StatusTooManyRequests), want: ErrorClassTransient},
+		{name: "server error", err: apiError(http.StatusBadGateway), want: ErrorClassTransient},
+		{name: "rate limit exceeded", err: apiError(http.StatusTooManyRequests, "Rate limit exceeded"), want: ErrorClassTransient},
+		{name: "server error mentioning capacity", err: apiError(http.StatusServiceUnavailable, "capacity service unavailable"), want: ErrorClassTransient},
+		{name: "wrapped", err: errors.Wrap(apiError(http.StatusNotFound), "error getting device"), want: ErrorClassNotFound, permanent: true},
+		{name: "already classified", err: errors.Wrap(&Error{Class: ErrorClassCapacity, Err: errors.New("no capacity")}, "error"), want: ErrorClassCapacity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyError(tt.err)
+			if got == nil {
+				t.Fatalf("ClassifyError() = nil, want %s", tt.want)
+			}
+			if got.Class != tt.want {
+				t.Errorf("ClassifyError() class = %s, want %s", got.Class, tt.want)
+			}
+			if got.Permanent() != tt.permanent {
+				t.Errorf("ClassifyError() permanent = %v, want %v", got.Permanent(), tt.permanent)
+			}
+		})
+	}
+}
+
+func TestClassifyErrorUnclassified(t *testing.T) {
+	for _, err := range []error{nil, errors.New("connection refused"), &packngo.ErrorResponse{}} {
+		if got := ClassifyError(err); got != nil {
+			t.Errorf("ClassifyError(%v) = %v, want nil", err, got)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package equinix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultGatewaySubnetSize = 8
+)
+
+var gatewayIncludes = &packngo.GetOptions{Includes: []string{"ip_reservation", "virtual_network"}}
+
+// vrfIPReservationRequest reserves an ip range of a VRF. It is not modelled by packngo.
+type vrfIPReservationRequest struct {
+	Type    string   `json:"type"`
+	VRFID   string   `json:"vrf_id"`
+	Network string   `json:"network"`
+	CIDR    int      `json:"cidr"`
+	Details string   `json:"details,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// EnsureMetalGateway returns the Metal Gateway attached to the VLAN of the networking configuration
+// of the pool. An existing gateway on the VLAN is reused, otherwise one is created backed by either
+// a private ip block, an existing ip reservation or a newly reserved VRF ip range.
+// The status of a known gateway is returned along with the error if its details can not be read.
+func (m *MetalClient) EnsureMetalGateway(ip *api.InstancePool) (*api.MetalGatewayStatus, error) {
+	config := ip.Spec.NetworkingConfiguration.MetalGateway
+	status := &api.MetalGatewayStatus{}
+	if ip.Status.MetalGateway != nil {
+		status = ip.Status.MetalGateway.DeepCopy()
+	}
+
+	// gateway was already created or adopted by the pool
+	if status.ID != "" {
+		gateway, resp, err := m.MetalGateways.Get(status.ID, gatewayIncludes)
+		if err == nil {
+			return gatewayStatus(gateway, status)
+		}
+
+		if !isNotFound(resp) {
+			return status, err
+		}
+		status = &api.MetalGatewayStatus{}
+	}
+
+	if config.ID != "" {
+		gateway, _, err := m.MetalGateways.Get(config.ID, gatewayIncludes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error looking up metal gateway %s", config.ID)
+		}
+		return gatewayStatus(gateway, status)
+	}
+
+	vlan, err := m.resolveVLAN(config.VLAN, ip.Spec.Metro)
+	if err != nil {
+		return nil, err
+	}
+
+	gateways, _, err := m.MetalGateways.List(m.ProjectID, gatewayIncludes)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range gateways {
+		if gateways[i].VirtualNetwork != nil && gateways[i].VirtualNetwork.ID == vlan.ID {
+			return gatewayStatus(&gateways[i], status)
+		}
+	}
+
+	request := &packngo.MetalGatewayCreateRequest{
+		VirtualNetworkID: vlan.ID,
+		IPReservationID:  config.IPReservationID,
+	}
+
+	if config.VRF != nil {
+		reservation, err := m.reserveVRFRange(ip, config.VRF)
+		if err != nil {
+			return nil, err
+		}
+		status.VRFReservationID = reservation.ID
+		request.IPReservationID = reservation.ID
+	}
+
+	if request.IPReservationID == "" {
+		request.PrivateIPv4SubnetSize = config.PrivateIPv4SubnetSize
+		if request.PrivateIPv4SubnetSize == 0 {
+			request.PrivateIPv4SubnetSize = DefaultGatewaySubnetSize
+		}
+	}
+
+	gateway, _, err := m.MetalGateways.Create(m.ProjectID, request)
+	if err != nil {
+		if status.VRFReservationID != "" {
+			if releaseErr := m.ReleaseIPBlock(status.VRFReservationID); releaseErr != nil {
+				return nil, errors.Wrapf(releaseErr, "error releasing vrf range after failed gateway creation: %v", err)
+			}
+		}
+		return nil, errors.Wrapf(err, "error creating metal gateway for vlan %s", config.VLAN)
+	}
+
+	// the gateway is returned before its reservation details are looked up, so the caller can record
+	// it and it is not leaked if the lookup fails. The details are filled in on the next reconcile.
+	status.ID = gateway.ID
+	status.State = string(gateway.State)
+	status.Managed = true
+	return status, nil
+}
+
+// DeleteMetalGateway removes a gateway created by the operator along with its VRF ip range
+func (m *MetalClient) DeleteMetalGateway(status *api.MetalGatewayStatus) error {
+	_, err := m.MetalGateways.Delete(status.ID)
+	if err != nil {
+		// packngo drops the response of a failed gateway deletion, only the error carries the status code
+		if classified := ClassifyError(err); classified == nil || classified.Class != ErrorClassNotFound {
+			return err
+		}
+	}
+
+	if status.VRFReservationID == "" {
+		return nil
+	}
+
+	return m.ReleaseIPBlock(status.VRFReservationID)
+}
+
+func (m *MetalClient) reserveVRFRange(ip *api.InstancePool, vrf *api.VRFConfiguration) (*packngo.IPAddressReservation, error) {
+	request := &vrfIPReservationRequest{
+		Type:    "vrf",
+		VRFID:   vrf.ID,
+		Network: vrf.Network,
+		CIDR:    vrf.CIDR,
+		Details: fmt.Sprintf("harvester instancePool %s", ip.Name),
+		Tags:    []string{fmt.Sprintf("instancePool:%s", ip.Name)},
+	}
+
+	reservation := &packngo.IPAddressReservation{}
+	_, err := m.Client.DoRequest("POST", path.Join("/projects", m.ProjectID, "ips"), request, reservation)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reserving range %s/%d of vrf %s", vrf.Network, vrf.CIDR, vrf.ID)
+	}
+
+	return reservation, nil
+}
+
+// resolveVLAN looks up a VLAN in the project either by UUID or by VXLAN id in the metro of the pool
+func (m *MetalClient) resolveVLAN(vlan, metro string) (*packngo.VirtualNetwork, error) {
+	vlans, _, err := m.ProjectVirtualNetworks.List(m.ProjectID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, vn := range vlans.VirtualNetworks {
+		if vn.ID == vlan {
+			return &vlans.VirtualNetworks[i], nil
+		}
+
+		if strconv.Itoa(vn.VXLAN) == vlan && (metro == "" || vn.MetroCode == "" || strings.EqualFold(vn.MetroCode, metro)) {
+			return &vlans.VirtualNetworks[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("vlan %s not found in project %s", vlan, m.ProjectID)
+}
+
+func gatewayStatus(gateway *packngo.MetalGateway, status *api.MetalGatewayStatus) (*api.MetalGatewayStatus, error) {
+	status.ID = gateway.ID
+	status.State = string(gateway.State)
+	if gateway.VirtualNetwork != nil {
+		status.VLAN = strconv.Itoa(gateway.VirtualNetwork.VXLAN)
+	}
+
+	reservation := gateway.IPReservation
+	if reservation == nil || reservation.Network == "" {
+		return status, fmt.Errorf("metal gateway %s has no ip reservation details", gateway.ID)
+	}
+
+	status.Network = fmt.Sprintf("%s/%d", reservation.Network, reservation.CIDR)
+	status.SubnetMask = reservation.Netmask
+	status.Gateway = reservation.Gateway
+	if status.Gateway == "" {
+		// the gateway takes the first usable address of the block
+		network := net.ParseIP(reservation.Network).To4()
+		if network == nil {
+			return status, fmt.Errorf("metal gateway %s has an invalid network %s", gateway.ID, reservation.Network)
+		}
+		first := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(first, binary.BigEndian.Uint32(network)+1)
+		status.Gateway = first.String()
+	}
+
+	return status, nil
+}
@@ -0,0 +1,212 @@
+package equinix
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"testing"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+)
+
+// fakeGateways serves the vlans and metal gateways of the test project, and records every request
+type fakeGateways struct {
+	gateways   []packngo.MetalGateway
+	createCode int
+	missing    map[string]bool
+	created    *packngo.MetalGatewayCreateRequest
+	requests   []string
+}
+
+func (f *fakeGateways) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, request)
+
+	w.Header().Set("Content-Type", "application/json")
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"Not found"}})
+	}
+
+	switch {
+	case request == "GET /projects/project/virtual-networks":
+		json.NewEncoder(w).Encode(packngo.VirtualNetworkListResponse{
+			VirtualNetworks: []packngo.VirtualNetwork{{ID: "vlan", VXLAN: 1000, MetroCode: "sv"}},
+		})
+	case request == "GET /projects/project/metal-gateways":
+		json.NewEncoder(w).Encode(map[string][]packngo.MetalGateway{"metal_gateways": f.gateways})
+	case request == "POST /projects/project/metal-gateways":
+		if f.createCode != 0 {
+			w.WriteHeader(f.createCode)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {http.StatusText(f.createCode)}})
+			return
+		}
+		f.created = &packngo.MetalGatewayCreateRequest{}
+		json.NewDecoder(r.Body).Decode(f.created)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(packngo.MetalGateway{ID: "created", State: packngo.MetalGatewayReady})
+	case request == "POST /projects/project/ips":
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: "vrf-range"}})
+	case r.Method == http.MethodGet && path.Dir(r.URL.Path) == "/metal-gateways":
+		for _, gateway := range f.gateways {
+			if gateway.ID == path.Base(r.URL.Path) {
+				json.NewEncoder(w).Encode(gateway)
+				return
+			}
+		}
+		notFound()
+	case r.Method == http.MethodDelete:
+		if f.missing[path.Base(r.URL.Path)] {
+			notFound()
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		notFound()
+	}
+}
+
+func TestEnsureMetalGateway(t *testing.T) {
+	existing := packngo.MetalGateway{
+		ID:             "existing",
+		State:          packngo.MetalGatewayReady,
+		VirtualNetwork: &packngo.VirtualNetwork{ID: "vlan", VXLAN: 1000},
+		IPReservation: &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+			Network: "10.0.0.0", CIDR: 29, Netmask: "255.255.255.248",
+		}},
+	}
+	existingStatus := &api.MetalGatewayStatus{
+		ID: "existing", State: "ready", VLAN: "1000", Network: "10.0.0.0/29", Gateway: "10.0.0.1", SubnetMask: "255.255.255.248",
+	}
+
+	tests := []struct {
+		name        string
+		config      api.MetalGatewayConfiguration
+		status      *api.MetalGatewayStatus
+		gateways    []packngo.MetalGateway
+		createCode  int
+		wantCreated *packngo.MetalGatewayCreateRequest
+		want        *api.MetalGatewayStatus
+		wantRelease bool
+		wantErr     bool
+	}{
+		{
+			name:     "gateway on the vlan is adopted",
+			config:   api.MetalGatewayConfiguration{VLAN: "1000"},
+			gateways: []packngo.MetalGateway{existing},
+			want:     existingStatus,
+		},
+		{
+			name:     "referenced gateway",
+			config:   api.MetalGatewayConfiguration{ID: "existing"},
+			gateways: []packngo.MetalGateway{existing},
+			want:     existingStatus,
+		},
+		{
+			name:     "recorded gateway keeps its managed state",
+			config:   api.MetalGatewayConfiguration{VLAN: "1000"},
+			status:   &api.MetalGatewayStatus{ID: "existing", Managed: true},
+			gateways: []packngo.MetalGateway{existing},
+			want: &api.MetalGatewayStatus{
+				ID: "existing", State: "ready", VLAN: "1000", Network: "10.0.0.0/29", Gateway: "10.0.0.1", SubnetMask: "255.255.255.248", Managed: true,
+			},
+		},
+		{
+			name:        "private block",
+			config:      api.MetalGatewayConfiguration{VLAN: "1000"},
+			wantCreated: &packngo.MetalGatewayCreateRequest{VirtualNetworkID: "vlan", PrivateIPv4SubnetSize: DefaultGatewaySubnetSize},
+			want:        &api.MetalGatewayStatus{ID: "created", State: "ready", Managed: true},
+		},
+		{
+			name:        "removed gateway is recreated",
+			config:      api.MetalGatewayConfiguration{VLAN: "1000", PrivateIPv4SubnetSize: 16},
+			status:      &api.MetalGatewayStatus{ID: "removed", Managed: true},
+			wantCreated: &packngo.MetalGatewayCreateRequest{VirtualNetworkID: "vlan", PrivateIPv4SubnetSize: 16},
+			want:        &api.MetalGatewayStatus{ID: "created", State: "ready", Managed: true},
+		},
+		{
+			name:        "vrf range",
+			config:      api.MetalGatewayConfiguration{VLAN: "1000", VRF: &api.VRFConfiguration{ID: "vrf", Network: "10.1.0.0", CIDR: 24}},
+			wantCreated: &packngo.MetalGatewayCreateRequest{VirtualNetworkID: "vlan", IPReservationID: "vrf-range"},
+			want:        &api.MetalGatewayStatus{ID: "created", State: "ready", Managed: true, VRFReservationID: "vrf-range"},
+		},
+		{
+			name:        "vrf range is released when the creation fails",
+			config:      api.MetalGatewayConfiguration{VLAN: "1000", VRF: &api.VRFConfiguration{ID: "vrf", Network: "10.1.0.0", CIDR: 24}},
+			createCode:  http.StatusUnprocessableEntity,
+			wantRelease: true,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metal := &fakeGateways{gateways: tt.gateways, createCode: tt.createCode}
+			ip := &api.InstancePool{}
+			ip.Name = "pool"
+			ip.Spec.Metro = "sv"
+			ip.Spec.NetworkingConfiguration.MetalGateway = &tt.config
+			ip.Status.MetalGateway = tt.status
+
+			got, err := newTestClient(t, metal).EnsureMetalGateway(ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EnsureMetalGateway() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EnsureMetalGateway() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(metal.created, tt.wantCreated) {
+				t.Errorf("EnsureMetalGateway() created %+v, want %+v", metal.created, tt.wantCreated)
+			}
+
+			released := false
+			for _, request := range metal.requests {
+				released = released || request == "DELETE /ips/vrf-range"
+			}
+			if released != tt.wantRelease {
+				t.Errorf("EnsureMetalGateway() released the vrf range %v, want %v", released, tt.wantRelease)
+			}
+		})
+	}
+}
+
+func TestDeleteMetalGateway(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       *api.MetalGatewayStatus
+		missing      map[string]bool
+		wantRequests []string
+	}{
+		{
+			name:         "private block",
+			status:       &api.MetalGatewayStatus{ID: "gateway"},
+			wantRequests: []string{"DELETE /metal-gateways/gateway"},
+		},
+		{
+			name:         "vrf range is released",
+			status:       &api.MetalGatewayStatus{ID: "gateway", VRFReservationID: "vrf-range"},
+			wantRequests: []string{"DELETE /metal-gateways/gateway", "DELETE /ips/vrf-range"},
+		},
+		{
+			name:         "vrf range of a removed gateway is released",
+			status:       &api.MetalGatewayStatus{ID: "gateway", VRFReservationID: "vrf-range"},
+			missing:      map[string]bool{"gateway": true, "vrf-range": true},
+			wantRequests: []string{"DELETE /metal-gateways/gateway", "DELETE /ips/vrf-range"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metal := &fakeGateways{missing: tt.missing}
+			if err := newTestClient(t, metal).DeleteMetalGateway(tt.status); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(metal.requests, tt.wantRequests) {
+				t.Errorf("DeleteMetalGateway() sent %v, want %v", metal.requests, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package equinix
+
+import (
+	"fmt"
+	"net/http"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultReservedIPType = "public_ipv4"
+	DefaultAssignmentCIDR = 32
+)
+
+// RequestIPBlock reserves a new IP block for the instancePool and returns the reservation ID
+func (m *MetalClient) RequestIPBlock(ip *api.InstancePool) (string, error) {
+	block := ip.Spec.ReservedIPBlock
+	if block.Quantity == 0 {
+		return "", fmt.Errorf("reservedIPBlock of instancePool %s needs either an id or a quantity", ip.Name)
+	}
+
+	request := &packngo.IPReservationRequest{
+		Type:                   block.Type,
+		Quantity:               block.Quantity,
+		Description:            fmt.Sprintf("harvester instancePool %s", ip.Name),
+		Tags:                   []string{fmt.Sprintf("instancePool:%s", ip.Name)},
+		FailOnApprovalRequired: true,
+	}
+
+	if request.Type == "" {
+		request.Type = DefaultReservedIPType
+	}
+
+	if ip.Spec.Metro != "" {
+		request.Metro = &ip.Spec.Metro
+	}
+
+	reservation, _, err := m.ProjectIPs.Request(m.ProjectID, request)
+	if err != nil {
+		return "", errors.Wrap(err, "error during ip block reservation")
+	}
+
+	return reservation.ID, nil
+}
+
+// ReleaseIPBlock returns a reservation requested by the operator
+func (m *MetalClient) ReleaseIPBlock(blockID string) error {
+	resp, err := m.ProjectIPs.Remove(blockID)
+	if isNotFound(resp) {
+		return nil
+	}
+
+	return err
+}
+
+// AvailableAddresses returns the subnets of the requested size which are not assigned to a device
+func (m *MetalClient) AvailableAddresses(blockID string, cidr int) ([]string, error) {
+	if cidr == 0 {
+		cidr = DefaultAssignmentCIDR
+	}
+
+	addresses, _, err := m.ProjectIPs.AvailableAddresses(blockID, &packngo.AvailableRequest{CIDR: cidr})
+	return addresses, err
+}
+
+// AssignReservedIP attaches the address allocated to the instance to its device. Assignments
+// which already exist on the device are reused to keep the operation idempotent.
+func (m *MetalClient) AssignReservedIP(instance *api.Instance) (status *api.InstanceStatus, err error) {
+	status = instance.Status.DeepCopy()
+	if instance.Spec.ReservedIPAddress == "" || (status.ReservedIP != nil && status.ReservedIP.AssignmentID != "") {
+		return status, nil
+	}
+
+	assignments, _, err := m.DeviceIPs.List(instance.Status.InstanceID, nil)
+	if err != nil {
+		return status, err
+	}
+
+	for _, assignment := range assignments {
+		if fmt.Sprintf("%s/%d", assignment.Network, assignment.CIDR) == instance.Spec.ReservedIPAddress ||
+			fmt.Sprintf("%s/%d", assignment.Address, assignment.CIDR) == instance.Spec.ReservedIPAddress {
+			status.ReservedIP = reservedIPStatus(&assignment)
+			return status, nil
+		}
+	}
+
+	assignment, _, err := m.DeviceIPs.Assign(instance.Status.InstanceID, &packngo.AddressStruct{Address: instance.Spec.ReservedIPAddress})
+	if err != nil {
+		return status, errors.Wrapf(err, "error assigning address %s", instance.Spec.ReservedIPAddress)
+	}
+
+	status.ReservedIP = reservedIPStatus(assignment)
+	return status, nil
+}
+
+// UnassignReservedIP returns the address of the instance to its reservation
+func (m *MetalClient) UnassignReservedIP(instance *api.Instance) error {
+	if instance.Status.ReservedIP == nil || instance.Status.ReservedIP.AssignmentID == "" {
+		return nil
+	}
+
+	resp, err := m.DeviceIPs.Unassign(instance.Status.ReservedIP.AssignmentID)
+	if isNotFound(resp) {
+		return nil
+	}
+
+	return err
+}
+
+func reservedIPStatus(assignment *packngo.IPAddressAssignment) *api.ReservedIPStatus {
+	return &api.ReservedIPStatus{
+		AssignmentID: assignment.ID,
+		Address:      assignment.Address,
+		CIDR:         assignment.CIDR,
+		Gateway:      assignment.Gateway,
+	}
+}
+
+func isNotFound(resp *packngo.Response) bool {
+	return resp != nil && resp.Response != nil && resp.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,150 @@
+package equinix
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+)
+
+func TestAssignReservedIP(t *testing.T) {
+	existing := []packngo.IPAddressAssignment{
+		{IpAddressCommon: packngo.IpAddressCommon{ID: "public", Address: "147.75.0.2", Network: "147.75.0.0", CIDR: 31, Gateway: "147.75.0.1"}},
+		{IpAddressCommon: packngo.IpAddressCommon{ID: "subnet", Address: "147.75.1.9", Network: "147.75.1.8", CIDR: 29, Gateway: "147.75.1.8"}},
+		{IpAddressCommon: packngo.IpAddressCommon{ID: "single", Address: "147.75.2.5", Network: "147.75.2.5", CIDR: 32, Gateway: "147.75.2.5"}},
+	}
+
+	tests := []struct {
+		name         string
+		address      string
+		status       *api.ReservedIPStatus
+		wantAssigned string
+		want         *api.ReservedIPStatus
+	}{
+		{
+			name: "no reserved address",
+		},
+		{
+			name:    "already assigned",
+			address: "147.75.1.8/29",
+			status:  &api.ReservedIPStatus{AssignmentID: "subnet"},
+			want:    &api.ReservedIPStatus{AssignmentID: "subnet"},
+		},
+		{
+			name:    "existing subnet assignment is adopted",
+			address: "147.75.1.8/29",
+			want:    &api.ReservedIPStatus{AssignmentID: "subnet", Address: "147.75.1.9", CIDR: 29, Gateway: "147.75.1.8"},
+		},
+		{
+			name:    "existing address assignment is adopted",
+			address: "147.75.2.5/32",
+			want:    &api.ReservedIPStatus{AssignmentID: "single", Address: "147.75.2.5", CIDR: 32, Gateway: "147.75.2.5"},
+		},
+		{
+			name:         "new assignment",
+			address:      "147.75.3.4/32",
+			wantAssigned: "147.75.3.4/32",
+			want:         &api.ReservedIPStatus{AssignmentID: "assigned", Address: "147.75.3.4", CIDR: 32, Gateway: "147.75.3.4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var assigned string
+			mux := http.NewServeMux()
+			mux.HandleFunc("/devices/device/ips", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					json.NewEncoder(w).Encode(map[string][]packngo.IPAddressAssignment{"ip_addresses": existing})
+					return
+				}
+
+				request := packngo.AddressStruct{}
+				json.NewDecoder(r.Body).Decode(&request)
+				assigned = request.Address
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(packngo.IPAddressAssignment{IpAddressCommon: packngo.IpAddressCommon{
+					ID: "assigned", Address: "147.75.3.4", Network: "147.75.3.4", CIDR: 32, Gateway: "147.75.3.4",
+				}})
+			})
+
+			i := &api.Instance{Spec: api.InstanceSpec{ReservedIPAddress: tt.address}}
+			i.Status.InstanceID = "device"
+			i.Status.ReservedIP = tt.status
+
+			status, err := newTestClient(t, mux).AssignReservedIP(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assigned != tt.wantAssigned {
+				t.Errorf("AssignReservedIP() assigned %q, want %q", assigned, tt.wantAssigned)
+			}
+			if !reflect.DeepEqual(status.ReservedIP, tt.want) {
+				t.Errorf("AssignReservedIP() reservedIP = %+v, want %+v", status.ReservedIP, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnassignReservedIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       *api.ReservedIPStatus
+		responseCode int
+		wantCalled   bool
+		wantErr      bool
+	}{
+		{
+			name: "nothing assigned",
+		},
+		{
+			name:         "assignment removed",
+			status:       &api.ReservedIPStatus{AssignmentID: "assignment"},
+			responseCode: http.StatusNoContent,
+			wantCalled:   true,
+		},
+		{
+			name:         "assignment already gone",
+			status:       &api.ReservedIPStatus{AssignmentID: "assignment"},
+			responseCode: http.StatusNotFound,
+			wantCalled:   true,
+		},
+		{
+			name:         "api error",
+			status:       &api.ReservedIPStatus{AssignmentID: "assignment"},
+			responseCode: http.StatusInternalServerError,
+			wantCalled:   true,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			mux := http.NewServeMux()
+			mux.HandleFunc("/ips/assignment", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodDelete {
+					t.Errorf("unexpected %s request", r.Method)
+				}
+				called = true
+				w.WriteHeader(tt.responseCode)
+				if tt.responseCode != http.StatusNoContent {
+					json.NewEncoder(w).Encode(map[string][]string{"errors": {http.StatusText(tt.responseCode)}})
+				}
+			})
+
+			i := &api.Instance{}
+			i.Status.ReservedIP = tt.status
+
+			err := newTestClient(t, mux).UnassignReservedIP(i)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UnassignReservedIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("UnassignReservedIP() called the api %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
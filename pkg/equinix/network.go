@@ -0,0 +1,387 @@
+package equinix
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+// VLANBatchPollInterval is the interval instances with pending VLAN assignment batches are requeued at
+const VLANBatchPollInterval = 10 * time.Second
+
+// portVLANIncludes expands the VLANs attached to device ports, which are otherwise only
+// returned as references
+var portVLANIncludes = &packngo.GetOptions{Includes: []string{"network_ports.virtual_networks", "network_ports.native_virtual_network"}}
+
+var nativeVLAN = true
+
+// NetworkDrift captures the difference between the observed port configuration of a device
+// and the desired NetworkingConfiguration
+type NetworkDrift struct {
+	CurrentType   string
+	DesiredType   string
+	AssignVLANs   map[string][]string
+	UnassignVLANs map[string][]string
+	NativeVLANs   map[string]string
+}
+
+// TypeChanged returns true when the device needs to be converted to a different network type
+func (d *NetworkDrift) TypeChanged() bool {
+	return d.DesiredType != "" && !networkTypeMatches(d.CurrentType, d.DesiredType)
+}
+
+func (d *NetworkDrift) IsEmpty() bool {
+	return !d.TypeChanged() && len(d.AssignVLANs) == 0 && len(d.UnassignVLANs) == 0 && len(d.NativeVLANs) == 0
+}
+
+func (d *NetworkDrift) String() string {
+	var changes []string
+	if d.TypeChanged() {
+		changes = append(changes, fmt.Sprintf("network type %s, expected %s", d.CurrentType, d.DesiredType))
+	}
+
+	for _, port := range sortedKeys(d.UnassignVLANs) {
+		changes = append(changes, fmt.Sprintf("port %s has unexpected vlans %s", port, strings.Join(d.UnassignVLANs[port], ",")))
+	}
+
+	for _, port := range sortedKeys(d.AssignVLANs) {
+		changes = append(changes, fmt.Sprintf("port %s is missing vlans %s", port, strings.Join(d.AssignVLANs[port], ",")))
+	}
+
+	for _, port := range sortedNativeKeys(d.NativeVLANs) {
+		changes = append(changes, fmt.Sprintf("port %s native vlan is not %s", port, d.NativeVLANs[port]))
+	}
+
+	return strings.Join(changes, "; ")
+}
+
+// ComputeNetworkDrift compares the ports of a device against the desired network configuration.
+// The desired configuration is authoritative, VLANs attached to ports which are not listed
+// in the configuration are reported for removal.
+func ComputeNetworkDrift(device *packngo.Device, network api.NetworkingConfiguration) (*NetworkDrift, error) {
+	drift := &NetworkDrift{
+		CurrentType:   device.GetNetworkType(),
+		DesiredType:   network.Type,
+		AssignVLANs:   make(map[string][]string),
+		UnassignVLANs: make(map[string][]string),
+		NativeVLANs:   make(map[string]string),
+	}
+
+	desired := make(map[string][]string)
+	for _, netInterface := range network.Interfaces {
+		port, err := device.GetPortByName(netInterface.Name)
+		if err != nil {
+			return nil, err
+		}
+		desired[netInterface.Name] = append(desired[netInterface.Name], netInterface.VlanIDS...)
+
+		if netInterface.NativeVlan == "" {
+			continue
+		}
+
+		// the native vlan needs to be assigned to the port before it can be made native
+		if !containsString(desired[netInterface.Name], netInterface.NativeVlan) {
+			desired[netInterface.Name] = append(desired[netInterface.Name], netInterface.NativeVlan)
+		}
+
+		if port.NativeVirtualNetwork == nil || !containsVLAN([]string{netInterface.NativeVlan}, *port.NativeVirtualNetwork) {
+			drift.NativeVLANs[netInterface.Name] = netInterface.NativeVlan
+		}
+	}
+
+	for _, port := range device.NetworkPorts {
+		for _, vn := range port.AttachedVirtualNetworks {
+			if !containsVLAN(desired[port.Name], vn) {
+				drift.UnassignVLANs[port.Name] = append(drift.UnassignVLANs[port.Name], vlanName(vn))
+			}
+		}
+	}
+
+	for portName, vlans := range desired {
+		port, _ := device.GetPortByName(portName)
+		for _, vlan := range vlans {
+			if !portHasVLAN(port, vlan) {
+				drift.AssignVLANs[portName] = append(drift.AssignVLANs[portName], vlan)
+			}
+		}
+	}
+
+	return drift, nil
+}
+
+// ApplyNetworkDrift issues only the bond/disbond/assign/unassign calls needed to converge
+// the device, and returns the VLAN assignment batches which were submitted. VLANs are removed
+// before the network type is changed, as Metal refuses to convert ports with VLANs attached,
+// so a type change takes two passes: the removals are submitted first, and the device is only
+// converted once they are processed and the drift no longer contains them.
+func (m *MetalClient) ApplyNetworkDrift(device *packngo.Device, drift *NetworkDrift, addresses []api.IPAddressRequest) ([]api.VLANBatchStatus, error) {
+	if !drift.TypeChanged() {
+		// ports keep their mode, so assignments and removals can be batched together
+		return m.batchVLANAssignments(device, drift.AssignVLANs, drift.UnassignVLANs, drift.NativeVLANs)
+	}
+
+	if len(drift.UnassignVLANs) != 0 {
+		return m.batchVLANAssignments(device, nil, drift.UnassignVLANs, nil)
+	}
+
+	err := m.ConvertDevice(device, drift.DesiredType, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	// port state needs to be refreshed after bonding/disbonding
+	device, _, err = m.Devices.Get(device.ID, portVLANIncludes)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.batchVLANAssignments(device, drift.AssignVLANs, nil, drift.NativeVLANs)
+}
+
+// batchVLANAssignments submits a single VLAN assignment batch per port without waiting for Metal
+// to process it. Native VLANs are flagged on their assignment, or re-assigned as native if
+// they are already attached to the port.
+func (m *MetalClient) batchVLANAssignments(device *packngo.Device, assign, unassign map[string][]string, native map[string]string) ([]api.VLANBatchStatus, error) {
+	requests := make(map[string][]packngo.VLANAssignmentCreateRequest)
+	for portName, vlans := range unassign {
+		for _, vlan := range vlans {
+			requests[portName] = append(requests[portName], packngo.VLANAssignmentCreateRequest{
+				VLAN:  vlan,
+				State: packngo.VLANAssignmentUnassigned,
+			})
+		}
+	}
+
+	for portName, vlans := range assign {
+		for _, vlan := range vlans {
+			request := packngo.VLANAssignmentCreateRequest{
+				VLAN:  vlan,
+				State: packngo.VLANAssignmentAssigned,
+			}
+			if native[portName] == vlan {
+				request.Native = &nativeVLAN
+			}
+			requests[portName] = append(requests[portName], request)
+		}
+	}
+
+	for portName, vlan := range native {
+		if containsString(assign[portName], vlan) {
+			continue
+		}
+		requests[portName] = append(requests[portName], packngo.VLANAssignmentCreateRequest{
+			VLAN:   vlan,
+			State:  packngo.VLANAssignmentAssigned,
+			Native: &nativeVLAN,
+		})
+	}
+
+	var batches []api.VLANBatchStatus
+	for _, portName := range sortedBatchKeys(requests) {
+		port, err := device.GetPortByName(portName)
+		if err != nil {
+			return batches, err
+		}
+
+		batch, _, err := m.VLANAssignments.CreateBatch(port.ID, &packngo.VLANAssignmentBatchCreateRequest{
+			VLANAssignments: requests[portName],
+		}, nil)
+		if err != nil {
+			return batches, errors.Wrapf(err, "error creating vlan assignment batch for port %s", portName)
+		}
+
+		batches = append(batches, api.VLANBatchStatus{
+			Port:    portName,
+			PortID:  port.ID,
+			BatchID: batch.ID,
+		})
+	}
+
+	return batches, nil
+}
+
+// CheckVLANBatches returns the batches which Metal has not processed yet. A failed batch is
+// dropped and reported as error, so the next reconcile recomputes the drift and resubmits it.
+func (m *MetalClient) CheckVLANBatches(batches []api.VLANBatchStatus) ([]api.VLANBatchStatus, error) {
+	var pending []api.VLANBatchStatus
+	var failed []string
+	for _, b := range batches {
+		batch, resp, err := m.VLANAssignments.GetBatch(b.PortID, b.BatchID, nil)
+		if isNotFound(resp) {
+			continue
+		}
+		if err != nil {
+			return batches, errors.Wrapf(err, "error checking vlan assignment batch %s of port %s", b.BatchID, b.Port)
+		}
+
+		switch batch.State {
+		case packngo.VLANAssignmentBatchCompleted:
+		case packngo.VLANAssignmentBatchFailed:
+			failed = append(failed, fmt.Sprintf("vlan assignment batch %s of port %s failed: %s", b.BatchID, b.Port, strings.Join(batch.ErrorMessages, ", ")))
+		default:
+			pending = append(pending, b)
+		}
+	}
+
+	if len(failed) != 0 {
+		return pending, errors.New(strings.Join(failed, "; "))
+	}
+
+	return pending, nil
+}
+
+// PortStatus returns the VLANs attached to each port of the device
+func PortStatus(device *packngo.Device) []api.PortStatus {
+	var ports []api.PortStatus
+	for _, port := range device.NetworkPorts {
+		p := api.PortStatus{
+			Name: port.Name,
+			MAC:  port.Data.MAC,
+		}
+
+		if port.Bond != nil {
+			p.Bond = port.Bond.Name
+		}
+
+		for _, vn := range port.AttachedVirtualNetworks {
+			p.VLANs = append(p.VLANs, vlanName(vn))
+		}
+
+		if port.NativeVirtualNetwork != nil {
+			p.NativeVLAN = vlanName(*port.NativeVirtualNetwork)
+		}
+		ports = append(ports, p)
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Name < ports[j].Name
+	})
+	return ports
+}
+
+// ReconcileNetworkConfig reads the current port state of the device backing the instance and
+// converges it with the NetworkingConfiguration. The drift observed before any changes were
+// applied is returned to allow callers to report it. Nothing is changed while VLAN assignment
+// batches of an earlier pass are pending, they are recorded in the returned status.
+func (m *MetalClient) ReconcileNetworkConfig(instance *api.Instance) (status *api.InstanceStatus, drift *NetworkDrift, err error) {
+	status = instance.Status.DeepCopy()
+	status.VLANBatches, err = m.CheckVLANBatches(status.VLANBatches)
+	if err != nil || len(status.VLANBatches) != 0 {
+		return status, nil, err
+	}
+
+	device, _, err := m.Devices.Get(instance.Status.InstanceID, portVLANIncludes)
+	if err != nil {
+		return status, nil, err
+	}
+
+	drift, err = ComputeNetworkDrift(device, instance.Spec.NetworkingConfiguration)
+	if err != nil {
+		return status, nil, err
+	}
+
+	status.NetworkType = drift.CurrentType
+	status.Ports = PortStatus(device)
+	status.Addresses = addressStatus(device)
+	if drift.IsEmpty() {
+		return status, drift, nil
+	}
+
+	status.VLANBatches, err = m.ApplyNetworkDrift(device, drift, instance.Spec.IPAddresses)
+	if err != nil {
+		return status, drift, err
+	}
+
+	device, _, err = m.Devices.Get(instance.Status.InstanceID, portVLANIncludes)
+	if err != nil {
+		return status, drift, err
+	}
+
+	status.NetworkType = device.GetNetworkType()
+	status.Ports = PortStatus(device)
+	status.Addresses = addressStatus(device)
+	return status, drift, nil
+}
+
+// networkTypeMatches accounts for hybrid-bonded, which Metal reports as layer3 since the
+// bond is intact and only differs by the VLANs attached to bond0
+func networkTypeMatches(current, desired string) bool {
+	if desired == "hybrid-bonded" {
+		return current == packngo.NetworkTypeL3 || current == desired
+	}
+
+	return current == desired
+}
+
+// containsVLAN matches a VLAN either by its VXLAN id or by its UUID, as both are accepted
+// by the Metal port assignment API
+func containsVLAN(vlans []string, vn packngo.VirtualNetwork) bool {
+	for _, vlan := range vlans {
+		if vlan == vn.ID || vlan == strconv.Itoa(vn.VXLAN) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func portHasVLAN(port *packngo.Port, vlan string) bool {
+	for _, vn := range port.AttachedVirtualNetworks {
+		if containsVLAN([]string{vlan}, vn) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func vlanName(vn packngo.VirtualNetwork) string {
+	if vn.VXLAN != 0 {
+		return strconv.Itoa(vn.VXLAN)
+	}
+
+	return vn.ID
+}
+
+func sortedBatchKeys(m map[string][]packngo.VLANAssignmentCreateRequest) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedNativeKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(arr []string, key string) bool {
+	for _, v := range arr {
+		if v == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
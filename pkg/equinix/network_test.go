@@ -0,0 +1,199 @@
+package equinix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"github.com/packethost/packngo"
+)
+
+func newTestClient(t *testing.T, handler http.Handler) *MetalClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := packngo.NewClientWithBaseURL("test", "token", server.Client(), server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &MetalClient{Client: client, ProjectID: "project"}
+}
+
+func TestCheckVLANBatches(t *testing.T) {
+	states := map[string]packngo.VLANAssignmentBatchState{
+		"queued":    packngo.VLANAssignmentBatchQueued,
+		"completed": packngo.VLANAssignmentBatchCompleted,
+		"failed":    packngo.VLANAssignmentBatchFailed,
+	}
+
+	m := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, ok := states[path.Base(r.URL.Path)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":["not found"]}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(packngo.VLANAssignmentBatch{
+			ID:            path.Base(r.URL.Path),
+			State:         state,
+			ErrorMessages: []string{"vlan not found"},
+		})
+	}))
+
+	batch := func(id string) api.VLANBatchStatus {
+		return api.VLANBatchStatus{Port: "eth1", PortID: "port", BatchID: id}
+	}
+
+	tests := []struct {
+		name    string
+		batches []api.VLANBatchStatus
+		pending []api.VLANBatchStatus
+		wantErr bool
+	}{
+		{
+			name: "no batches",
+		},
+		{
+			name:    "queued batch is pending",
+			batches: []api.VLANBatchStatus{batch("queued"), batch("completed")},
+			pending: []api.VLANBatchStatus{batch("queued")},
+		},
+		{
+			name:    "missing batch is dropped",
+			batches: []api.VLANBatchStatus{batch("missing")},
+		},
+		{
+			name:    "failed batch is dropped and reported",
+			batches: []api.VLANBatchStatus{batch("failed"), batch("queued")},
+			pending: []api.VLANBatchStatus{batch("queued")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending, err := m.CheckVLANBatches(tt.batches)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckVLANBatches() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(pending, tt.pending) {
+				t.Errorf("CheckVLANBatches() = %v, want %v", pending, tt.pending)
+			}
+		})
+	}
+}
+
+func TestComputeNetworkDrift(t *testing.T) {
+	vlan := func(vxlan int) packngo.VirtualNetwork {
+		return packngo.VirtualNetwork{ID: "vlan-" + strconv.Itoa(vxlan), VXLAN: vxlan}
+	}
+
+	device := func(slug string, eth1 ...packngo.VirtualNetwork) *packngo.Device {
+		return &packngo.Device{
+			ID:   "device",
+			Plan: &packngo.Plan{Slug: slug},
+			NetworkPorts: []packngo.Port{
+				{ID: "bond0", Name: "bond0", Type: "NetworkBondPort"},
+				{ID: "eth1", Name: "eth1", Type: "NetworkPort", AttachedVirtualNetworks: eth1},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		device  *packngo.Device
+		network api.NetworkingConfiguration
+		want    *NetworkDrift
+		wantErr bool
+	}{
+		{
+			name:    "in sync",
+			device:  device("baremetal_1e", vlan(100)),
+			network: api.NetworkingConfiguration{Type: packngo.NetworkTypeHybrid, Interfaces: []api.InterfaceConfiguration{{Name: "eth1", VlanIDS: []string{"100"}}}},
+			want:    &NetworkDrift{CurrentType: packngo.NetworkTypeHybrid, DesiredType: packngo.NetworkTypeHybrid},
+		},
+		{
+			name:    "vlans matched by id",
+			device:  device("baremetal_1e", vlan(100)),
+			network: api.NetworkingConfiguration{Type: packngo.NetworkTypeHybrid, Interfaces: []api.InterfaceConfiguration{{Name: "eth1", VlanIDS: []string{"vlan-100"}}}},
+			want:    &NetworkDrift{CurrentType: packngo.NetworkTypeHybrid, DesiredType: packngo.NetworkTypeHybrid},
+		},
+		{
+			name:    "missing and unexpected vlans",
+			device:  device("baremetal_1e", vlan(100), vlan(200)),
+			network: api.NetworkingConfiguration{Type: packngo.NetworkTypeHybrid, Interfaces: []api.InterfaceConfiguration{{Name: "eth1", VlanIDS: []string{"100", "300"}}}},
+			want: &NetworkDrift{
+				CurrentType:   packngo.NetworkTypeHybrid,
+				DesiredType:   packngo.NetworkTypeHybrid,
+				AssignVLANs:   map[string][]string{"eth1": {"300"}},
+				UnassignVLANs: map[string][]string{"eth1": {"200"}},
+			},
+		},
+		{
+			name:    "native vlan is assigned",
+			device:  device("baremetal_1e"),
+			network: api.NetworkingConfiguration{Type: packngo.NetworkTypeHybrid, Interfaces: []api.InterfaceConfiguration{{Name: "eth1", NativeVlan: "100"}}},
+			want: &NetworkDrift{
+				CurrentType: packngo.NetworkTypeHybrid,
+				DesiredType: packngo.NetworkTypeHybrid,
+				AssignVLANs: map[string][]string{"eth1": {"100"}},
+				NativeVLANs: map[string]string{"eth1": "100"},
+			},
+		},
+		{
+			name:    "type change removes vlans of unlisted ports",
+			device:  device("baremetal_1e", vlan(100)),
+			network: api.NetworkingConfiguration{Type: packngo.NetworkTypeL3},
+			want: &NetworkDrift{
+				CurrentType:   packngo.NetworkTypeHybrid,
+				DesiredType:   packngo.NetworkTypeL3,
+				UnassignVLANs: map[string][]string{"eth1": {"100"}},
+			},
+		},
+		{
+			name:    "hybrid-bonded matches layer3",
+			device:  device("baremetal_0"),
+			network: api.NetworkingConfiguration{Type: "hybrid-bonded"},
+			want:    &NetworkDrift{CurrentType: packngo.NetworkTypeL3, DesiredType: "hybrid-bonded"},
+		},
+		{
+			name:    "unknown port",
+			device:  device("baremetal_1e"),
+			network: api.NetworkingConfiguration{Type: packngo.NetworkTypeHybrid, Interfaces: []api.InterfaceConfiguration{{Name: "eth2", VlanIDS: []string{"100"}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ComputeNetworkDrift(tt.device, tt.network)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ComputeNetworkDrift() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for _, m := range []*map[string][]string{&tt.want.AssignVLANs, &tt.want.UnassignVLANs} {
+				if *m == nil {
+					*m = map[string][]string{}
+				}
+			}
+			if tt.want.NativeVLANs == nil {
+				tt.want.NativeVLANs = map[string]string{}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ComputeNetworkDrift() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package equinix
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DefaultInstallDevice = "/dev/sda"
+	DefaultTTY           = "ttyS1,115200n8"
+	DefaultArmTTY        = "ttyAMA0,115200"
+	DefaultManagementNIC = "eth0"
+	driveTypeNVMe        = "NVME"
+	driveSizeUnits       = "KMGTP"
+	// HoursPerMonth converts hourly prices of plans without a monthly price
+	HoursPerMonth = 730
+	// PlanCacheTTL is how long the plans of a project are cached per credential
+	PlanCacheTTL = time.Hour
+)
+
+type cachedPlans struct {
+	plans   []packngo.Plan
+	expires time.Time
+}
+
+var (
+	planCache     = make(map[string]cachedPlans)
+	planCacheLock sync.Mutex
+)
+
+// PlanProfile describes the hardware layout of a Metal plan needed to install Harvester on it,
+// and the price of the plan used to estimate the cost of instances
+type PlanProfile struct {
+	Device       string   `json:"device,omitempty"`
+	DataDisks    []string `json:"dataDisks,omitempty"`
+	TTY          string   `json:"tty,omitempty"`
+	Interfaces   []string `json:"interfaces,omitempty"`
+	HourlyPrice  float64  `json:"hourlyPrice,omitempty"`
+	MonthlyPrice float64  `json:"monthlyPrice,omitempty"`
+}
+
+// DefaultPlanProfile is used for plans which are neither returned by the plans api nor overridden
+func DefaultPlanProfile() *PlanProfile {
+	return &PlanProfile{
+		Device:     DefaultInstallDevice,
+		TTY:        DefaultTTY,
+		Interfaces: []string{DefaultManagementNIC},
+	}
+}
+
+// PlanCatalogue returns the profiles of all plans available to the project, keyed by plan slug
+func (m *MetalClient) PlanCatalogue() (map[string]*PlanProfile, error) {
+	plans, err := m.projectPlans()
+	if err != nil {
+		return nil, err
+	}
+
+	catalogue := make(map[string]*PlanProfile, len(plans))
+	for i := range plans {
+		catalogue[plans[i].Slug] = ProfileFromPlan(&plans[i])
+	}
+
+	return catalogue, nil
+}
+
+// projectPlans lists the plans available to the project, which are cached for PlanCacheTTL as
+// they rarely change but are looked up whenever instances are submitted
+func (m *MetalClient) projectPlans() ([]packngo.Plan, error) {
+	key := m.credential + "/" + m.ProjectID
+	planCacheLock.Lock()
+	cached, ok := planCache[key]
+	planCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.plans, nil
+	}
+
+	plans, _, err := m.Plans.ProjectList(m.ProjectID, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing plans")
+	}
+
+	planCacheLock.Lock()
+	planCache[key] = cachedPlans{plans: plans, expires: time.Now().Add(PlanCacheTTL)}
+	planCacheLock.Unlock()
+	return plans, nil
+}
+
+// ProfileFromPlan derives the install layout from the plan specs. Harvester is installed on the
+// first of the smallest drives, while its siblings and the drives of the other groups are made
+// available as data disks. SATA drives are named in the order the plan lists them, NVMe drives
+// are named separately. The management interfaces are the ports of bond0, eth0 and eth1, on
+// plans with more than one NIC.
+func ProfileFromPlan(plan *packngo.Plan) *PlanProfile {
+	profile := DefaultPlanProfile()
+	if strings.Contains(plan.Slug, "arm") || strings.Contains(strings.ToLower(plan.Line), "arm") {
+		profile.TTY = DefaultArmTTY
+	}
+
+	if plan.Pricing != nil {
+		profile.HourlyPrice = float64(plan.Pricing.Hour)
+		profile.MonthlyPrice = float64(plan.Pricing.Month)
+	}
+
+	if plan.Specs == nil {
+		return profile
+	}
+
+	nics := 0
+	for _, nic := range plan.Specs.Nics {
+		if nic != nil {
+			nics += nic.Count
+		}
+	}
+	if nics > 1 {
+		profile.Interfaces = []string{DefaultManagementNIC, "eth1"}
+	}
+
+	if len(plan.Specs.Drives) == 0 {
+		return profile
+	}
+
+	type driveGroup struct {
+		devices []string
+		size    float64
+	}
+
+	var groups []driveGroup
+	sata, nvme := 0, 0
+	for _, drive := range plan.Specs.Drives {
+		if drive == nil || drive.Count == 0 {
+			continue
+		}
+
+		group := driveGroup{size: parseDriveSize(drive.Size)}
+		for i := 0; i < drive.Count; i++ {
+			if strings.EqualFold(drive.Type, driveTypeNVMe) {
+				group.devices = append(group.devices, fmt.Sprintf("/dev/nvme%dn1", nvme))
+				nvme++
+			} else {
+				group.devices = append(group.devices, "/dev/sd"+string(rune('a'+sata)))
+				sata++
+			}
+		}
+		groups = append(groups, group)
+	}
+
+	if len(groups) == 0 {
+		return profile
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].size < groups[j].size
+	})
+
+	profile.Device = groups[0].devices[0]
+	profile.DataDisks = append(profile.DataDisks, groups[0].devices[1:]...)
+	for _, group := range groups[1:] {
+		profile.DataDisks = append(profile.DataDisks, group.devices...)
+	}
+
+	return profile
+}
+
+// Merge overrides the fields of the profile which are set in override
+func (p *PlanProfile) Merge(override *PlanProfile) {
+	if override.Device != "" {
+		p.Device = override.Device
+	}
+
+	if override.DataDisks != nil {
+		p.DataDisks = override.DataDisks
+	}
+
+	if override.TTY != "" {
+		p.TTY = override.TTY
+	}
+
+	if len(override.Interfaces) != 0 {
+		p.Interfaces = override.Interfaces
+	}
+
+	// an overridden hourly price without monthly price also overrides the monthly price
+	if override.HourlyPrice != 0 {
+		p.HourlyPrice = override.HourlyPrice
+		p.MonthlyPrice = 0
+	}
+
+	if override.MonthlyPrice != 0 {
+		p.MonthlyPrice = override.MonthlyPrice
+	}
+}
+
+// Monthly returns the monthly price of the plan, derived from the hourly price if the plan has none
+func (p *PlanProfile) Monthly() float64 {
+	if p.MonthlyPrice != 0 {
+		return p.MonthlyPrice
+	}
+
+	return p.HourlyPrice * HoursPerMonth
+}
+
+// parseDriveSize converts plan drive sizes such as 240GB or 3.8TB to kilobytes
+func parseDriveSize(size string) float64 {
+	size = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	if size == "" {
+		return 0
+	}
+
+	multiplier := 1.0
+	unit := strings.IndexByte(driveSizeUnits, size[len(size)-1])
+	if unit >= 0 {
+		size = size[:len(size)-1]
+		for i := 0; i < unit; i++ {
+			multiplier *= 1000
+		}
+	}
+
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return 0
+	}
+
+	return value * multiplier
+}
+
+// ParsePlanProfile reads a profile override of the plan catalogue ConfigMap
+func ParsePlanProfile(data string) (*PlanProfile, error) {
+	profile := &PlanProfile{}
+	if err := yaml.UnmarshalStrict([]byte(data), profile); err != nil {
+		return nil, errors.Wrap(err, "invalid plan profile")
+	}
+
+	return profile, nil
+}
@@ -0,0 +1,88 @@
+package equinix
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo"
+)
+
+func TestProfileFromPlan(t *testing.T) {
+	tests := []struct {
+		name string
+		plan *packngo.Plan
+		want *PlanProfile
+	}{
+		{
+			name: "no specs",
+			plan: &packngo.Plan{Slug: "c3.small.x86"},
+			want: DefaultPlanProfile(),
+		},
+		{
+			name: "pricing",
+			plan: &packngo.Plan{Slug: "c3.small.x86", Pricing: &packngo.Pricing{Hour: 0.5, Month: 350}},
+			want: &PlanProfile{Device: DefaultInstallDevice, TTY: DefaultTTY, Interfaces: []string{"eth0"}, HourlyPrice: 0.5, MonthlyPrice: 350},
+		},
+		{
+			name: "single drive and nic",
+			plan: &packngo.Plan{Slug: "t1.small.x86", Specs: &packngo.Specs{
+				Drives: []*packngo.Drives{{Count: 1, Size: "80GB", Type: "SSD"}},
+				Nics:   []*packngo.Nics{{Count: 1, Type: "1Gbps"}},
+			}},
+			want: &PlanProfile{Device: "/dev/sda", TTY: DefaultTTY, Interfaces: []string{"eth0"}},
+		},
+		{
+			name: "bonded nics",
+			plan: &packngo.Plan{Slug: "c3.small.x86", Specs: &packngo.Specs{
+				Nics: []*packngo.Nics{{Count: 2, Type: "10Gbps"}},
+			}},
+			want: &PlanProfile{Device: DefaultInstallDevice, TTY: DefaultTTY, Interfaces: []string{"eth0", "eth1"}},
+		},
+		{
+			name: "install on smallest group and siblings as data disks",
+			plan: &packngo.Plan{Slug: "s3.xlarge.x86", Specs: &packngo.Specs{
+				Drives: []*packngo.Drives{
+					{Count: 12, Size: "8TB", Type: "HDD"},
+					{Count: 2, Size: "960GB", Type: "SSD"},
+					{Count: 2, Size: "240GB", Type: "SSD"},
+				},
+			}},
+			want: &PlanProfile{
+				Device: "/dev/sdo",
+				DataDisks: []string{"/dev/sdp", "/dev/sdm", "/dev/sdn",
+					"/dev/sda", "/dev/sdb", "/dev/sdc", "/dev/sdd", "/dev/sde", "/dev/sdf",
+					"/dev/sdg", "/dev/sdh", "/dev/sdi", "/dev/sdj", "/dev/sdk", "/dev/sdl"},
+				TTY:        DefaultTTY,
+				Interfaces: []string{"eth0"},
+			},
+		},
+		{
+			name: "nvme drives are named separately",
+			plan: &packngo.Plan{Slug: "m3.large.x86", Specs: &packngo.Specs{
+				Drives: []*packngo.Drives{
+					{Count: 2, Size: "3.8TB", Type: "NVME"},
+					{Count: 2, Size: "240GB", Type: "SSD"},
+				},
+			}},
+			want: &PlanProfile{
+				Device:     "/dev/sda",
+				DataDisks:  []string{"/dev/sdb", "/dev/nvme0n1", "/dev/nvme1n1"},
+				TTY:        DefaultTTY,
+				Interfaces: []string{"eth0"},
+			},
+		},
+		{
+			name: "arm console",
+			plan: &packngo.Plan{Slug: "c3.large.arm64"},
+			want: &PlanProfile{Device: DefaultInstallDevice, TTY: DefaultArmTTY, Interfaces: []string{"eth0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ProfileFromPlan(tt.plan); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ProfileFromPlan() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package equinix
+
+import (
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+// ResolveSSHKeys returns the public keys of the referenced Metal user and project keys. Like the
+// device api, all keys of the project are used when no keys are referenced, unless noSSHKeys is set.
+func (m *MetalClient) ResolveSSHKeys(userKeys, projectKeys []string, noSSHKeys bool) ([]string, error) {
+	if noSSHKeys {
+		return nil, nil
+	}
+
+	if len(userKeys) == 0 && len(projectKeys) == 0 {
+		keys, _, err := m.SSHKeys.ProjectList(m.ProjectID)
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing project ssh keys")
+		}
+		return sshKeyValues(keys), nil
+	}
+
+	var keys []packngo.SSHKey
+	for _, id := range append(append([]string{}, userKeys...), projectKeys...) {
+		key, _, err := m.SSHKeys.Get(id, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error looking up ssh key %s", id)
+		}
+		keys = append(keys, *key)
+	}
+
+	return sshKeyValues(keys), nil
+}
+
+func sshKeyValues(keys []packngo.SSHKey) []string {
+	var values []string
+	for _, key := range keys {
+		values = append(values, key.Key)
+	}
+
+	return values
+}
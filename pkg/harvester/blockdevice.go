@@ -0,0 +1,99 @@
+package harvester
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	BlockDeviceNamespace   = "longhorn-system"
+	DeviceTypeDisk         = "disk"
+	ProvisionPhaseComplete = "Provisioned"
+)
+
+var BlockDeviceResource = schema.GroupVersionResource{
+	Group:    "harvesterhci.io",
+	Version:  "v1beta1",
+	Resource: "blockdevices",
+}
+
+// BlockDevice is the subset of a node-disk-manager BlockDevice needed to provision data disks
+type BlockDevice struct {
+	Name        string
+	NodeName    string
+	DevPath     string
+	DeviceType  string
+	SizeBytes   int64
+	Provisioned bool
+	Phase       string
+}
+
+// BlockDeviceClient manages the BlockDevices discovered by the harvester node-disk-manager
+type BlockDeviceClient struct {
+	client dynamic.ResourceInterface
+}
+
+func NewBlockDeviceClient(client dynamic.Interface) *BlockDeviceClient {
+	return &BlockDeviceClient{
+		client: client.Resource(BlockDeviceResource).Namespace(BlockDeviceNamespace),
+	}
+}
+
+// List returns the block devices discovered on a node
+func (b *BlockDeviceClient) List(ctx context.Context, nodeName string) ([]BlockDevice, error) {
+	list, err := b.client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []BlockDevice
+	for _, obj := range list.Items {
+		device := blockDevice(&obj)
+		if device.NodeName == nodeName {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices, nil
+}
+
+// Provision asks the node-disk-manager to format and mount the block device, after which it is
+// added to the Longhorn node as a data disk
+func (b *BlockDeviceClient) Provision(ctx context.Context, name string, forceFormatted bool) error {
+	obj, err := b.client.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if err := unstructured.SetNestedField(obj.Object, true, "spec", "fileSystem", "provisioned"); err != nil {
+		return fmt.Errorf("error updating blockdevice %s: %v", name, err)
+	}
+
+	if forceFormatted {
+		if err := unstructured.SetNestedField(obj.Object, true, "spec", "fileSystem", "forceFormatted"); err != nil {
+			return fmt.Errorf("error updating blockdevice %s: %v", name, err)
+		}
+	}
+
+	_, err = b.client.Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+func blockDevice(obj *unstructured.Unstructured) BlockDevice {
+	device := BlockDevice{Name: obj.GetName()}
+	device.NodeName, _, _ = unstructured.NestedString(obj.Object, "spec", "nodeName")
+	device.DevPath, _, _ = unstructured.NestedString(obj.Object, "status", "deviceStatus", "devPath")
+	if device.DevPath == "" {
+		device.DevPath, _, _ = unstructured.NestedString(obj.Object, "spec", "devPath")
+	}
+	device.DeviceType, _, _ = unstructured.NestedString(obj.Object, "status", "deviceStatus", "details", "deviceType")
+	device.SizeBytes, _, _ = unstructured.NestedInt64(obj.Object, "status", "deviceStatus", "capacity", "sizeBytes")
+	device.Provisioned, _, _ = unstructured.NestedBool(obj.Object, "spec", "fileSystem", "provisioned")
+	device.Phase, _, _ = unstructured.NestedString(obj.Object, "status", "provisionPhase")
+	return device
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/imdario/mergo"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -98,6 +99,8 @@ type OS struct {
 	Wifi           []Wifi            `json:"wifi,omitempty"`
 	Password       string            `json:"password,omitempty"`
 	Environment    map[string]string `json:"environment,omitempty"`
+
+	AfterInstallChrootCommands []string `json:"afterInstallChrootCommands,omitempty"`
 }
 
 type HarvesterConfig struct {
@@ -121,6 +124,36 @@ func (c *HarvesterConfig) DeepCopy() (*HarvesterConfig, error) {
 	return newConf, nil
 }
 
+// ParseHarvesterConfig reads a partial harvester config using the field names of the harvester
+// configuration file, e.g. os.ntpServers or install.webhooks
+func ParseHarvesterConfig(data string) (*HarvesterConfig, error) {
+	c := NewHarvesterConfig()
+	if err := yaml.UnmarshalStrict([]byte(data), c); err != nil {
+		return nil, fmt.Errorf("invalid harvester config: %s", err.Error())
+	}
+	return c, nil
+}
+
+// MergeOverride deep merges override onto the config. Fields set in override take precedence and
+// lists replace the generated ones, except for the fields managed by the operator: the join token
+// and server url, the hostname and the install networks.
+func (c *HarvesterConfig) MergeOverride(override *HarvesterConfig) error {
+	o, err := override.DeepCopy()
+	if err != nil {
+		return err
+	}
+
+	o.ServerURL = ""
+	o.Token = ""
+	o.Hostname = ""
+	o.Networks = nil
+
+	if err := mergo.Merge(c, o, mergo.WithOverride); err != nil {
+		return fmt.Errorf("fail to merge harvester config override: %s", err.Error())
+	}
+	return nil
+}
+
 func (c *HarvesterConfig) sanitized() (*HarvesterConfig, error) {
 	copied, err := c.DeepCopy()
 	if err != nil {
@@ -0,0 +1,82 @@
+package harvester
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeOverride(t *testing.T) {
+	generated := func() *HarvesterConfig {
+		return &HarvesterConfig{
+			ServerURL: "https://10.0.0.1:8443",
+			Token:     "token",
+			OS: OS{
+				Hostname:          "node-1",
+				SSHAuthorizedKeys: []string{"ssh-ed25519 generated"},
+				NTPServers:        []string{"0.pool.ntp.org"},
+			},
+			Install: Install{
+				Mode:     "join",
+				Device:   "/dev/sda",
+				Networks: map[string]Network{"harvester-mgmt": {Method: "dhcp"}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		override *HarvesterConfig
+		want     func(c *HarvesterConfig)
+	}{
+		{
+			name:     "empty override",
+			override: &HarvesterConfig{},
+			want:     func(c *HarvesterConfig) {},
+		},
+		{
+			name: "fields take precedence",
+			override: &HarvesterConfig{
+				OS:      OS{Environment: map[string]string{"HTTP_PROXY": "http://proxy:3128"}},
+				Install: Install{Device: "/dev/nvme0n1"},
+			},
+			want: func(c *HarvesterConfig) {
+				c.Environment = map[string]string{"HTTP_PROXY": "http://proxy:3128"}
+				c.Install.Device = "/dev/nvme0n1"
+			},
+		},
+		{
+			name: "lists replace the generated ones",
+			override: &HarvesterConfig{
+				OS: OS{SSHAuthorizedKeys: []string{"ssh-ed25519 override"}},
+			},
+			want: func(c *HarvesterConfig) {
+				c.SSHAuthorizedKeys = []string{"ssh-ed25519 override"}
+			},
+		},
+		{
+			name: "operator managed fields are ignored",
+			override: &HarvesterConfig{
+				ServerURL: "https://10.0.0.2:8443",
+				Token:     "other",
+				OS:        OS{Hostname: "other"},
+				Install:   Install{Networks: map[string]Network{"harvester-mgmt": {Method: "static"}}},
+			},
+			want: func(c *HarvesterConfig) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generated()
+			if err := got.MergeOverride(tt.override); err != nil {
+				t.Fatal(err)
+			}
+
+			want := generated()
+			tt.want(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("MergeOverride() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package harvester
+
+import (
+	"context"
+	"encoding/json"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+var LonghornNodeResource = schema.GroupVersionResource{
+	Group:    "longhorn.io",
+	Version:  "v1beta1",
+	Resource: "nodes",
+}
+
+var LonghornReplicaResource = schema.GroupVersionResource{
+	Group:    "longhorn.io",
+	Version:  "v1beta1",
+	Resource: "replicas",
+}
+
+// NodeStorage is the storage capacity of the Longhorn disks of a node, in bytes
+type NodeStorage struct {
+	Maximum   int64
+	Available int64
+}
+
+// LonghornNodeClient reads the disk usage reported by Longhorn, and moves the replicas off nodes
+// which are removed
+type LonghornNodeClient struct {
+	client   dynamic.ResourceInterface
+	replicas dynamic.ResourceInterface
+}
+
+func NewLonghornNodeClient(client dynamic.Interface) *LonghornNodeClient {
+	return &LonghornNodeClient{
+		client:   client.Resource(LonghornNodeResource).Namespace(BlockDeviceNamespace),
+		replicas: client.Resource(LonghornReplicaResource).Namespace(BlockDeviceNamespace),
+	}
+}
+
+// Storage returns the storage of the Longhorn disks of every node, keyed by node name
+func (l *LonghornNodeClient) Storage(ctx context.Context) (map[string]NodeStorage, error) {
+	list, err := l.client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	storage := make(map[string]NodeStorage, len(list.Items))
+	for _, obj := range list.Items {
+		disks, _, _ := unstructured.NestedMap(obj.Object, "status", "diskStatus")
+		var node NodeStorage
+		for name := range disks {
+			maximum, _, _ := unstructured.NestedInt64(disks, name, "storageMaximum")
+			available, _, _ := unstructured.NestedInt64(disks, name, "storageAvailable")
+			node.Maximum += maximum
+			node.Available += available
+		}
+		storage[obj.GetName()] = node
+	}
+
+	return storage, nil
+}
+
+// SetEviction requests Longhorn to move the replicas of the node to other nodes and stop scheduling
+// replicas on it, or cancels the request. Nodes unknown to Longhorn are ignored.
+func (l *LonghornNodeClient) SetEviction(ctx context.Context, node string, evict bool) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"allowScheduling":   !evict,
+			"evictionRequested": evict,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = l.client.Patch(ctx, node, types.MergePatchType, patch, metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Replicas returns the number of Longhorn replicas on the node
+func (l *LonghornNodeClient) Replicas(ctx context.Context, node string) (int, error) {
+	list, err := l.replicas.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, obj := range list.Items {
+		if nodeID, _, _ := unstructured.NestedString(obj.Object, "spec", "nodeID"); nodeID == node {
+			count++
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,65 @@
+package harvester
+
+import (
+	"fmt"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ReleaseBaseURL = "https://releases.rancher.com/harvester"
+	// MetadataUserDataURL serves the userdata of a device, which holds the harvester config of the node
+	MetadataUserDataURL = "https://metadata.platformequinix.com/userdata"
+)
+
+// ipxeScriptTemplate boots the harvester installer, which reads its config from the device userdata
+const ipxeScriptTemplate = `#!ipxe
+dhcp
+kernel %s initrd=initrd ip=dhcp net.ifnames=1 rd.cos.disable rd.noverifyssl console=tty1 console=%s root=live:%s harvester.install.automatic=true harvester.install.config_url=%s
+initrd --name initrd %s
+boot
+`
+
+// IPXEScript renders the iPXE script installing harvester from the given kernel, initrd and rootfs
+func IPXEScript(kernelURL, initrdURL, rootFSURL, tty string) string {
+	return fmt.Sprintf(ipxeScriptTemplate, kernelURL, tty, rootFSURL, MetadataUserDataURL, initrdURL)
+}
+
+// DefaultRelease returns the artifact urls of a version published on the harvester release server
+func DefaultRelease(version string) *api.HarvesterRelease {
+	base := fmt.Sprintf("%s/%s/harvester-%s", ReleaseBaseURL, version, version)
+	return &api.HarvesterRelease{
+		Version:   version,
+		ISOURL:    base + "-amd64.iso",
+		KernelURL: base + "-vmlinuz-amd64",
+		InitrdURL: base + "-initrd-amd64",
+		RootFSURL: base + "-rootfs-amd64.squashfs",
+	}
+}
+
+// ParseRelease reads a version catalogue entry. Artifacts which are not listed default to the
+// ones published on the harvester release server.
+func ParseRelease(version, data string) (*api.HarvesterRelease, error) {
+	release := &api.HarvesterRelease{}
+	if err := yaml.UnmarshalStrict([]byte(data), release); err != nil {
+		return nil, fmt.Errorf("invalid release %s: %s", version, err.Error())
+	}
+
+	defaults := DefaultRelease(version)
+	release.Version = version
+	if release.ISOURL == "" {
+		release.ISOURL = defaults.ISOURL
+	}
+	if release.KernelURL == "" {
+		release.KernelURL = defaults.KernelURL
+	}
+	if release.InitrdURL == "" {
+		release.InitrdURL = defaults.InitrdURL
+	}
+	if release.RootFSURL == "" {
+		release.RootFSURL = defaults.RootFSURL
+	}
+
+	return release, nil
+}
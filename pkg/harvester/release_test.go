@@ -0,0 +1,71 @@
+package harvester
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	api "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+)
+
+func TestParseRelease(t *testing.T) {
+	defaults := DefaultRelease("v1.0.3")
+
+	tests := []struct {
+		name    string
+		data    string
+		want    *api.HarvesterRelease
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			data: "",
+			want: defaults,
+		},
+		{
+			name: "overridden iso",
+			data: "isoUrl: https://mirror.example.com/harvester.iso",
+			want: &api.HarvesterRelease{
+				Version:   "v1.0.3",
+				ISOURL:    "https://mirror.example.com/harvester.iso",
+				KernelURL: defaults.KernelURL,
+				InitrdURL: defaults.InitrdURL,
+				RootFSURL: defaults.RootFSURL,
+			},
+		},
+		{
+			name:    "unknown field",
+			data:    "iso: https://mirror.example.com/harvester.iso",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRelease("v1.0.3", tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRelease() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRelease() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPXEScript(t *testing.T) {
+	script := IPXEScript("http://mirror/kernel", "http://mirror/initrd", "http://mirror/rootfs", "ttyS1,115200n8")
+
+	for _, want := range []string{
+		"#!ipxe\n",
+		"kernel http://mirror/kernel initrd=initrd ",
+		" console=ttyS1,115200n8 ",
+		" root=live:http://mirror/rootfs ",
+		" harvester.install.config_url=" + MetadataUserDataURL + "\n",
+		"initrd --name initrd http://mirror/initrd\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("IPXEScript() = %q, missing %q", script, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package harvester
+
+import (
+	"context"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	ServerVersionSetting = "server-version"
+)
+
+var SettingResource = schema.GroupVersionResource{
+	Group:    "harvesterhci.io",
+	Version:  "v1beta1",
+	Resource: "settings",
+}
+
+// SettingClient reads the cluster scoped harvester settings
+type SettingClient struct {
+	client dynamic.ResourceInterface
+}
+
+func NewSettingClient(client dynamic.Interface) *SettingClient {
+	return &SettingClient{
+		client: client.Resource(SettingResource),
+	}
+}
+
+// Get returns the value of a setting, falling back to its default
+func (s *SettingClient) Get(ctx context.Context, name string) (string, error) {
+	obj, err := s.client.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	value, _, _ := unstructured.NestedString(obj.Object, "value")
+	if value == "" {
+		value, _, _ = unstructured.NestedString(obj.Object, "default")
+	}
+
+	return value, nil
+}
+
+// ServerVersion returns the version of the running harvester cluster
+func (s *SettingClient) ServerVersion(ctx context.Context) (string, error) {
+	return s.Get(ctx, ServerVersionSetting)
+}
+
+// VersionsMatch compares harvester versions, ignoring the optional v prefix
+func VersionsMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "v") == strings.TrimPrefix(b, "v")
+}
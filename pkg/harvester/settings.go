@@ -0,0 +1,114 @@
+package harvester
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	RegistriesFilePath   = "/etc/rancher/rke2/registries.yaml"
+	AdditionalCAFilePath = "/etc/pki/trust/anchors/additional-ca.pem"
+)
+
+// DefaultNoProxy are the addresses of the node itself and of the cluster and service networks of
+// Harvester, which must never be sent through a proxy
+var DefaultNoProxy = []string{"localhost", "127.0.0.1", ".svc", ".cluster.local", "10.52.0.0/16", "10.53.0.0/16"}
+
+// NodeSettings are operator wide settings written into the config of every node, allowing nodes
+// to join from behind an egress proxy or pull images from a private registry
+type NodeSettings struct {
+	HTTPProxy       string
+	HTTPSProxy      string
+	NoProxy         string
+	RegistryMirrors map[string][]string
+	AdditionalCA    string
+}
+
+type registryMirror struct {
+	Endpoint []string `json:"endpoint"`
+}
+
+type registries struct {
+	Mirrors map[string]registryMirror `json:"mirrors"`
+}
+
+// ApplyNodeSettings adds the proxy environment, registry mirrors and CA bundle to the config.
+// NO_PROXY is always set, so nodes reach the cluster directly even when a proxy is only configured
+// by a pool override. It holds the configured exclusions, DefaultNoProxy and the addresses in noProxy.
+// Environment variables already set in the config are kept.
+func (c *HarvesterConfig) ApplyNodeSettings(s *NodeSettings, noProxy ...string) error {
+	if s.HTTPProxy != "" {
+		c.setDefaultEnvironment("HTTP_PROXY", s.HTTPProxy)
+	}
+	if s.HTTPSProxy != "" {
+		c.setDefaultEnvironment("HTTPS_PROXY", s.HTTPSProxy)
+	}
+
+	var exclusions []string
+	if s.NoProxy != "" {
+		exclusions = append(exclusions, s.NoProxy)
+	}
+	exclusions = append(exclusions, DefaultNoProxy...)
+	exclusions = append(exclusions, noProxy...)
+	c.setDefaultEnvironment("NO_PROXY", strings.Join(exclusions, ","))
+
+	if len(s.RegistryMirrors) != 0 {
+		r := registries{Mirrors: make(map[string]registryMirror, len(s.RegistryMirrors))}
+		for registry, endpoints := range s.RegistryMirrors {
+			r.Mirrors[registry] = registryMirror{Endpoint: endpoints}
+		}
+
+		content, err := yaml.Marshal(r)
+		if err != nil {
+			return err
+		}
+		c.WriteFiles = append(c.WriteFiles, File{
+			Content:            string(content),
+			Owner:              "root",
+			Path:               RegistriesFilePath,
+			RawFilePermissions: "0600",
+		})
+	}
+
+	if s.AdditionalCA != "" {
+		c.WriteFiles = append(c.WriteFiles, File{
+			Content:            s.AdditionalCA,
+			Owner:              "root",
+			Path:               AdditionalCAFilePath,
+			RawFilePermissions: "0644",
+		})
+
+		// the files are only written on boot, so the CA is also added to the trust store of the
+		// installed system, which is only rebuilt by update-ca-certificates
+		c.AfterInstallChrootCommands = append(c.AfterInstallChrootCommands, fmt.Sprintf("mkdir -p %s && echo %s | base64 -d > %s && update-ca-certificates",
+			path.Dir(AdditionalCAFilePath), base64.StdEncoding.EncodeToString([]byte(s.AdditionalCA)), AdditionalCAFilePath))
+	}
+
+	return nil
+}
+
+func (c *HarvesterConfig) setDefaultEnvironment(key, value string) {
+	if c.Environment == nil {
+		c.Environment = make(map[string]string)
+	}
+	if _, ok := c.Environment[key]; !ok {
+		c.Environment[key] = value
+	}
+}
+
+// ParseRegistryMirrors reads the endpoints of each mirrored registry, e.g.
+//
+//	docker.io:
+//	  - https://mirror.example.com
+func ParseRegistryMirrors(data string) (map[string][]string, error) {
+	mirrors := make(map[string][]string)
+	if err := yaml.UnmarshalStrict([]byte(data), &mirrors); err != nil {
+		return nil, fmt.Errorf("invalid registry mirrors: %s", err.Error())
+	}
+
+	return mirrors, nil
+}
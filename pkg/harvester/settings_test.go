@@ -0,0 +1,77 @@
+package harvester
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyNodeSettings(t *testing.T) {
+	defaults := strings.Join(DefaultNoProxy, ",")
+
+	tests := []struct {
+		name        string
+		environment map[string]string
+		settings    *NodeSettings
+		want        map[string]string
+		files       int
+		commands    int
+	}{
+		{
+			name:     "no proxy is always set",
+			settings: &NodeSettings{},
+			want:     map[string]string{"NO_PROXY": defaults + ",10.0.0.1"},
+		},
+		{
+			name:     "proxy",
+			settings: &NodeSettings{HTTPProxy: "http://proxy:3128", NoProxy: "example.com"},
+			want: map[string]string{
+				"HTTP_PROXY": "http://proxy:3128",
+				"NO_PROXY":   "example.com," + defaults + ",10.0.0.1",
+			},
+		},
+		{
+			name:        "environment of the config is kept",
+			environment: map[string]string{"HTTP_PROXY": "http://pool:3128", "NO_PROXY": "pool.local"},
+			settings:    &NodeSettings{HTTPProxy: "http://proxy:3128", HTTPSProxy: "http://proxy:3128"},
+			want: map[string]string{
+				"HTTP_PROXY":  "http://pool:3128",
+				"HTTPS_PROXY": "http://proxy:3128",
+				"NO_PROXY":    "pool.local",
+			},
+		},
+		{
+			name: "registry mirrors and ca",
+			settings: &NodeSettings{
+				RegistryMirrors: map[string][]string{"docker.io": {"https://mirror"}},
+				AdditionalCA:    "-----BEGIN CERTIFICATE-----",
+			},
+			want:     map[string]string{"NO_PROXY": defaults + ",10.0.0.1"},
+			files:    2,
+			commands: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &HarvesterConfig{OS: OS{Environment: tt.environment}}
+			if err := c.ApplyNodeSettings(tt.settings, "10.0.0.1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(c.Environment) != len(tt.want) {
+				t.Errorf("environment = %v, want %v", c.Environment, tt.want)
+			}
+			for k, v := range tt.want {
+				if c.Environment[k] != v {
+					t.Errorf("environment %s = %q, want %q", k, c.Environment[k], v)
+				}
+			}
+			if len(c.WriteFiles) != tt.files {
+				t.Errorf("got %d files, want %d", len(c.WriteFiles), tt.files)
+			}
+			if len(c.AfterInstallChrootCommands) != tt.commands {
+				t.Errorf("got %d commands, want %d", len(c.AfterInstallChrootCommands), tt.commands)
+			}
+		})
+	}
+}
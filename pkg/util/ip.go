@@ -0,0 +1,68 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// AllocateIP returns the first free IPv4 address in cidr, optionally limited to the range between
+// start and end. The network, broadcast and gateway addresses are never allocated.
+// The subnet mask of cidr is returned in dotted decimal notation.
+func AllocateIP(cidr, start, end, gateway string, used map[string]bool) (ip string, mask string, err error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid cidr %s: %v", cidr, err)
+	}
+
+	if ipNet.IP.To4() == nil {
+		return "", "", fmt.Errorf("cidr %s is not an IPv4 range", cidr)
+	}
+
+	network := binary.BigEndian.Uint32(ipNet.IP.To4())
+	ones, bits := ipNet.Mask.Size()
+	broadcast := network | (1<<uint(bits-ones) - 1)
+
+	first, last := network+1, broadcast-1
+	if start != "" {
+		if first, err = ipInNet(ipNet, start); err != nil {
+			return "", "", err
+		}
+	}
+
+	if end != "" {
+		if last, err = ipInNet(ipNet, end); err != nil {
+			return "", "", err
+		}
+	}
+
+	for addr := first; addr <= last && addr >= first; addr++ {
+		if addr == network || addr == broadcast {
+			continue
+		}
+
+		candidate := uint32ToIP(addr).String()
+		if candidate == gateway || used[candidate] {
+			continue
+		}
+
+		return candidate, net.IP(ipNet.Mask).String(), nil
+	}
+
+	return "", "", fmt.Errorf("no free addresses left in %s", cidr)
+}
+
+func ipInNet(ipNet *net.IPNet, addr string) (uint32, error) {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil || !ipNet.Contains(ip) {
+		return 0, fmt.Errorf("address %s is not part of %s", addr, ipNet.String())
+	}
+
+	return binary.BigEndian.Uint32(ip), nil
+}
+
+func uint32ToIP(addr uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, addr)
+	return ip
+}
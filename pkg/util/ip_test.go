@@ -0,0 +1,88 @@
+package util
+
+import "testing"
+
+func TestAllocateIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		start    string
+		end      string
+		gateway  string
+		used     map[string]bool
+		wantIP   string
+		wantMask string
+		wantErr  bool
+	}{
+		{
+			name:     "first address",
+			cidr:     "192.168.0.0/24",
+			wantIP:   "192.168.0.1",
+			wantMask: "255.255.255.0",
+		},
+		{
+			name:     "gateway and used addresses are skipped",
+			cidr:     "192.168.0.0/24",
+			gateway:  "192.168.0.1",
+			used:     map[string]bool{"192.168.0.2": true},
+			wantIP:   "192.168.0.3",
+			wantMask: "255.255.255.0",
+		},
+		{
+			name:     "start of range",
+			cidr:     "10.0.0.0/16",
+			start:    "10.0.1.10",
+			end:      "10.0.1.20",
+			wantIP:   "10.0.1.10",
+			wantMask: "255.255.0.0",
+		},
+		{
+			name:    "range exhausted",
+			cidr:    "10.0.0.0/16",
+			start:   "10.0.1.10",
+			end:     "10.0.1.11",
+			used:    map[string]bool{"10.0.1.10": true, "10.0.1.11": true},
+			wantErr: true,
+		},
+		{
+			name:     "broadcast is never allocated",
+			cidr:     "192.168.0.0/30",
+			used:     map[string]bool{"192.168.0.1": true},
+			wantIP:   "192.168.0.2",
+			wantMask: "255.255.255.252",
+		},
+		{
+			name:    "network without hosts",
+			cidr:    "192.168.0.0/31",
+			wantErr: true,
+		},
+		{
+			name:    "start outside cidr",
+			cidr:    "192.168.0.0/24",
+			start:   "192.168.1.1",
+			wantErr: true,
+		},
+		{
+			name:    "ipv6 cidr",
+			cidr:    "fd00::/64",
+			wantErr: true,
+		},
+		{
+			name:    "invalid cidr",
+			cidr:    "192.168.0.0",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, mask, err := AllocateIP(tt.cidr, tt.start, tt.end, tt.gateway, tt.used)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AllocateIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ip != tt.wantIP || mask != tt.wantMask {
+				t.Errorf("AllocateIP() = %s/%s, want %s/%s", ip, mask, tt.wantIP, tt.wantMask)
+			}
+		})
+	}
+}
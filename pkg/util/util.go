@@ -1,9 +1,14 @@
 package util
 
 import (
+	cryptorand "crypto/rand"
+	"math/big"
 	"math/rand"
+	"os"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func ContainsFinalizer(arr []string, key string) bool {
@@ -42,3 +47,41 @@ func LowerRandStringRunes(n int) string {
 	s := RandStringRunes(n)
 	return strings.ToLower(s)
 }
+
+const DefaultNamespace = "harvester-system"
+
+// OperatorNamespace returns the namespace the operator is deployed in, passed in via the downward api
+func OperatorNamespace() string {
+	namespace := os.Getenv("NAMESPACE")
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	return namespace
+}
+
+const passwordRunes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// GeneratePassword returns a random password of length n generated with crypto/rand
+func GeneratePassword(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(passwordRunes)))
+	for i := range b {
+		r, err := cryptorand.Int(cryptorand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = passwordRunes[r.Int64()]
+	}
+	return string(b), nil
+}
+
+// HashPassword returns the bcrypt hash of a password in crypt format, as accepted by the os
+// password of the harvester config
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
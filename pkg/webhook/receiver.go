@@ -0,0 +1,246 @@
+package webhook
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+	controller "github.com/harvester/harvester-equinix-addon/pkg/generated/controllers/equinix.harvesterhci.io/v1"
+	"github.com/harvester/harvester-equinix-addon/pkg/harvester"
+	"github.com/harvester/harvester-equinix-addon/pkg/util"
+	corecontrollers "github.com/rancher/wrangler/pkg/generated/controllers/core/v1"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	DefaultListenAddress = ":8081"
+	// TokenKey is the key of the token in the install webhook secret of an instance
+	TokenKey    = "token"
+	installPath = "/v1/install/"
+
+	EventStarted   = "STARTED"
+	EventSucceeded = "SUCCEEDED"
+	EventFailed    = "FAILED"
+
+	// StatusInstallFailed is the instance status after harvester reported a failed install
+	StatusInstallFailed = "installFailed"
+)
+
+// URL returns the url devices reach the install webhook receiver of the operator at. Install
+// webhooks are disabled when it is not set.
+func URL() string {
+	return strings.TrimSuffix(os.Getenv("INSTALL_WEBHOOK_URL"), "/")
+}
+
+// ListenAddress returns the address the install webhook receiver listens on
+func ListenAddress() string {
+	address := os.Getenv("INSTALL_WEBHOOK_LISTEN_ADDRESS")
+	if address == "" {
+		address = DefaultListenAddress
+	}
+
+	return address
+}
+
+// InstallWebhooks returns the harvester install webhooks reporting the progress of the install of
+// an instance to the receiver at baseURL, authenticated with the token of the instance
+func InstallWebhooks(baseURL, instance, token string) []harvester.Webhook {
+	var webhooks []harvester.Webhook
+	for _, event := range []string{EventStarted, EventSucceeded, EventFailed} {
+		webhooks = append(webhooks, harvester.Webhook{
+			Event:  event,
+			Method: http.MethodPost,
+			URL:    fmt.Sprintf("%s%s%s/%s", baseURL, installPath, instance, event),
+			Headers: map[string][]string{
+				"Authorization": {"Bearer " + token},
+			},
+		})
+	}
+
+	return webhooks
+}
+
+// TokenSecretName returns the name of the secret holding the install webhook token of an instance
+func TokenSecretName(instance string) string {
+	return fmt.Sprintf("%s-install-webhook", instance)
+}
+
+// Receiver records the install events reported by harvester in the Installed condition of the instance
+type Receiver struct {
+	instance controller.InstanceController
+	secret   corecontrollers.SecretController
+	handlers map[string]http.Handler
+}
+
+func NewReceiver(instance controller.InstanceController, secret corecontrollers.SecretController) *Receiver {
+	return &Receiver{
+		instance: instance,
+		secret:   secret,
+		handlers: make(map[string]http.Handler),
+	}
+}
+
+// Handle serves handler under pattern along with the install webhooks, for content devices download
+// during the install. It has to be called before Serve.
+func (r *Receiver) Handle(pattern string, handler http.Handler) {
+	r.handlers[pattern] = handler
+}
+
+// Serve handles install webhooks until the context is cancelled
+func (r *Receiver) Serve(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle(installPath, r)
+	for pattern, handler := range r.handlers {
+		mux.Handle(pattern, handler)
+	}
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, installPath), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, req)
+		return
+	}
+	name, event := parts[0], parts[1]
+
+	i, err := r.instance.Get(name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// don't reveal which instances exist to unauthenticated callers
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := r.token(i)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !authorized(req, token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if event != EventStarted && event != EventSucceeded && event != EventFailed {
+		http.Error(w, fmt.Sprintf("unknown event %s", event), http.StatusBadRequest)
+		return
+	}
+
+	logrus.Infof("instance %s reported install event %s", name, event)
+	if err := r.recordEvent(name, event); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	r.instance.Enqueue(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// token returns the install webhook token of the instance, which is empty when the instance has none
+func (r *Receiver) token(i *equinix.Instance) (string, error) {
+	secret, err := r.secret.Get(util.OperatorNamespace(), TokenSecretName(i.Name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// the secret of a deleted instance could be reused by a new one with the same name
+	for _, owner := range secret.OwnerReferences {
+		if owner.UID == i.UID {
+			return string(secret.Data[TokenKey]), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (r *Receiver) recordEvent(name, event string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		i, err := r.instance.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		iCopy := i.DeepCopy()
+		if !applyEvent(iCopy, event) {
+			logrus.Infof("ignoring install event %s of instance %s, which already reported %s", event, name,
+				equinix.InstanceInstalled.GetReason(i))
+			return nil
+		}
+
+		_, err = r.instance.UpdateStatus(iCopy)
+		return err
+	})
+}
+
+// applyEvent records the install event in the Installed condition of the instance. The outcome of
+// the install is final, so events reported after it are ignored and false is returned.
+func applyEvent(i *equinix.Instance, event string) bool {
+	if equinix.InstanceInstalled.IsTrue(i) || equinix.InstanceInstalled.IsFalse(i) {
+		return false
+	}
+
+	switch event {
+	case EventStarted:
+		equinix.InstanceInstalled.Unknown(i)
+		equinix.InstanceInstalled.Reason(i, "InstallStarted")
+		equinix.InstanceInstalled.Message(i, "")
+	case EventSucceeded:
+		equinix.InstanceInstalled.True(i)
+		equinix.InstanceInstalled.Reason(i, "InstallSucceeded")
+		equinix.InstanceInstalled.Message(i, "")
+	case EventFailed:
+		equinix.InstanceInstalled.False(i)
+		equinix.InstanceInstalled.Reason(i, "InstallFailed")
+		equinix.InstanceInstalled.Message(i, "harvester reported a failed install")
+		// stop waiting for the node to join, unless it already did
+		if i.Status.Status != "managed" {
+			i.Status.Status = StatusInstallFailed
+		}
+	}
+
+	return true
+}
+
+func authorized(req *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	provided := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
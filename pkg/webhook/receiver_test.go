@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"testing"
+
+	equinix "github.com/harvester/harvester-equinix-addon/pkg/apis/equinix.harvesterhci.io/v1"
+)
+
+func TestApplyEvent(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		events      []string
+		wantApplied bool
+		wantReason  string
+		wantStatus  string
+	}{
+		{
+			name:        "started",
+			status:      "reinstalling",
+			events:      []string{EventStarted},
+			wantApplied: true,
+			wantReason:  "InstallStarted",
+			wantStatus:  "reinstalling",
+		},
+		{
+			name:        "succeeded",
+			status:      "reinstalling",
+			events:      []string{EventStarted, EventSucceeded},
+			wantApplied: true,
+			wantReason:  "InstallSucceeded",
+			wantStatus:  "reinstalling",
+		},
+		{
+			name:        "failed",
+			status:      "reinstalling",
+			events:      []string{EventStarted, EventFailed},
+			wantApplied: true,
+			wantReason:  "InstallFailed",
+			wantStatus:  StatusInstallFailed,
+		},
+		{
+			name:        "failed after the node joined",
+			status:      "managed",
+			events:      []string{EventFailed},
+			wantApplied: true,
+			wantReason:  "InstallFailed",
+			wantStatus:  "managed",
+		},
+		{
+			name:       "late started after succeeded",
+			status:     "ready",
+			events:     []string{EventSucceeded, EventStarted},
+			wantReason: "InstallSucceeded",
+			wantStatus: "ready",
+		},
+		{
+			name:       "failed after succeeded",
+			status:     "ready",
+			events:     []string{EventSucceeded, EventFailed},
+			wantReason: "InstallSucceeded",
+			wantStatus: "ready",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := &equinix.Instance{}
+			i.Status.Status = tt.status
+
+			var applied bool
+			for _, event := range tt.events {
+				applied = applyEvent(i, event)
+			}
+
+			if applied != tt.wantApplied {
+				t.Errorf("applyEvent() = %v, want %v", applied, tt.wantApplied)
+			}
+			if reason := equinix.InstanceInstalled.GetReason(i); reason != tt.wantReason {
+				t.Errorf("Installed reason = %s, want %s", reason, tt.wantReason)
+			}
+			if i.Status.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", i.Status.Status, tt.wantStatus)
+			}
+		})
+	}
+}